@@ -0,0 +1,4 @@
+// +k8s:deepcopy-gen=package
+
+// Package v1alpha1 HelmApp custom resource, registered under each watched kind
+package v1alpha1
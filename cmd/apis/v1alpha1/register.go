@@ -0,0 +1,23 @@
+package v1alpha1
+
+import (
+	sdkK8sutil "github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+//AddKnownKind registers HelmApp as <kind> of <apiVersion> with the sdk scheme
+func AddKnownKind(apiVersion, kind string) error {
+	groupVersion, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return err
+	}
+	sdkK8sutil.AddToSDKScheme(func(scheme *runtime.Scheme) error {
+		scheme.AddKnownTypeWithName(groupVersion.WithKind(kind), &HelmApp{})
+		scheme.AddKnownTypeWithName(groupVersion.WithKind(kind+"List"), &HelmAppList{})
+		metav1.AddToGroupVersion(scheme, groupVersion)
+		return nil
+	})
+	return nil
+}
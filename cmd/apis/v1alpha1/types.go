@@ -1,3 +1,21 @@
+// Copyright 2018 CoreOS, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Copied from github.com/operator-framework/helm-app-operator-kit (helm-app-operator/pkg/apis/app/v1alpha1),
+// see LICENSE and NOTICE in this directory.
+// Modified: chart status, hook outputs and condition reasons of this operator added.
+
 package v1alpha1
 
 import (
@@ -45,15 +63,31 @@ const (
 	ReasonCustomResourceUpdated ConditionReason = "CustomResourceUpdated"
 	ReasonApplySuccessful       ConditionReason = "ApplySuccessful"
 	ReasonApplyFailed           ConditionReason = "ApplyFailed"
+
+	ReasonChartVerificationFailed ConditionReason = "ChartVerificationFailed"
+	ReasonValuesInvalid           ConditionReason = "ValuesInvalid"
+	ReasonHookTimedOut            ConditionReason = "HookTimedOut"
 )
 
 type HelmAppStatus struct {
-	Release            *release.Release `json:"release"`
-	Phase              ResourcePhase    `json:"phase"`
-	Reason             ConditionReason  `json:"reason,omitempty"`
-	Message            string           `json:"message,omitempty"`
-	LastUpdateTime     metav1.Time      `json:"lastUpdateTime,omitempty"`
-	LastTransitionTime metav1.Time      `json:"lastTransitionTime,omitempty"`
+	Release            *release.Release    `json:"release"`
+	Chart              *HelmAppChartStatus `json:"chart,omitempty"`
+	Phase              ResourcePhase       `json:"phase"`
+	Reason             ConditionReason     `json:"reason,omitempty"`
+	Message            string              `json:"message,omitempty"`
+	LastUpdateTime     metav1.Time         `json:"lastUpdateTime,omitempty"`
+	LastTransitionTime metav1.Time         `json:"lastTransitionTime,omitempty"`
+	// Outputs are values written by hooks to EVENT_OUTPUT, by hook, merged into release values until the hook runs again.
+	Outputs map[string]HelmAppSpec `json:"outputs,omitempty"`
+}
+
+// HelmAppChartStatus records the chart source resolved for the release.
+// Digest is the sha256 of the chart archive, Revision the immutable revision of the source (eg. OCI manifest digest).
+type HelmAppChartStatus struct {
+	Source   string `json:"source,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Revision string `json:"revision,omitempty"`
 }
 
 func (s *HelmAppStatus) ToMap() (map[string]interface{}, error) {
@@ -1,3 +1,21 @@
+// Copyright 2018 CoreOS, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Copied from github.com/operator-framework/helm-app-operator-kit (helm-app-operator/pkg/apis/app/v1alpha1),
+// see LICENSE and NOTICE in this directory.
+// Modified: regenerated for the types added in types.go.
+
 // +build !ignore_autogenerated
 
 // Code generated by deepcopy-gen. DO NOT EDIT.
@@ -14,7 +32,7 @@ func (in *HelmApp) DeepCopyInto(out *HelmApp) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -36,6 +54,22 @@ func (in *HelmApp) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HelmAppChartStatus) DeepCopyInto(out *HelmAppChartStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HelmAppChartStatus.
+func (in *HelmAppChartStatus) DeepCopy() *HelmAppChartStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(HelmAppChartStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *HelmAppList) DeepCopyInto(out *HelmAppList) {
 	*out = *in
@@ -88,6 +122,18 @@ func (in *HelmAppSpec) DeepCopy() *HelmAppSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *HelmAppStatus) DeepCopyInto(out *HelmAppStatus) {
 	*out = *in
+	if in.Chart != nil {
+		in, out := &in.Chart, &out.Chart
+		*out = new(HelmAppChartStatus)
+		**out = **in
+	}
+	if in.Outputs != nil {
+		in, out := &in.Outputs, &out.Outputs
+		*out = make(map[string]HelmAppSpec, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	return
 }
 
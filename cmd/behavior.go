@@ -1,31 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
-	"net/url"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/xiaopal/helm-app-operator/cmd/option"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/helm/pkg/chartutil"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
 
-	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/apis/app/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
 	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+	"github.com/xiaopal/helm-app-operator/cmd/schema"
 )
 
 type installerBehavior struct {
-	clientset internalclientset.Interface
+	operator *option.Operator
+	objects  objectSource
+	cache    *charts.Cache
+	poller   *chartPoller
+	watcher  *chartWatcher
 }
 
 func (c installerBehavior) ReleaseValues(raw *v1alpha1.HelmApp) (map[string]interface{}, error) {
-	clientset := c.clientset
 	namespace, name := raw.GetNamespace(), raw.GetName()
 	valueYamls := [][]byte{}
-	if cfgmap, err := clientset.Core().ConfigMaps(namespace).Get(name, metav1.GetOptions{}); err == nil {
+	if cfgmap, err := c.objects.ConfigMap(namespace, name); err == nil {
 		for _, key := range []string{"values.yaml", "values"} {
 			if valueYaml, ok := cfgmap.Data[key]; ok {
 				valueYamls = append(valueYamls, []byte(valueYaml))
@@ -34,7 +44,7 @@ func (c installerBehavior) ReleaseValues(raw *v1alpha1.HelmApp) (map[string]inte
 	} else if !apierrors.IsNotFound(err) {
 		return nil, err
 	}
-	if secret, err := clientset.Core().Secrets(namespace).Get(name, metav1.GetOptions{}); err == nil {
+	if secret, err := c.objects.Secret(namespace, name); err == nil {
 		for _, key := range []string{"values.yaml", "values"} {
 			if valueYaml, ok := secret.Data[key]; ok {
 				valueYamls = append(valueYamls, valueYaml)
@@ -44,7 +54,11 @@ func (c installerBehavior) ReleaseValues(raw *v1alpha1.HelmApp) (map[string]inte
 		return nil, err
 	}
 
-	return option.DecorateValues(raw.Spec, valueYamls)
+	outputs, err := hookOutputs(raw)
+	if err != nil {
+		return nil, err
+	}
+	return c.operator.DecorateValues(raw.Spec, append(valueYamls, outputs...))
 }
 
 func (c installerBehavior) OptionForce(r *v1alpha1.HelmApp) bool {
@@ -52,46 +66,437 @@ func (c installerBehavior) OptionForce(r *v1alpha1.HelmApp) bool {
 }
 
 func (c installerBehavior) Logger(r *v1alpha1.HelmApp) func(string, ...interface{}) {
-	return option.NewLogger("tiller").Printf
+	return resourceLogger(r, "tiller").Printf
 }
 
 func (c installerBehavior) TranslateChartPath(r *v1alpha1.HelmApp, chartPath string) (string, error) {
 	chart, chartSrc := helmext.ReleaseOption(r, helmext.OptionChart, ""), ""
+	r.Status.Chart = nil
+	c.poller.Untrack(r)
+	c.watcher.Untrack(r)
 	if chart != "" {
-		if strings.HasPrefix(chart, "http://") || strings.HasPrefix(chart, "https://") {
-			uri, err := url.Parse(chart)
-			if err != nil {
-				return "", err
-			}
-			name := filepath.Base(uri.Path)
-			name = strings.TrimSuffix(name, ".tgz")
-			name = strings.TrimSuffix(name, ".tar.gz")
-			chartPath = filepath.Join(chartPath, name)
-			chartSrc = chart
+		if ref, err := parseChartObjectRef(r.GetNamespace(), chart); err != nil || ref != nil {
+			//loaded by ReadChart
+			return chart, err
+		} else if strings.HasPrefix(chart, "http://") || strings.HasPrefix(chart, "https://") {
+			return c.fetchURLChart(r, chart)
+		} else if charts.IsOCIReference(chart) {
+			return c.fetchOCIChart(r, chart)
+		} else if charts.IsGitReference(chart) {
+			return c.fetchGitChart(r, chart)
 		} else if filepath.IsAbs(chart) {
 			chartPath = chart
+		} else if repo, name := c.repositoryChart(chart); repo != nil {
+			return c.fetchRepositoryChart(r, repo, name)
 		} else {
 			chartPath = filepath.Join(chartPath, chart)
 			chartSrc = chart
 		}
 	}
-	return fetchChart(r, chart, chartPath, chartSrc)
+	if _, err := c.verifyChart(r, ""); err != nil {
+		return "", err
+	}
+	return c.fetchChart(r, chart, chartPath, chartSrc)
 }
 
-func fetchChart(r *v1alpha1.HelmApp, chart string, chartPath string, chartSrc string) (string, error) {
-	fetchAlways := strings.ToLower(helmext.ReleaseOption(r, "fetch", "")) == "always"
+func (c installerBehavior) fetchChart(r *v1alpha1.HelmApp, chart string, chartPath string, chartSrc string) (string, error) {
+	fetchAlways, maxAge := c.fetchAlways(r)
 	if _, err := os.Stat(chartPath); !os.IsNotExist(err) && !fetchAlways {
 		return chartPath, nil
 	}
 	if option.OptionFetchExec == "" {
 		return "", fmt.Errorf("chart %s not exists and --fetch-exec not present", chartPath)
 	}
-	if err := execEvent(r, "chart", option.OptionFetchExec,
-		fmt.Sprintf("FETCH_CHART=%s", chart),
-		fmt.Sprintf("FETCH_CHART_TO=%s", chartPath),
-		fmt.Sprintf("FETCH_CHART_FROM=%s", chartSrc),
-	); err != nil {
+	return c.cache.Get("exec:"+chartPath, maxAge, func(dir string) error {
+		return execEvent(c.operator, r, "chart", option.OptionFetchExec,
+			fmt.Sprintf("FETCH_CHART=%s", chart),
+			fmt.Sprintf("FETCH_CHART_TO=%s", dir),
+			fmt.Sprintf("FETCH_CHART_FROM=%s", chartSrc),
+		)
+	})
+}
+
+//fetchAlways whether fetch option is 'always', and max age of cached chart
+func (c installerBehavior) fetchAlways(r *v1alpha1.HelmApp) (bool, time.Duration) {
+	if strings.ToLower(helmext.ReleaseOption(r, "fetch", "")) == "always" {
+		return true, time.Duration(option.OptionChartRefresh) * time.Second
+	}
+	return false, 0
+}
+
+func (c installerBehavior) ReadChart(r *v1alpha1.HelmApp, chartPath string) (*cpb.Chart, error) {
+	var chart *cpb.Chart
+	if ref, err := parseChartObjectRef(r.GetNamespace(), chartPath); err != nil {
+		return nil, err
+	} else if ref != nil {
+		if chart, err = c.readObjectChart(r, ref); err != nil {
+			return nil, err
+		}
+	} else if chart, err = c.cache.Load(chartPath); err != nil {
+		return nil, err
+	}
+	if err := c.resolveDependencies(r, chart, chartPath); err != nil {
+		return nil, err
+	}
+	return chart, nil
+}
+
+//readObjectChart loads chart archive of ConfigMap binaryData or Secret data in memory
+func (c installerBehavior) readObjectChart(r *v1alpha1.HelmApp, ref *chartObjectRef) (*cpb.Chart, error) {
+	data, resourceVersion, err := c.chartObjectData(ref)
+	if err != nil {
+		return nil, err
+	}
+	archive, ok := data[ref.Key]
+	if !ok {
+		c.watcher.Track(r, ref, "")
+		return nil, fmt.Errorf("chart %s not found", ref)
+	}
+	c.watcher.Track(r, ref, charts.Digest(archive))
+	if helmext.ReleaseOptionBool(r, helmext.OptionVerify, option.OptionVerify) {
+		return nil, &charts.VerificationError{Message: fmt.Sprintf("provenance of chart %s cannot be verified, use chart-digest", ref)}
+	}
+	digest, err := charts.VerifyDigest(archive, helmext.ReleaseOption(r, helmext.OptionChartDigest, ""))
+	if err != nil {
+		return nil, err
+	}
+	chart, err := chartutil.LoadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chart %s: %v", ref, err)
+	}
+	r.Status.Chart = &v1alpha1.HelmAppChartStatus{
+		Source:   ref.String(),
+		Digest:   digest,
+		Revision: resourceVersion,
+	}
+	return chart, nil
+}
+
+//chartObjectData binaryData of ConfigMap or data of Secret referenced, and its resource version
+func (c installerBehavior) chartObjectData(ref *chartObjectRef) (map[string][]byte, string, error) {
+	switch ref.Kind {
+	case "ConfigMap":
+		cfgmap, err := c.objects.ConfigMap(ref.Namespace, ref.Name)
+		if err != nil {
+			return nil, "", err
+		}
+		return cfgmap.BinaryData, cfgmap.ResourceVersion, nil
+	case "Secret":
+		secret, err := c.objects.Secret(ref.Namespace, ref.Name)
+		if err != nil {
+			return nil, "", err
+		}
+		return secret.Data, secret.ResourceVersion, nil
+	}
+	return nil, "", fmt.Errorf("unknown chart object %s", ref)
+}
+
+//ValidateValues validates values merged over chart defaults against values schema
+func (c installerBehavior) ValidateValues(r *v1alpha1.HelmApp, chart *cpb.Chart, values map[string]interface{}) error {
+	s, err := c.valuesSchema(chart)
+	if err != nil || s == nil {
+		return err
+	}
+	defaults, err := chartutil.ReadValues([]byte(chart.GetValues().GetRaw()))
+	if err != nil {
+		return fmt.Errorf("failed to parse values of chart %s: %v", chart.GetMetadata().GetName(), err)
+	}
+	merged := option.MergeValues(defaults, values)
+	return s.Validate(merged, helmext.ReleaseOptionBool(r, helmext.OptionStrictValues, option.OptionStrictValues))
+}
+
+//valuesSchema schema of --values-schema or values.schema.json of chart, nil if none
+func (c installerBehavior) valuesSchema(chart *cpb.Chart) (*schema.Schema, error) {
+	if schemaFile := c.operator.ValuesSchemaFile(); schemaFile != "" {
+		data, err := ioutil.ReadFile(schemaFile)
+		if err != nil {
+			return nil, err
+		}
+		return schema.Parse(data)
+	}
+	for _, f := range chart.GetFiles() {
+		if f.GetTypeUrl() == "values.schema.json" {
+			return schema.Parse(f.GetValue())
+		}
+	}
+	return nil, nil
+}
+
+func (c installerBehavior) repositoryChart(chart string) (*charts.Repository, string) {
+	parts := strings.Split(chart, "/")
+	if len(parts) != 2 {
+		return nil, ""
+	}
+	return option.OptionRepositories[parts[0]], parts[1]
+}
+
+func (c installerBehavior) fetchRepositoryChart(r *v1alpha1.HelmApp, repo *charts.Repository, name string) (string, error) {
+	version := helmext.ReleaseOption(r, helmext.OptionChartVersion, "")
+	verification, err := c.chartVerification(r)
+	if err != nil {
+		return "", err
+	}
+	var chartPath, resolved string
+	if err := withFetchTimeout(r, func(ctx context.Context) (err error) {
+		chartPath, resolved, err = repo.Fetch(ctx, c.cache, name, version, verification)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	resourceLogger(r, "chart").Debugf("resolved %s/%s version %q to %s", repo.Name, name, version, resolved)
+	digest, err := c.verifyChart(r, chartPath+".tgz")
+	if err != nil {
 		return "", err
 	}
+	r.Status.Chart = &v1alpha1.HelmAppChartStatus{
+		Source:  fmt.Sprintf("%s/%s", repo.Name, name),
+		Version: resolved,
+		Digest:  digest,
+	}
+	return chartPath, nil
+}
+
+func (c installerBehavior) fetchURLChart(r *v1alpha1.HelmApp, chart string) (string, error) {
+	_, maxAge := c.fetchAlways(r)
+	verification, err := c.chartVerification(r)
+	if err != nil {
+		return "", err
+	}
+	var chartPath string
+	if err := withFetchTimeout(r, func(ctx context.Context) (err error) {
+		chartPath, err = charts.FetchURL(ctx, c.cache, chart, maxAge, verification)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	digest, err := c.verifyChart(r, chartPath+".tgz")
+	if err != nil {
+		return "", err
+	}
+	r.Status.Chart = &v1alpha1.HelmAppChartStatus{
+		Source: chart,
+		Digest: digest,
+	}
 	return chartPath, nil
 }
+
+func (c installerBehavior) fetchOCIChart(r *v1alpha1.HelmApp, chart string) (string, error) {
+	ref, err := charts.ParseOCIReference(chart, helmext.ReleaseOption(r, helmext.OptionChartVersion, ""))
+	if err != nil {
+		return "", err
+	}
+	registry, err := c.ociRegistry(r)
+	if err != nil {
+		return "", err
+	}
+	_, maxAge := c.fetchAlways(r)
+	var chartPath, manifestDigest string
+	if err := withFetchTimeout(r, func(ctx context.Context) (err error) {
+		chartPath, manifestDigest, err = registry.Fetch(ctx, c.cache, ref, maxAge)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	resourceLogger(r, "chart").Debugf("resolved %s to %s", ref, manifestDigest)
+	digest, err := c.verifyChart(r, chartPath+".tgz")
+	if err != nil {
+		return "", err
+	}
+	r.Status.Chart = &v1alpha1.HelmAppChartStatus{
+		Source:   fmt.Sprintf("oci://%s/%s", ref.Registry, ref.Repository),
+		Version:  ref.Tag,
+		Digest:   digest,
+		Revision: manifestDigest,
+	}
+	return chartPath, nil
+}
+
+func (c installerBehavior) fetchGitChart(r *v1alpha1.HelmApp, chart string) (string, error) {
+	ref, git, err := c.gitChart(r, chart)
+	if err != nil {
+		return "", err
+	}
+	var commit, name string
+	var branch bool
+	if err := withFetchTimeout(r, func(ctx context.Context) (err error) {
+		commit, name, branch, err = git.Resolve(ctx, ref)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	resourceLogger(r, "chart").Debugf("resolved %s to %s", ref, commit)
+	if _, err := c.verifyChart(r, ""); err != nil {
+		return "", err
+	}
+	var chartPath string
+	if err := withFetchTimeout(r, func(ctx context.Context) (err error) {
+		chartPath, err = git.Checkout(ctx, c.cache, ref, commit, name)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	if branch {
+		c.trackGitChart(r, git, ref, commit)
+	}
+	r.Status.Chart = &v1alpha1.HelmAppChartStatus{
+		Source:   gitChartSource(ref),
+		Version:  ref.Ref,
+		Revision: commit,
+	}
+	return chartPath, nil
+}
+
+//gitChart git reference of chart and client with credentials of chart-pull-secret option
+func (c installerBehavior) gitChart(r *v1alpha1.HelmApp, chart string) (*charts.GitReference, *charts.Git, error) {
+	ref, err := charts.ParseGitReference(chart, helmext.ReleaseOption(r, helmext.OptionChartVersion, ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	git := &charts.Git{}
+	if _, secret, err := c.chartPullSecret(r); err != nil {
+		return nil, nil, err
+	} else if secret != nil {
+		git.Username, git.Password = string(secret["username"]), string(secret["password"])
+	}
+	return ref, git, nil
+}
+
+func gitChartSource(ref *charts.GitReference) string {
+	return fmt.Sprintf("git+%s//%s", ref.Repository, ref.Path)
+}
+
+//trackGitChart polls ref resolved to commit, until it turns out not to be a branch
+func (c installerBehavior) trackGitChart(r *v1alpha1.HelmApp, git *charts.Git, ref *charts.GitReference, commit string) {
+	c.poller.Track(r, commit, func() (commit string, branch bool, err error) {
+		err = withFetchTimeout(r, func(ctx context.Context) (err error) {
+			commit, _, branch, err = git.Resolve(ctx, ref)
+			return err
+		})
+		return commit, branch, err
+	})
+}
+
+//TrackChart tracks moving chart or chart object of r as recorded in status, on every event of r,
+//so that charts of resources not reconciled again (eg. unchanged after restart) are polled or watched as well
+func (c installerBehavior) TrackChart(r *v1alpha1.HelmApp) {
+	chart, status := helmext.ReleaseOption(r, helmext.OptionChart, ""), r.Status.Chart
+	if ref, err := parseChartObjectRef(r.GetNamespace(), chart); err != nil || ref != nil {
+		if ref == nil || c.watcher.Tracked(r) {
+			return
+		}
+		if status == nil {
+			//never loaded, any archive triggers an upgrade
+			c.watcher.Track(r, ref, "")
+		} else if status.Source == ref.String() {
+			c.watcher.Track(r, ref, status.Digest)
+		} else {
+			return
+		}
+		//changed while not watched
+		if data, _, err := c.chartObjectData(ref); err == nil {
+			c.watcher.changed(ref.Kind, ref.Namespace, ref.Name, data)
+		}
+		return
+	}
+	if status == nil || !charts.IsGitReference(chart) || c.poller.Tracked(r) {
+		return
+	}
+	ref, git, err := c.gitChart(r, chart)
+	if err != nil || status.Source != gitChartSource(ref) || status.Version != ref.Ref || status.Revision == "" {
+		return
+	}
+	c.trackGitChart(r, git, ref, status.Revision)
+}
+
+//withFetchTimeout runs native fetch of chart limited by chart-timeout option (or --hook-timeout) as --fetch-exec is,
+//cancelled on operator shutdown
+func withFetchTimeout(r *v1alpha1.HelmApp, fetch func(ctx context.Context) error) error {
+	timeout, err := hookTimeout(r, "chart")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(hookContext)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(hookContext, timeout)
+	}
+	defer cancel()
+	runningHooks.Add(1)
+	defer runningHooks.Done()
+	if err := fetch(ctx); err != nil {
+		if hookContext.Err() != nil {
+			return fmt.Errorf("chart cancelled on shutdown")
+		} else if ctx.Err() != nil {
+			return &hookTimeoutError{"chart", timeout}
+		}
+		return err
+	}
+	return nil
+}
+
+//ociRegistries registry clients by operator and chart pull secret, shared across reconciles to reuse tokens and resolved tags
+var ociRegistries sync.Map
+
+//ociRegistry registry client with credentials of chart-pull-secret option
+func (c installerBehavior) ociRegistry(r *v1alpha1.HelmApp) (*charts.Registry, error) {
+	secretName, secret, err := c.chartPullSecret(r)
+	if err != nil {
+		return nil, err
+	}
+	config, ok := secret[".dockerconfigjson"]
+	if !ok {
+		config = secret[".dockercfg"]
+	}
+	key := fmt.Sprintf("%s/%x", c.operator.Name, sha256.Sum256(config))
+	if registry, ok := ociRegistries.Load(key); ok {
+		return registry.(*charts.Registry), nil
+	}
+	registry := &charts.Registry{PlainHTTP: option.OptionPlainHTTPRegistries}
+	if secret != nil {
+		if registry.Config, err = charts.ParseDockerConfig(config); err != nil {
+			return nil, fmt.Errorf("chart pull secret %s: %v", secretName, err)
+		}
+	}
+	shared, _ := ociRegistries.LoadOrStore(key, registry)
+	return shared.(*charts.Registry), nil
+}
+
+//chartPullSecret data of chart-pull-secret option, nil if not present
+func (c installerBehavior) chartPullSecret(r *v1alpha1.HelmApp) (string, map[string][]byte, error) {
+	secretName := helmext.ReleaseOption(r, helmext.OptionChartPullSecret, option.OptionChartPullSecret)
+	if secretName == "" {
+		return "", nil, nil
+	}
+	secret, err := c.objects.Secret(r.GetNamespace(), secretName)
+	if err != nil {
+		return secretName, nil, fmt.Errorf("failed to get chart pull secret %s: %v", secretName, err)
+	}
+	return secretName, secret.Data, nil
+}
+
+//chartVerification chart-digest option and keyring if verification required
+func (c installerBehavior) chartVerification(r *v1alpha1.HelmApp) (charts.Verification, error) {
+	verification := charts.Verification{Digest: helmext.ReleaseOption(r, helmext.OptionChartDigest, "")}
+	if helmext.ReleaseOptionBool(r, helmext.OptionVerify, option.OptionVerify) {
+		if option.OptionKeyring == "" {
+			return verification, &charts.VerificationError{Message: "chart verification required but --keyring not present"}
+		}
+		verification.Keyring = option.OptionKeyring
+	}
+	return verification, nil
+}
+
+//verifyChart verifies chart archive against chart-digest option and provenance if required, returns archive digest.
+//Fetched archives are verified before stored as well, this covers archives cached before
+func (c installerBehavior) verifyChart(r *v1alpha1.HelmApp, archivePath string) (string, error) {
+	verification, err := c.chartVerification(r)
+	if err != nil {
+		return "", err
+	}
+	if archivePath == "" {
+		if verification != (charts.Verification{}) {
+			return "", &charts.VerificationError{Message: "chart directory cannot be verified, use a chart archive source"}
+		}
+		return "", nil
+	}
+	return charts.Verify(archivePath, verification.Digest, verification.Keyring)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"k8s.io/helm/pkg/chartutil"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+//testBehavior installer behavior of a test operator with a chart cache in a temp dir, removed on cleanup
+func testBehavior(t *testing.T) (installerBehavior, func()) {
+	dir, err := ioutil.TempDir("", "behavior-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := loadFileObjects(nil, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &option.Operator{Name: "test-operator", CRD: "TestApp,testapps.example.com/v1", CRDKind: "TestApp", APIVersion: "example.com/v1"}
+	helmext.RegisterOperator(op.APIVersion, op.CRDKind, op.Name)
+	behavior := installerBehavior{op, objects, charts.NewCache(filepath.Join(dir, "cache"), 0, 0), newChartPoller(), newChartWatcher()}
+	return behavior, func() { os.RemoveAll(dir) }
+}
+
+//testResource resource of test operator with annotations as options
+func testResource(options map[string]string) *v1alpha1.HelmApp {
+	r := &v1alpha1.HelmApp{Spec: v1alpha1.HelmAppSpec{}}
+	r.APIVersion, r.Kind = "example.com/v1", "TestApp"
+	helmext.RegisterOperator(r.APIVersion, r.Kind, "test-operator")
+	r.SetNamespace("default")
+	r.SetName("test")
+	annotations := map[string]string{}
+	for k, v := range options {
+		annotations["test-operator/"+k] = v
+	}
+	r.SetAnnotations(annotations)
+	return r
+}
+
+//testChartArchive archive of a minimal chart of name and version
+func testChartArchive(t *testing.T, name string, version string) []byte {
+	dir, err := ioutil.TempDir("", "chart-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := chartutil.Save(&cpb.Chart{Metadata: &cpb.Metadata{ApiVersion: "v1", Name: name, Version: version}}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestReleaseValuesKeepsSpec(t *testing.T) {
+	op := &option.Operator{Name: "test-operator", CRD: "TestApp,testapps.example.com/v1"}
+	objects, err := loadFileObjects(nil, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	behavior := installerBehavior{operator: op, objects: objects}
+	r := &v1alpha1.HelmApp{Spec: v1alpha1.HelmAppSpec{"db": map[string]interface{}{"host": "x"}}}
+	r.SetNamespace("default")
+	r.SetName("test")
+	r.Status.Outputs = map[string]v1alpha1.HelmAppSpec{"pre-install": {"db": map[string]interface{}{"password": "secret"}}}
+	values, err := behavior.ReleaseValues(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (v1alpha1.HelmAppSpec{"db": map[string]interface{}{"host": "x"}}); !reflect.DeepEqual(r.Spec, expected) {
+		t.Errorf("spec changed to %v", r.Spec)
+	}
+	if db := values["db"].(map[string]interface{}); db["host"] != "x" || db["password"] != "secret" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestRepositoryChartStatus(t *testing.T) {
+	archives := map[string][]byte{}
+	index := "apiVersion: v1\nentries:\n  redis:\n"
+	for _, version := range []string{"1.2.0", "1.2.7", "1.3.0"} {
+		archives[fmt.Sprintf("/redis-%s.tgz", version)] = testChartArchive(t, "redis", version)
+		index += fmt.Sprintf("  - {name: redis, version: %s, urls: [redis-%s.tgz]}\n", version, version)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/index.yaml" {
+			w.Write([]byte(index))
+		} else if archive, ok := archives[req.URL.Path]; ok {
+			w.Write(archive)
+		} else {
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	repo, err := charts.ParseRepository("test=" + server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	option.OptionRepositories = map[string]*charts.Repository{repo.Name: repo}
+	defer func() { option.OptionRepositories = nil }()
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+
+	r := testResource(map[string]string{"chart": "test/redis", "chart-version": "~1.2"})
+	chartPath, err := behavior.TranslateChartPath(r, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(chartPath, "Chart.yaml")); err != nil {
+		t.Errorf("chart not expanded: %v", err)
+	}
+	if r.Status.Chart == nil || r.Status.Chart.Source != "test/redis" || r.Status.Chart.Version != "1.2.7" || r.Status.Chart.Digest == "" {
+		t.Errorf("unexpected chart status %+v", r.Status.Chart)
+	}
+}
+
+func TestTrackChart(t *testing.T) {
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+
+	r := testResource(map[string]string{"chart": "git+file:///srv/charts//redis?ref=main"})
+	behavior.TrackChart(r)
+	if behavior.poller.Tracked(r) {
+		t.Errorf("tracked chart never fetched")
+	}
+	r.Status.Chart = &v1alpha1.HelmAppChartStatus{Source: "git+file:///srv/charts//redis", Version: "main", Revision: commit}
+	behavior.TrackChart(r)
+	if !behavior.poller.Tracked(r) || behavior.poller.tracked[pollKey(r)].revision != commit {
+		t.Errorf("chart fetched before not tracked")
+	}
+
+	other := testResource(map[string]string{"chart": "git+file:///srv/charts//redis?ref=v2"})
+	other.SetName("other")
+	other.Status.Chart = r.Status.Chart
+	behavior.TrackChart(other)
+	if behavior.poller.Tracked(other) {
+		t.Errorf("tracked chart of outdated status")
+	}
+}
+
+func TestTrackChartObject(t *testing.T) {
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+
+	r := testResource(map[string]string{"chart": "configmap://charts/redis.tgz"})
+	r.Status.Chart = &v1alpha1.HelmAppChartStatus{Source: "configmap://charts/redis.tgz", Digest: "sha256:abc"}
+	behavior.TrackChart(r)
+	if watched, ok := behavior.watcher.tracked[pollKey(r)]; !ok || watched.digest != "sha256:abc" || watched.ref.Name != "charts" {
+		t.Errorf("chart object loaded before not tracked")
+	}
+
+	missing := testResource(map[string]string{"chart": "secret://charts/redis.tgz"})
+	missing.SetName("missing")
+	behavior.TrackChart(missing)
+	if watched, ok := behavior.watcher.tracked[pollKey(missing)]; !ok || watched.digest != "" {
+		t.Errorf("chart object never loaded not tracked")
+	}
+}
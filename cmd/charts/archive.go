@@ -0,0 +1,86 @@
+package charts
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Expand extracts chart archive into dir, stripping the top level chart directory.
+//The archive is extracted to a sibling temp dir first and renamed, so dir is either complete or absent.
+func Expand(archive []byte, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".expand-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Clean(header.Name))
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		path := filepath.Join(tmp, filepath.FromSlash(parts[1]))
+		if !strings.HasPrefix(path, tmp+string(filepath.Separator)) {
+			return fmt.Errorf("illegal file path in chart archive: %s", header.Name)
+		}
+		switch mode := header.FileInfo().Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	os.RemoveAll(dir)
+	return os.Rename(tmp, dir)
+}
+
+//store expands archive into dir, keeping archive as <dir>.tgz and provenance (if any) as <dir>.tgz.prov
+func store(dir string, archive []byte, prov []byte) error {
+	if err := Expand(archive, dir); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dir+".tgz", archive, 0644); err != nil {
+		return err
+	}
+	if len(prov) > 0 {
+		return ioutil.WriteFile(dir+".tgz.prov", prov, 0644)
+	}
+	os.Remove(dir + ".tgz.prov")
+	return nil
+}
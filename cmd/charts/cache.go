@@ -0,0 +1,287 @@
+package charts
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"k8s.io/helm/pkg/chartutil"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+//Cache content-addressed chart cache, entries keyed by source and version.
+//Each entry is a directory <Dir>/<hash of key> holding the chart at 'chart', and its archive at 'chart.tgz' if any.
+type Cache struct {
+	//Dir cache root
+	Dir string
+	//TTL entries not used within TTL are evicted, 0 to keep
+	TTL time.Duration
+	//MaxSize bytes on disk, least recently used entries are evicted beyond it, 0 for no limit
+	MaxSize int64
+	//Lease entries returned by Get or Lookup are kept at least Lease, while callers load them, even beyond MaxSize
+	Lease time.Duration
+	//Log logger
+	Log func(string, ...interface{})
+
+	lock     sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheCall
+	charts   map[string]*loadedChart
+}
+
+type cacheEntry struct {
+	root     string
+	fetched  time.Time
+	lastUsed time.Time
+}
+
+type cacheCall struct {
+	done chan struct{}
+	dir  string
+	err  error
+}
+
+type loadedChart struct {
+	fingerprint string
+	chart       *cpb.Chart
+}
+
+//DefaultLease lease of entries of NewCache, bounding the time between getting a chart and loading it
+const DefaultLease = 10 * time.Minute
+
+//NewCache creates chart cache in dir
+func NewCache(dir string, ttl time.Duration, maxSize int64) *Cache {
+	return &Cache{
+		Dir:      dir,
+		TTL:      ttl,
+		MaxSize:  maxSize,
+		Lease:    DefaultLease,
+		Log:      func(string, ...interface{}) {},
+		entries:  map[string]*cacheEntry{},
+		inflight: map[string]*cacheCall{},
+		charts:   map[string]*loadedChart{},
+	}
+}
+
+func (c *Cache) root(key string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%x", sha256.Sum256([]byte(key)))[:32])
+}
+
+//entry cached entry of key, including entries left on disk by previous runs
+func (c *Cache) entry(key string) *cacheEntry {
+	if e, ok := c.entries[key]; ok {
+		return e
+	}
+	root := c.root(key)
+	info, err := os.Stat(filepath.Join(root, "chart"))
+	if err != nil {
+		return nil
+	}
+	e := &cacheEntry{root: root, fetched: info.ModTime(), lastUsed: info.ModTime()}
+	c.entries[key] = e
+	return e
+}
+
+//Lookup chart dir of key if cached
+func (c *Cache) Lookup(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e := c.entry(key); e != nil {
+		e.lastUsed = time.Now()
+		return filepath.Join(e.root, "chart"), true
+	}
+	return "", false
+}
+
+//Get chart dir of key, fetch is called with a not yet existing dir when the entry is missing
+//or was fetched longer than maxAge ago (0 never refreshes).
+//Concurrent calls of the same key share a single fetch.
+func (c *Cache) Get(key string, maxAge time.Duration, fetch func(dir string) error) (string, error) {
+	c.lock.Lock()
+	if e := c.entry(key); e != nil && (maxAge <= 0 || time.Since(e.fetched) < maxAge) {
+		e.lastUsed = time.Now()
+		c.lock.Unlock()
+		return filepath.Join(e.root, "chart"), nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.lock.Unlock()
+		<-call.done
+		return call.dir, call.err
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.lock.Unlock()
+
+	call.dir, call.err = c.fetch(key, fetch)
+
+	c.lock.Lock()
+	delete(c.inflight, key)
+	c.lock.Unlock()
+	close(call.done)
+	if call.err == nil {
+		c.Evict()
+	}
+	return call.dir, call.err
+}
+
+func (c *Cache) fetch(key string, fetch func(dir string) error) (string, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(c.Dir, ".fetch-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := fetch(filepath.Join(tmp, "chart")); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "chart")); err != nil {
+		return "", fmt.Errorf("chart %s not fetched: %v", key, err)
+	}
+
+	root := c.root(key)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	os.RemoveAll(root)
+	if err := os.Rename(tmp, root); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	c.entries[key] = &cacheEntry{root: root, fetched: now, lastUsed: now}
+	c.Log("cached chart %s", key)
+	return filepath.Join(root, "chart"), nil
+}
+
+//Run evicts entries every interval until ctx done, so that TTL is enforced on a cache only hit
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Evict()
+		}
+	}
+}
+
+//Evict entries expired by TTL, then least recently used entries beyond MaxSize. Leased entries are kept
+func (c *Cache) Evict() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return
+	}
+	type usage struct {
+		root     string
+		key      string
+		lastUsed time.Time
+		size     int64
+	}
+	known := map[string]string{}
+	for key, e := range c.entries {
+		known[e.root] = key
+	}
+	usages, total := []*usage{}, int64(0)
+	for _, file := range files {
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		u := &usage{root: filepath.Join(c.Dir, file.Name()), lastUsed: file.ModTime()}
+		if key, ok := known[u.root]; ok {
+			u.key, u.lastUsed = key, c.entries[key].lastUsed
+			if _, ok := c.inflight[key]; ok {
+				continue
+			}
+		}
+		if time.Since(u.lastUsed) < c.Lease {
+			//may be loaded by callers, still counted against MaxSize
+			total += dirSize(u.root)
+			continue
+		}
+		u.size = dirSize(u.root)
+		usages, total = append(usages, u), total+u.size
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].lastUsed.Before(usages[j].lastUsed)
+	})
+	for _, u := range usages {
+		expired := c.TTL > 0 && time.Since(u.lastUsed) > c.TTL
+		oversize := c.MaxSize > 0 && total > c.MaxSize
+		if !expired && !oversize {
+			continue
+		}
+		if err := os.RemoveAll(u.root); err != nil {
+			continue
+		}
+		total -= u.size
+		delete(c.entries, u.key)
+		for dir := range c.charts {
+			if strings.HasPrefix(dir, u.root+string(filepath.Separator)) {
+				delete(c.charts, dir)
+			}
+		}
+		c.Log("evicted chart %s", u.root)
+	}
+}
+
+func dirSize(dir string) int64 {
+	size := int64(0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+//fingerprint of chart dir, changes when any file is modified, added or removed
+func fingerprint(dir string) (string, error) {
+	count, latest := 0, time.Time{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		count++
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return fmt.Sprintf("%d/%d", count, latest.UnixNano()), err
+}
+
+//Load parsed chart of dir, kept in memory until the dir changes.
+//Returns a copy, callers are free to modify it.
+func (c *Cache) Load(dir string) (*cpb.Chart, error) {
+	current, err := fingerprint(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	loaded, ok := c.charts[dir]
+	c.lock.Unlock()
+	if !ok || loaded.fingerprint != current {
+		chart, err := chartutil.Load(dir)
+		if err != nil {
+			return nil, err
+		}
+		loaded = &loadedChart{current, chart}
+		c.lock.Lock()
+		c.charts[dir] = loaded
+		c.lock.Unlock()
+	}
+	return proto.Clone(loaded.chart).(*cpb.Chart), nil
+}
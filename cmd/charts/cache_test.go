@@ -0,0 +1,58 @@
+package charts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testCacheEntry gets an entry of key holding redis chart
+func testCacheEntry(t *testing.T, cache *Cache, key string) string {
+	dir, err := cache.Get(key, 0, func(dir string) error {
+		return Expand(testChartArchive(t, "redis", "1.2.3"), dir)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCacheRunEvictsExpired(t *testing.T) {
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	cache.TTL, cache.Lease = 10*time.Millisecond, 0
+	dir := testCacheEntry(t, cache, "expired")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.Run(ctx, 5*time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Errorf("expired entry of hit only cache not evicted")
+}
+
+func TestCacheEvictKeepsLeased(t *testing.T) {
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	cache.MaxSize = 1
+	first := testCacheEntry(t, cache, "first")
+	second := testCacheEntry(t, cache, "second")
+	for _, dir := range []string{first, second} {
+		if _, err := os.Stat(filepath.Join(dir, "Chart.yaml")); err != nil {
+			t.Errorf("leased entry evicted beyond max size: %v", err)
+		}
+	}
+
+	cache.Lease = 0
+	cache.Evict()
+	for _, dir := range []string{first, second} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("entry beyond max size kept after lease: %v", err)
+		}
+	}
+}
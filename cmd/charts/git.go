@@ -0,0 +1,164 @@
+package charts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+//GitReference chart reference of form 'git+<url>[//<path>][?ref=<ref>]'
+type GitReference struct {
+	Repository string
+	Path       string
+	Ref        string
+}
+
+//IsGitReference whether chart is of form 'git+...'
+func IsGitReference(chart string) bool {
+	return strings.HasPrefix(chart, "git+")
+}
+
+//ParseGitReference parses 'git+<url>[//<path>][?ref=<ref>]', ref defaults to defaultRef, or HEAD
+func ParseGitReference(chart string, defaultRef string) (*GitReference, error) {
+	u, err := url.Parse(strings.TrimPrefix(chart, "git+"))
+	if err != nil || !IsGitReference(chart) || u.Scheme == "" {
+		return nil, fmt.Errorf("illegal git chart %q, expect git+<url>//<path>?ref=<ref>", chart)
+	}
+	ref := &GitReference{Ref: u.Query().Get("ref")}
+	if ref.Ref == "" {
+		ref.Ref = defaultRef
+	}
+	if ref.Ref == "" {
+		ref.Ref = "HEAD"
+	}
+	if sep := strings.Index(u.Path, "//"); sep >= 0 {
+		u.Path, ref.Path = u.Path[:sep], strings.Trim(u.Path[sep+2:], "/")
+	}
+	for _, part := range strings.Split(ref.Path, "/") {
+		if part == ".." {
+			return nil, fmt.Errorf("illegal git chart %q, path must be inside repository", chart)
+		}
+	}
+	u.RawQuery = ""
+	ref.Repository = u.String()
+	return ref, nil
+}
+
+func (r *GitReference) String() string {
+	s := "git+" + r.Repository
+	if r.Path != "" {
+		s += "//" + r.Path
+	}
+	return s + "?ref=" + r.Ref
+}
+
+//Git git client executing git binary
+type Git struct {
+	//Username, Password basic auth of http(s) repositories, empty if none
+	Username string
+	Password string
+}
+
+//gitCredentialHelper answers credentials of Git from environment, so that they never appear on command line
+const gitCredentialHelper = `!f() { test "$1" = get && echo "username=$GIT_CHART_USERNAME" && echo "password=$GIT_CHART_PASSWORD"; }; f`
+
+//run git in dir, killed once ctx done
+func (g *Git) run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	command := args[0]
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("git %s: %v", command, err)
+	}
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if g.Username != "" || g.Password != "" {
+		args = append([]string{"-c", "credential.helper=", "-c", "credential.helper=" + gitCredentialHelper}, args...)
+		env = append(env, "GIT_CHART_USERNAME="+g.Username, "GIT_CHART_PASSWORD="+g.Password)
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir, cmd.Env = dir, env
+	//own process group, so remote helpers are killed along
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("git %s: %v", command, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+		}
+		return stdout.Bytes(), nil
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, fmt.Errorf("git %s: %v", command, ctx.Err())
+	}
+}
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+//Resolve commit of ref, returns commit, full ref name (commit itself if ref is a commit) and whether ref is a branch
+func (g *Git) Resolve(ctx context.Context, ref *GitReference) (string, string, bool, error) {
+	if commitSHA.MatchString(ref.Ref) {
+		return ref.Ref, ref.Ref, false, nil
+	}
+	out, err := g.run(ctx, "", "ls-remote", ref.Repository, ref.Ref, ref.Ref+"^{}")
+	if err != nil {
+		return "", "", false, err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	for _, name := range []string{"refs/tags/" + ref.Ref + "^{}", "refs/tags/" + ref.Ref, "refs/heads/" + ref.Ref, ref.Ref} {
+		if commit, ok := refs[name]; ok {
+			return commit, strings.TrimSuffix(name, "^{}"), name == ref.Ref || strings.HasPrefix(name, "refs/heads/"), nil
+		}
+	}
+	return "", "", false, fmt.Errorf("ref %s not found in %s", ref.Ref, ref.Repository)
+}
+
+//Checkout commit of ref resolved from name into cache, returns chart dir.
+//Commits already in cache skip cloning.
+func (g *Git) Checkout(ctx context.Context, cache *Cache, ref *GitReference, commit string, name string) (string, error) {
+	dir, err := cache.Get(fmt.Sprintf("git:%s@%s", ref.Repository, commit), 0, func(dir string) error {
+		if _, err := g.run(ctx, "", "init", "-q", dir); err != nil {
+			return err
+		}
+		if _, err := g.run(ctx, dir, "fetch", "-q", "--depth", "1", ref.Repository, name); err != nil {
+			return err
+		}
+		fetched, err := g.run(ctx, dir, "rev-parse", "FETCH_HEAD^{commit}")
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(fetched)) != commit {
+			return fmt.Errorf("ref %s of %s moved while fetching, retry later", ref.Ref, ref.Repository)
+		}
+		if _, err := g.run(ctx, dir, "checkout", "-q", "FETCH_HEAD"); err != nil {
+			return err
+		}
+		return os.RemoveAll(filepath.Join(dir, ".git"))
+	})
+	if err != nil {
+		return "", err
+	}
+	chartDir := filepath.Join(dir, filepath.FromSlash(ref.Path))
+	if _, err := os.Stat(filepath.Join(chartDir, "Chart.yaml")); err != nil {
+		return "", fmt.Errorf("no chart at %s of %s: %v", ref.Path, ref, err)
+	}
+	return chartDir, nil
+}
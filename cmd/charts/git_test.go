@@ -0,0 +1,156 @@
+package charts
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//testGitRepository repository of redis chart at charts/redis, tagged v1 and moved on by branch main,
+//removed on cleanup
+func testGitRepository(t *testing.T) (string, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "git-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	commitChart := func(version string) {
+		chartDir := filepath.Join(dir, "charts", "redis")
+		if err := os.MkdirAll(chartDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: redis\nversion: "+version+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "-A")
+		git("commit", "-q", "-m", version)
+	}
+	git("init", "-q")
+	git("checkout", "-q", "-b", "main")
+	commitChart("1.0.0")
+	git("tag", "v1")
+	commitChart("1.1.0")
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestParseGitReference(t *testing.T) {
+	for _, c := range []struct {
+		chart    string
+		expected GitReference
+	}{
+		{"git+https://git.example.com/charts.git//stable/redis?ref=v1.2.3", GitReference{"https://git.example.com/charts.git", "stable/redis", "v1.2.3"}},
+		{"git+file:///srv/charts//redis", GitReference{"file:///srv/charts", "redis", "main"}},
+		{"git+ssh://git@git.example.com/redis.git", GitReference{"ssh://git@git.example.com/redis.git", "", "main"}},
+	} {
+		ref, err := ParseGitReference(c.chart, "main")
+		if err != nil {
+			t.Errorf("%s: %v", c.chart, err)
+		} else if *ref != c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.chart, c.expected, *ref)
+		}
+	}
+	for _, illegal := range []string{"https://git.example.com/charts.git", "git+charts.git", "git+file:///srv/charts//../redis"} {
+		if _, err := ParseGitReference(illegal, ""); err == nil {
+			t.Errorf("%q accepted", illegal)
+		}
+	}
+}
+
+func TestGitCheckout(t *testing.T) {
+	dir, cleanup := testGitRepository(t)
+	defer cleanup()
+	cache, cleanupCache := testCache(t)
+	defer cleanupCache()
+	g := &Git{}
+
+	for _, c := range []struct {
+		ref     string
+		version string
+		branch  bool
+	}{
+		{"v1", "1.0.0", false},
+		{"main", "1.1.0", true},
+	} {
+		ref, err := ParseGitReference("git+file://"+dir+"//charts/redis?ref="+c.ref, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit, name, branch, err := g.Resolve(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("%s: %v", c.ref, err)
+		}
+		if !commitSHA.MatchString(commit) || branch != c.branch {
+			t.Errorf("%s: unexpected commit %q of %s, branch %v", c.ref, commit, name, branch)
+		}
+		chartDir, err := g.Checkout(context.Background(), cache, ref, commit, name)
+		if err != nil {
+			t.Fatalf("%s: %v", c.ref, err)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(chartDir, "Chart.yaml")); err != nil || !strings.Contains(string(data), "version: "+c.version) {
+			t.Errorf("%s: unexpected chart %s %v", c.ref, data, err)
+		}
+		if _, err := os.Stat(filepath.Join(chartDir, "..", "..", ".git")); !os.IsNotExist(err) {
+			t.Errorf("%s: .git kept in cache", c.ref)
+		}
+	}
+
+	missing, _ := ParseGitReference("git+file://"+dir+"?ref=v2", "")
+	if _, _, _, err := g.Resolve(context.Background(), missing); err == nil {
+		t.Errorf("missing ref resolved")
+	}
+}
+
+func TestGitCancelled(t *testing.T) {
+	dir, cleanup := testGitRepository(t)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ref, _ := ParseGitReference("git+file://"+dir+"//charts/redis?ref=main", "")
+	if _, _, _, err := (&Git{}).Resolve(ctx, ref); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("expected cancelled, got %v", err)
+	}
+}
+
+func TestGitCredentials(t *testing.T) {
+	dir, cleanup := testGitRepository(t)
+	defer cleanup()
+	git, _ := exec.LookPath("git")
+	backend := &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + filepath.Dir(dir), "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="charts"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	ref, _ := ParseGitReference("git+"+server.URL+"/"+filepath.Base(dir)+"//charts/redis?ref=v1", "")
+
+	if _, _, _, err := (&Git{}).Resolve(context.Background(), ref); err == nil {
+		t.Errorf("resolved without credentials")
+	}
+	if _, _, _, err := (&Git{Username: "user", Password: "secret"}).Resolve(context.Background(), ref); err != nil {
+		t.Errorf("failed to resolve with credentials: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package charts
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	//MediaTypeChartLayer layer of chart archive pushed by helm
+	MediaTypeChartLayer = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	//MediaTypeLegacyChartLayer layer of chart archive pushed by helm 3 experimental
+	MediaTypeLegacyChartLayer = "application/tar+gzip"
+)
+
+//OCIReference chart reference of form 'oci://<registry>/<repository>[:<tag>|@<digest>]'
+type OCIReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+//IsOCIReference whether chart is of form 'oci://...'
+func IsOCIReference(chart string) bool {
+	return strings.HasPrefix(chart, "oci://")
+}
+
+//ParseOCIReference parses 'oci://<registry>/<repository>[:<tag>|@<digest>]', tag defaults to defaultTag
+func ParseOCIReference(chart string, defaultTag string) (*OCIReference, error) {
+	ref := &OCIReference{}
+	rest := strings.TrimPrefix(chart, "oci://")
+	slash := strings.Index(rest, "/")
+	if !IsOCIReference(chart) || slash <= 0 || slash == len(rest)-1 {
+		return nil, fmt.Errorf("illegal oci chart %q, expect oci://<registry>/<repository>:<tag>", chart)
+	}
+	ref.Registry, rest = rest[:slash], rest[slash+1:]
+	if at := strings.Index(rest, "@"); at >= 0 {
+		d, err := digest.Parse(rest[at+1:])
+		if err != nil {
+			return nil, fmt.Errorf("illegal oci chart %q: %v", chart, err)
+		}
+		ref.Digest, rest = d.String(), rest[:at]
+	}
+	if colon := strings.LastIndex(rest, ":"); colon >= 0 {
+		ref.Tag, rest = rest[colon+1:], rest[:colon]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	if ref.Tag == "" && ref.Digest == "" || rest == "" {
+		return nil, fmt.Errorf("illegal oci chart %q, expect oci://<registry>/<repository>:<tag>", chart)
+	}
+	ref.Repository = rest
+	return ref, nil
+}
+
+func (r *OCIReference) String() string {
+	s := fmt.Sprintf("oci://%s/%s", r.Registry, r.Repository)
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+//manifestRef tag or digest to resolve manifest
+func (r *OCIReference) manifestRef() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+//DockerConfig docker config of '.dockerconfigjson' or '.dockercfg'
+type DockerConfig struct {
+	Auths map[string]DockerAuth `json:"auths"`
+}
+
+//DockerAuth credentials of a registry
+type DockerAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+//ParseDockerConfig parses '.dockerconfigjson', or legacy '.dockercfg' without 'auths'
+func ParseDockerConfig(data []byte) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config: %v", err)
+	}
+	if config.Auths == nil {
+		if err := json.Unmarshal(data, &config.Auths); err != nil {
+			return nil, fmt.Errorf("failed to parse docker config: %v", err)
+		}
+	}
+	return config, nil
+}
+
+//Credentials username and password of registry host, empty if none
+func (c *DockerConfig) Credentials(host string) (string, string) {
+	if c == nil {
+		return "", ""
+	}
+	for key, auth := range c.Auths {
+		key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		if slash := strings.Index(key, "/"); slash >= 0 {
+			key = key[:slash]
+		}
+		if key != host {
+			continue
+		}
+		if auth.Username == "" && auth.Auth != "" {
+			if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil {
+				if colon := strings.Index(string(decoded), ":"); colon >= 0 {
+					return string(decoded[:colon]), string(decoded[colon+1:])
+				}
+			}
+		}
+		if auth.IdentityToken != "" {
+			return "<token>", auth.IdentityToken
+		}
+		return auth.Username, auth.Password
+	}
+	return "", ""
+}
+
+//Registry OCI distribution client pulling charts.
+//Tokens and resolved tags are kept by the registry, it should be shared by fetches with the same credentials.
+type Registry struct {
+	Client *http.Client
+	Config *DockerConfig
+	//PlainHTTP hosts served over http instead of https, loopback hosts always are
+	PlainHTTP []string
+
+	tokens sync.Map
+	tags   sync.Map
+}
+
+type resolvedTag struct {
+	digest   string
+	resolved time.Time
+}
+
+func (g *Registry) client() *http.Client {
+	if g.Client != nil {
+		return g.Client
+	}
+	return http.DefaultClient
+}
+
+func (g *Registry) baseURL(ref *OCIReference) string {
+	scheme := "https"
+	host := ref.Registry
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		scheme = "http"
+	}
+	for _, plain := range g.PlainHTTP {
+		if plain == ref.Registry {
+			scheme = "http"
+		}
+	}
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, ref.Registry, ref.Repository)
+}
+
+var challengeParams = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+//get requests registry, answering basic or bearer token challenges with credentials of config
+func (g *Registry) get(ctx context.Context, ref *OCIReference, target string, accept ...string) (*http.Response, error) {
+	request := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, mediaType := range accept {
+			req.Header.Add("Accept", mediaType)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return g.client().Do(req.WithContext(ctx))
+	}
+	tokenKey := ref.Registry + "/" + ref.Repository
+	authorization, _ := g.tokens.Load(tokenKey)
+	authorizationValue, _ := authorization.(string)
+	resp, err := request(authorizationValue)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if authorizationValue, err = g.authorize(ctx, ref, challenge); err != nil {
+		return nil, err
+	}
+	g.tokens.Store(tokenKey, authorizationValue)
+	return request(authorizationValue)
+}
+
+func (g *Registry) authorize(ctx context.Context, ref *OCIReference, challenge string) (string, error) {
+	username, password := g.Config.Credentials(ref.Registry)
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "basic"):
+		if username == "" {
+			return "", fmt.Errorf("registry %s requires credentials", ref.Registry)
+		}
+		return basic, nil
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer"):
+		params := map[string]string{}
+		for _, match := range challengeParams.FindAllStringSubmatch(challenge, -1) {
+			params[strings.ToLower(match[1])] = match[2]
+		}
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return "", fmt.Errorf("registry %s: illegal auth challenge %q", ref.Registry, challenge)
+		}
+		query := realm.Query()
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		query.Set("scope", fmt.Sprintf("repository:%s:pull", ref.Repository))
+		realm.RawQuery = query.Encode()
+		req, err := http.NewRequest("GET", realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if username != "" {
+			req.Header.Set("Authorization", basic)
+		}
+		resp, err := g.client().Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("registry %s: failed to get token: %s", ref.Registry, resp.Status)
+		}
+		token := struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", fmt.Errorf("registry %s: failed to parse token: %v", ref.Registry, err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		return "Bearer " + token.Token, nil
+	}
+	return "", fmt.Errorf("registry %s: unsupported auth challenge %q", ref.Registry, challenge)
+}
+
+//fetch gets content of target, verified against expected digest if not empty
+func (g *Registry) fetch(ctx context.Context, ref *OCIReference, target string, expected string, accept ...string) ([]byte, string, error) {
+	resp, err := g.get(ctx, ref, target, accept...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch %s: %s", target, resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	actual := digest.FromBytes(content)
+	if expected == "" {
+		expected = resp.Header.Get("Docker-Content-Digest")
+	}
+	if expected != "" && expected != actual.String() {
+		return nil, "", verificationErrorf("digest mismatch of %s: expected %s, got %s", target, expected, actual)
+	}
+	return content, actual.String(), nil
+}
+
+//Resolve fetches manifest of ref, returns manifest and its digest
+func (g *Registry) Resolve(ctx context.Context, ref *OCIReference) (*ocispec.Manifest, string, error) {
+	content, manifestDigest, err := g.fetch(ctx, ref, g.baseURL(ref)+"/manifests/"+ref.manifestRef(), ref.Digest,
+		ocispec.MediaTypeImageManifest)
+	if err != nil {
+		return nil, "", err
+	}
+	manifest := &ocispec.Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to parse manifest of %s: %v", ref, err)
+	}
+	return manifest, manifestDigest, nil
+}
+
+//Pull fetches chart layer of manifest
+func (g *Registry) Pull(ctx context.Context, ref *OCIReference, manifest *ocispec.Manifest) ([]byte, error) {
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == MediaTypeChartLayer || layer.MediaType == MediaTypeLegacyChartLayer {
+			archive, _, err := g.fetch(ctx, ref, g.baseURL(ref)+"/blobs/"+layer.Digest.String(), layer.Digest.String())
+			return archive, err
+		}
+	}
+	return nil, fmt.Errorf("%s is not a chart: no chart layer in manifest", ref)
+}
+
+//Fetch pulls chart of ref into cache, archive kept as <dir>.tgz for verification,
+//returns chart dir and manifest digest. Pinned digests already in cache skip the registry,
+//tags are resolved again when resolved longer than maxAge ago (0 never resolves again).
+func (g *Registry) Fetch(ctx context.Context, cache *Cache, ref *OCIReference, maxAge time.Duration) (string, string, error) {
+	key := func(manifestDigest string) string {
+		return fmt.Sprintf("oci:%s/%s@%s", ref.Registry, ref.Repository, manifestDigest)
+	}
+	if ref.Digest != "" {
+		if dir, ok := cache.Lookup(key(ref.Digest)); ok {
+			return dir, ref.Digest, nil
+		}
+	}
+	tagKey := fmt.Sprintf("%s/%s:%s", ref.Registry, ref.Repository, ref.Tag)
+	if cached, ok := g.tags.Load(tagKey); ok && ref.Digest == "" {
+		tag := cached.(*resolvedTag)
+		if maxAge <= 0 || time.Since(tag.resolved) < maxAge {
+			if dir, ok := cache.Lookup(key(tag.digest)); ok {
+				return dir, tag.digest, nil
+			}
+		}
+	}
+	manifest, manifestDigest, err := g.Resolve(ctx, ref)
+	if err != nil {
+		return "", "", err
+	}
+	if ref.Digest == "" {
+		g.tags.Store(tagKey, &resolvedTag{manifestDigest, time.Now()})
+	}
+	dir, err := cache.Get(key(manifestDigest), 0, func(dir string) error {
+		archive, err := g.Pull(ctx, ref, manifest)
+		if err != nil {
+			return err
+		}
+		return store(dir, archive, nil)
+	})
+	return dir, manifestDigest, err
+}
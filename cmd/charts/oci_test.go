@@ -0,0 +1,228 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+//testRegistry in-process registry serving redis chart tags of repository 'charts/redis' behind bearer tokens,
+//counting requests by path
+func testRegistry(t *testing.T, tags ...string) (*httptest.Server, map[string]int) {
+	requests := map[string]int{}
+	manifests, blobs := map[string][]byte{}, map[string][]byte{}
+	for _, tag := range tags {
+		archive := testChartArchive(t, "redis", tag)
+		layer := digest.FromBytes(archive)
+		blobs[layer.String()] = archive
+		manifest, err := json.Marshal(&ocispec.Manifest{Layers: []ocispec.Descriptor{{
+			MediaType: MediaTypeChartLayer,
+			Digest:    layer,
+			Size:      int64(len(archive)),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests[tag] = manifest
+		manifests[digest.FromBytes(manifest).String()] = manifest
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		if req.URL.Path == "/token" {
+			if req.URL.Query().Get("scope") != "repository:charts/redis:pull" {
+				http.Error(w, "illegal scope", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"token":"secret-token"}`))
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if ref := strings.TrimPrefix(req.URL.Path, "/v2/charts/redis/manifests/"); ref != req.URL.Path {
+			if manifest, ok := manifests[ref]; ok {
+				w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+				w.Write(manifest)
+				return
+			}
+		}
+		if blob, ok := blobs[strings.TrimPrefix(req.URL.Path, "/v2/charts/redis/blobs/")]; ok {
+			w.Write(blob)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	return server, requests
+}
+
+func TestParseOCIReference(t *testing.T) {
+	d := digest.FromString("manifest").String()
+	for _, c := range []struct {
+		chart    string
+		expected OCIReference
+	}{
+		{"oci://registry.example.com/charts/redis:1.2.3", OCIReference{"registry.example.com", "charts/redis", "1.2.3", ""}},
+		{"oci://localhost:5000/redis", OCIReference{"localhost:5000", "redis", "latest", ""}},
+		{"oci://localhost:5000/redis@" + d, OCIReference{"localhost:5000", "redis", "", d}},
+	} {
+		ref, err := ParseOCIReference(c.chart, "latest")
+		if err != nil {
+			t.Errorf("%s: %v", c.chart, err)
+		} else if *ref != c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.chart, c.expected, *ref)
+		}
+	}
+	for _, illegal := range []string{"https://registry.example.com/redis", "oci://registry.example.com", "oci://registry.example.com/redis@sha256:bad"} {
+		if _, err := ParseOCIReference(illegal, "latest"); err == nil {
+			t.Errorf("%q accepted", illegal)
+		}
+	}
+	if _, err := ParseOCIReference("oci://registry.example.com/redis", ""); err == nil {
+		t.Errorf("reference without tag accepted")
+	}
+}
+
+func TestRegistryFetch(t *testing.T) {
+	server, requests := testRegistry(t, "1.2.3", "1.3.0")
+	defer server.Close()
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	registry := &Registry{}
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ref, _ := ParseOCIReference("oci://"+host+"/charts/redis:1.2.3", "")
+	dir, manifestDigest, err := registry.Fetch(context.Background(), cache, ref, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "Chart.yaml")); err != nil || !strings.Contains(string(data), "version: 1.2.3") {
+		t.Errorf("chart not expanded: %s %v", data, err)
+	}
+	if _, err := os.Stat(dir + ".tgz"); err != nil {
+		t.Errorf("archive not kept: %v", err)
+	}
+	if !strings.HasPrefix(manifestDigest, "sha256:") {
+		t.Errorf("unexpected manifest digest %q", manifestDigest)
+	}
+
+	if _, again, err := registry.Fetch(context.Background(), cache, ref, 0); err != nil || again != manifestDigest {
+		t.Errorf("unexpected refetch %q: %v", again, err)
+	}
+	//first request of manifest is challenged
+	if n := requests["/v2/charts/redis/manifests/1.2.3"]; n != 2 {
+		t.Errorf("resolved tag not reused, manifest requested %d times", n)
+	}
+
+	other, _ := ParseOCIReference("oci://"+host+"/charts/redis:1.3.0", "")
+	if _, _, err := registry.Fetch(context.Background(), cache, other, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests["/token"]; n != 1 {
+		t.Errorf("token not reused, requested %d times", n)
+	}
+
+	pinned, _ := ParseOCIReference("oci://"+host+"/charts/redis@"+manifestDigest, "")
+	total := func() int {
+		n := 0
+		for _, count := range requests {
+			n += count
+		}
+		return n
+	}
+	before := total()
+	if pinnedDir, _, err := registry.Fetch(context.Background(), cache, pinned, 0); err != nil || pinnedDir != dir {
+		t.Errorf("pinned digest not served from cache: %s %v", pinnedDir, err)
+	}
+	if total() != before {
+		t.Errorf("pinned digest in cache requested registry")
+	}
+}
+
+func TestRegistryFetchMaxAge(t *testing.T) {
+	server, requests := testRegistry(t, "1.2.3")
+	defer server.Close()
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	registry := &Registry{}
+	ref, _ := ParseOCIReference("oci://"+strings.TrimPrefix(server.URL, "http://")+"/charts/redis:1.2.3", "")
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := registry.Fetch(context.Background(), cache, ref, time.Nanosecond); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := requests["/v2/charts/redis/manifests/1.2.3"]; n != 3 {
+		t.Errorf("expired tag not resolved again, manifest requested %d times", n)
+	}
+	for path, n := range requests {
+		if strings.Contains(path, "/blobs/") && n != 1 {
+			t.Errorf("unchanged digest pulled again, %s requested %d times", path, n)
+		}
+	}
+}
+
+func TestRegistryFetchUnauthorized(t *testing.T) {
+	server, _ := testRegistry(t, "1.2.3")
+	defer server.Close()
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	ref, _ := ParseOCIReference("oci://"+strings.TrimPrefix(server.URL, "http://")+"/charts/other:1.2.3", "")
+	if _, _, err := (&Registry{}).Fetch(context.Background(), cache, ref, 0); err == nil {
+		t.Errorf("fetched chart of unauthorized repository")
+	}
+}
+
+func TestRegistryFetchCancelled(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer server.Close()
+	defer close(hang)
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	ref, _ := ParseOCIReference("oci://"+strings.TrimPrefix(server.URL, "http://")+"/charts/redis:1.2.3", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := (&Registry{}).Fetch(ctx, cache, ref, 0); err == nil {
+		t.Error("fetched from hanging registry")
+	}
+}
+
+func TestDockerConfigCredentials(t *testing.T) {
+	config, err := ParseDockerConfig([]byte(`{"auths":{"https://registry.example.com/v1/":{"auth":"dXNlcjpwYXNz"},"other.example.com":{"identitytoken":"token"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username, password := config.Credentials("registry.example.com"); username != "user" || password != "pass" {
+		t.Errorf("unexpected credentials %s:%s", username, password)
+	}
+	if username, password := config.Credentials("other.example.com"); username != "<token>" || password != "token" {
+		t.Errorf("unexpected credentials %s:%s", username, password)
+	}
+	if username, _ := config.Credentials("unknown.example.com"); username != "" {
+		t.Errorf("unexpected credentials of unknown registry")
+	}
+	legacy, err := ParseDockerConfig([]byte(`{"registry.example.com":{"username":"user","password":"pass"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username, password := legacy.Credentials("registry.example.com"); username != "user" || password != "pass" {
+		t.Errorf("unexpected legacy credentials %s:%s", username, password)
+	}
+}
@@ -0,0 +1,187 @@
+package charts
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
+)
+
+//Repository chart repository serving index.yaml
+type Repository struct {
+	Name   string
+	URL    string
+	Client *http.Client
+}
+
+//IndexFile repository index.yaml
+type IndexFile struct {
+	APIVersion string                     `json:"apiVersion"`
+	Entries    map[string][]*ChartVersion `json:"entries"`
+}
+
+//ChartVersion index entry of a chart version
+type ChartVersion struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	URLs    []string `json:"urls"`
+	Digest  string   `json:"digest,omitempty"`
+}
+
+//ParseRepository parses '<name>=<url>'
+func ParseRepository(repo string) (*Repository, error) {
+	eq := strings.Index(repo, "=")
+	if eq <= 0 || eq == len(repo)-1 {
+		return nil, fmt.Errorf("illegal repository %q, expect <name>=<url>", repo)
+	}
+	return &Repository{Name: repo[:eq], URL: strings.TrimSuffix(repo[eq+1:], "/") + "/"}, nil
+}
+
+func (r *Repository) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	return http.DefaultClient
+}
+
+func (r *Repository) get(ctx context.Context, ref string) ([]byte, error) {
+	base, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	target, err := base.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", target, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+//provenanceURL URL of provenance of chart archive at ref, '.prov' appended to its path
+func provenanceURL(ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref + ".prov"
+	}
+	u.Path += ".prov"
+	if len(u.RawPath) > 0 {
+		u.RawPath += ".prov"
+	}
+	return u.String()
+}
+
+//LoadIndex fetches index.yaml of repository
+func (r *Repository) LoadIndex(ctx context.Context) (*IndexFile, error) {
+	bytes, err := r.get(ctx, "index.yaml")
+	if err != nil {
+		return nil, err
+	}
+	index := &IndexFile{}
+	if err := yaml.Unmarshal(bytes, index); err != nil {
+		return nil, fmt.Errorf("failed to parse index of repository %s: %v", r.Name, err)
+	}
+	return index, nil
+}
+
+//Download fetches chart archive of version
+func (r *Repository) Download(ctx context.Context, cv *ChartVersion) ([]byte, error) {
+	if len(cv.URLs) == 0 {
+		return nil, fmt.Errorf("chart %s-%s has no download url", cv.Name, cv.Version)
+	}
+	return r.get(ctx, cv.URLs[0])
+}
+
+//Resolve highest version of chart matching constraint, latest stable version if constraint empty
+func (i *IndexFile) Resolve(name string, constraint string) (*ChartVersion, error) {
+	var constraints *semver.Constraints
+	if len(constraint) > 0 {
+		c, err := semver.NewConstraint(constraint)
+		if err != nil {
+			return nil, fmt.Errorf("illegal chart version %q: %v", constraint, err)
+		}
+		constraints = c
+	}
+	type candidate struct {
+		version *semver.Version
+		chart   *ChartVersion
+	}
+	candidates := []candidate{}
+	for _, cv := range i.Entries[name] {
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil {
+			continue
+		}
+		if constraints == nil && v.Prerelease() != "" {
+			continue
+		}
+		if constraints != nil && !constraints.Check(v) {
+			continue
+		}
+		candidates = append(candidates, candidate{v, cv})
+	}
+	if len(candidates) == 0 {
+		if len(constraint) > 0 {
+			return nil, fmt.Errorf("chart %s version %s not found", name, constraint)
+		}
+		return nil, fmt.Errorf("chart %s not found", name)
+	}
+	sort.Slice(candidates, func(a, b int) bool {
+		return candidates[a].version.GreaterThan(candidates[b].version)
+	})
+	return candidates[0].chart, nil
+}
+
+//Fetch resolves chart version matching constraint into cache, archive kept as <dir>.tgz for verification,
+//returns chart dir and resolved version. Exact versions already in cache skip the index.
+func (r *Repository) Fetch(ctx context.Context, cache *Cache, name string, constraint string, verification Verification) (string, string, error) {
+	key := func(version string) string {
+		return fmt.Sprintf("repo:%s%s@%s", r.URL, name, version)
+	}
+	if len(constraint) > 0 {
+		if dir, ok := cache.Lookup(key(constraint)); ok {
+			return dir, constraint, nil
+		}
+	}
+	index, err := r.LoadIndex(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	cv, err := index.Resolve(name, constraint)
+	if err != nil {
+		return "", "", err
+	}
+	dir, err := cache.Get(key(cv.Version), 0, func(dir string) error {
+		archive, err := r.Download(ctx, cv)
+		if err != nil {
+			return err
+		}
+		if len(cv.Digest) > 0 {
+			if _, err := VerifyDigest(archive, cv.Digest); err != nil {
+				return verificationErrorf("%s-%s of repository index: %v", cv.Name, cv.Version, err)
+			}
+		}
+		prov, _ := r.get(ctx, provenanceURL(cv.URLs[0]))
+		if _, err := verification.Check(archive, prov); err != nil {
+			return err
+		}
+		return store(dir, archive, prov)
+	})
+	return dir, cv.Version, err
+}
@@ -0,0 +1,294 @@
+package charts
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testChartArchive archive of a minimal chart of name and version
+func testChartArchive(t *testing.T, name string, version string) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	files := map[string]string{
+		"Chart.yaml":  fmt.Sprintf("apiVersion: v1\nname: %s\nversion: %s\n", name, version),
+		"values.yaml": "replicas: 1\n",
+	}
+	for file, content := range files {
+		header := &tar.Header{Name: name + "/" + file, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+//testCache chart cache in a temp dir, removed on cleanup
+func testCache(t *testing.T) (*Cache, func()) {
+	dir, err := ioutil.TempDir("", "charts-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCache(dir, 0, 0), func() { os.RemoveAll(dir) }
+}
+
+//testRepository serves index.yaml and archives of redis versions, counting requests by path
+func testRepository(t *testing.T, versions ...string) (*httptest.Server, map[string]int) {
+	requests := map[string]int{}
+	archives := map[string][]byte{}
+	index := "apiVersion: v1\nentries:\n  redis:\n"
+	for _, version := range versions {
+		file := fmt.Sprintf("redis-%s.tgz", version)
+		archives["/charts/"+file] = testChartArchive(t, "redis", version)
+		index += fmt.Sprintf("  - name: redis\n    version: %s\n    urls: [charts/%s]\n", version, file)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		if req.URL.Path == "/index.yaml" {
+			w.Write([]byte(index))
+			return
+		}
+		if archive, ok := archives[req.URL.Path]; ok {
+			w.Write(archive)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	return server, requests
+}
+
+func TestParseRepository(t *testing.T) {
+	r, err := ParseRepository("stable=https://charts.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "stable" || r.URL != "https://charts.example.com/" {
+		t.Errorf("unexpected repository %+v", r)
+	}
+	for _, illegal := range []string{"stable", "=https://charts.example.com", "stable="} {
+		if _, err := ParseRepository(illegal); err == nil {
+			t.Errorf("%q accepted", illegal)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	index := &IndexFile{Entries: map[string][]*ChartVersion{"redis": {
+		{Name: "redis", Version: "1.1.0"},
+		{Name: "redis", Version: "1.2.0"},
+		{Name: "redis", Version: "1.2.3"},
+		{Name: "redis", Version: "1.3.0"},
+		{Name: "redis", Version: "2.0.0-rc.1"},
+		{Name: "redis", Version: "not-semver"},
+	}}}
+	for _, c := range []struct {
+		constraint string
+		expected   string
+	}{
+		{"", "1.3.0"},
+		{"~1.2", "1.2.3"},
+		{"^1.1", "1.3.0"},
+		{"1.1.0", "1.1.0"},
+		{"<1.2.3", "1.2.0"},
+		{">=2.0.0-0", "2.0.0-rc.1"},
+	} {
+		cv, err := index.Resolve("redis", c.constraint)
+		if err != nil {
+			t.Errorf("%q: %v", c.constraint, err)
+			continue
+		}
+		if cv.Version != c.expected {
+			t.Errorf("%q resolved to %s, expected %s", c.constraint, cv.Version, c.expected)
+		}
+	}
+	if _, err := index.Resolve("redis", "~3.0"); err == nil {
+		t.Error("unmatched constraint resolved")
+	}
+	if _, err := index.Resolve("memcached", ""); err == nil {
+		t.Error("missing chart resolved")
+	}
+	if _, err := index.Resolve("redis", "not a constraint"); err == nil {
+		t.Error("illegal constraint accepted")
+	}
+}
+
+func TestRepositoryFetch(t *testing.T) {
+	server, requests := testRepository(t, "1.2.0", "1.2.5", "1.3.0")
+	defer server.Close()
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	repo, err := ParseRepository("test=" + server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, version, err := repo.Fetch(context.Background(), cache, "redis", "~1.2", Verification{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.2.5" {
+		t.Errorf("resolved %s, expected 1.2.5", version)
+	}
+	chart, err := ioutil.ReadFile(filepath.Join(dir, "Chart.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(chart, []byte("version: 1.2.5")) {
+		t.Errorf("unexpected Chart.yaml %s", chart)
+	}
+	if _, err := os.Stat(dir + ".tgz"); err != nil {
+		t.Errorf("archive not kept: %v", err)
+	}
+
+	//exact versions in cache skip index and download
+	requests["/index.yaml"] = 0
+	if _, version, err = repo.Fetch(context.Background(), cache, "redis", "1.2.5", Verification{}); err != nil || version != "1.2.5" {
+		t.Errorf("cached fetch: %s %v", version, err)
+	}
+	if requests["/index.yaml"] != 0 || requests["/charts/redis-1.2.5.tgz"] != 1 {
+		t.Errorf("cached fetch requested %v", requests)
+	}
+
+	if _, _, err := repo.Fetch(context.Background(), cache, "redis", "~2.0", Verification{}); err == nil {
+		t.Error("unmatched constraint fetched")
+	}
+	if _, _, err := repo.Fetch(context.Background(), cache, "memcached", "", Verification{}); err == nil {
+		t.Error("missing chart fetched")
+	}
+}
+
+func TestRepositoryFetchVerifiesBeforeStore(t *testing.T) {
+	good, tampered := testChartArchive(t, "redis", "1.1.0"), testChartArchive(t, "redis", "1.0.0")
+	index := fmt.Sprintf("apiVersion: v1\nentries:\n  redis:\n"+
+		"  - {name: redis, version: 1.0.0, urls: [charts/redis-1.0.0.tgz], digest: %s}\n"+
+		"  - {name: redis, version: 1.1.0, urls: [charts/redis-1.1.0.tgz], digest: %s}\n",
+		strings.TrimPrefix(Digest(good), "sha256:"), strings.TrimPrefix(Digest(good), "sha256:"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/index.yaml":
+			w.Write([]byte(index))
+		case "/charts/redis-1.0.0.tgz":
+			w.Write(tampered)
+		case "/charts/redis-1.1.0.tgz":
+			w.Write(good)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	repo, _ := ParseRepository("test=" + server.URL)
+	stored := func(version string) bool {
+		_, ok := cache.Lookup(fmt.Sprintf("repo:%sredis@%s", repo.URL, version))
+		return ok
+	}
+
+	if _, _, err := repo.Fetch(context.Background(), cache, "redis", "1.0.0", Verification{}); !IsVerificationError(err) || stored("1.0.0") {
+		t.Errorf("archive not matching digest of index stored: %v", err)
+	}
+	if _, _, err := repo.Fetch(context.Background(), cache, "redis", "1.1.0", Verification{Digest: Digest(tampered)}); !IsVerificationError(err) || stored("1.1.0") {
+		t.Errorf("archive not matching chart digest stored: %v", err)
+	}
+	if _, _, err := repo.Fetch(context.Background(), cache, "redis", "1.1.0", Verification{Keyring: "keyring.gpg"}); !IsVerificationError(err) || stored("1.1.0") {
+		t.Errorf("archive without provenance stored: %v", err)
+	}
+	if _, _, err := repo.Fetch(context.Background(), cache, "redis", "1.1.0", Verification{Digest: Digest(good)}); err != nil || !stored("1.1.0") {
+		t.Errorf("verified archive not stored: %v", err)
+	}
+}
+
+func TestFetchURLVerifiesBeforeStore(t *testing.T) {
+	archive, requests := testChartArchive(t, "redis", "1.2.3"), map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.RequestURI()]++
+		if req.URL.Path == "/redis-1.2.3.tgz" {
+			w.Write(archive)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	defer server.Close()
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	chartURL := server.URL + "/redis-1.2.3.tgz?token=x"
+
+	if _, err := FetchURL(context.Background(), cache, chartURL, 0, Verification{Digest: "sha256:00"}); !IsVerificationError(err) {
+		t.Errorf("archive not matching chart digest fetched: %v", err)
+	}
+	if _, ok := cache.Lookup("url:" + chartURL); ok {
+		t.Error("archive not matching chart digest stored")
+	}
+	if requests["/redis-1.2.3.tgz.prov?token=x"] != 1 {
+		t.Errorf("provenance not requested next to archive: %v", requests)
+	}
+	if _, err := FetchURL(context.Background(), cache, chartURL, 0, Verification{Digest: Digest(archive)}); err != nil {
+		t.Errorf("verified archive not fetched: %v", err)
+	}
+}
+
+func TestProvenanceURL(t *testing.T) {
+	for ref, expected := range map[string]string{
+		"https://example.com/charts/redis-1.2.3.tgz":         "https://example.com/charts/redis-1.2.3.tgz.prov",
+		"https://example.com/redis-1.2.3.tgz?token=x&sig=y":  "https://example.com/redis-1.2.3.tgz.prov?token=x&sig=y",
+		"charts/redis-1.2.3.tgz":                             "charts/redis-1.2.3.tgz.prov",
+		"https://example.com/a%2Fb/redis-1.2.3.tgz#fragment": "https://example.com/a%2Fb/redis-1.2.3.tgz.prov#fragment",
+	} {
+		if actual := provenanceURL(ref); actual != expected {
+			t.Errorf("provenance of %s at %s, expected %s", ref, actual, expected)
+		}
+	}
+}
+
+func TestRepositoryFetchFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	repo, _ := ParseRepository("test=" + server.URL)
+	if _, _, err := repo.Fetch(context.Background(), cache, "redis", "", Verification{}); err == nil {
+		t.Error("fetched from failing repository")
+	}
+}
+
+func TestRepositoryFetchCancelled(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer server.Close()
+	defer close(hang)
+	cache, cleanup := testCache(t)
+	defer cleanup()
+	repo, _ := ParseRepository("test=" + server.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := repo.Fetch(ctx, cache, "redis", "", Verification{}); err == nil {
+		t.Error("fetched from hanging repository")
+	}
+	if _, err := FetchURL(ctx, cache, server.URL+"/redis-1.2.3.tgz", 0, Verification{}); err == nil {
+		t.Error("fetched from hanging url")
+	}
+}
@@ -0,0 +1,23 @@
+package charts
+
+import (
+	"context"
+	"time"
+)
+
+//FetchURL downloads chart archive (and its provenance, '.prov' appended to the URL path, if any) into cache
+//once it passes verification, returns chart dir. Cached charts are refreshed when fetched longer than maxAge ago (0 never refreshes).
+func FetchURL(ctx context.Context, cache *Cache, chartURL string, maxAge time.Duration, verification Verification) (string, error) {
+	return cache.Get("url:"+chartURL, maxAge, func(dir string) error {
+		repo := &Repository{URL: chartURL}
+		archive, err := repo.get(ctx, chartURL)
+		if err != nil {
+			return err
+		}
+		prov, _ := repo.get(ctx, provenanceURL(chartURL))
+		if _, err := verification.Check(archive, prov); err != nil {
+			return err
+		}
+		return store(dir, archive, prov)
+	})
+}
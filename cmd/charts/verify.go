@@ -0,0 +1,142 @@
+package charts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"k8s.io/helm/pkg/chartutil"
+)
+
+//VerificationError chart archive failed digest or provenance verification
+type VerificationError struct {
+	Message string
+}
+
+func (e *VerificationError) Error() string {
+	return e.Message
+}
+
+//IsVerificationError whether err is a VerificationError
+func IsVerificationError(err error) bool {
+	_, ok := err.(*VerificationError)
+	return ok
+}
+
+func verificationErrorf(format string, args ...interface{}) error {
+	return &VerificationError{fmt.Sprintf(format, args...)}
+}
+
+//Digest sha256 digest of archive, of form 'sha256:<hex>'
+func Digest(archive []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(archive))
+}
+
+//VerifyDigest checks archive against digest ('sha256:<hex>' or '<hex>', empty to skip), returns digest of archive
+func VerifyDigest(archive []byte, digest string) (string, error) {
+	actual := Digest(archive)
+	if len(digest) > 0 {
+		if !strings.HasPrefix(digest, "sha256:") {
+			digest = "sha256:" + digest
+		}
+		if !strings.EqualFold(digest, actual) {
+			return "", verificationErrorf("chart digest mismatch: expected %s, got %s", digest, actual)
+		}
+	}
+	return actual, nil
+}
+
+//Verification digest ('sha256:<hex>' or '<hex>', empty to skip) and keyring (empty to skip) a chart archive
+//and its provenance are checked against, as by Verify, before a fetched archive is stored
+type Verification struct {
+	Digest  string
+	Keyring string
+}
+
+//Check archive against digest and provenance against keyring, returns digest of archive
+func (v Verification) Check(archive []byte, prov []byte) (string, error) {
+	actual, err := VerifyDigest(archive, v.Digest)
+	if err != nil {
+		return "", err
+	}
+	if len(v.Keyring) > 0 {
+		if len(prov) == 0 {
+			return "", verificationErrorf("chart provenance not available")
+		}
+		if err := verifyProvenance(prov, archive, actual, v.Keyring); err != nil {
+			return "", err
+		}
+	}
+	return actual, nil
+}
+
+//Verify checks archive file against digest ('sha256:<hex>' or '<hex>', empty to skip),
+//and its '.prov' file against keyring (empty to skip), returns digest of archive
+func Verify(archivePath string, digest string, keyring string) (string, error) {
+	archive, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		return "", verificationErrorf("chart archive not available for verification: %v", err)
+	}
+	var prov []byte
+	if len(keyring) > 0 {
+		if prov, err = ioutil.ReadFile(archivePath + ".prov"); err != nil {
+			return "", verificationErrorf("chart provenance not available: %v", err)
+		}
+	}
+	return Verification{digest, keyring}.Check(archive, prov)
+}
+
+//verifyProvenance checks clearsigned provenance against keyring (binary or armored), which must sign
+//digest of archive as its file '<name>-<version>.tgz', as helm verifies provenance
+func verifyProvenance(prov []byte, archive []byte, digest string, keyring string) error {
+	keys, err := readKeyring(keyring)
+	if err != nil {
+		return err
+	}
+	block, _ := clearsign.Decode(prov)
+	if block == nil {
+		return verificationErrorf("chart provenance is not a clearsigned message")
+	}
+	files := struct {
+		Files map[string]string `json:"files"`
+	}{}
+	docs := bytes.Split(block.Plaintext, []byte("\n...\n"))
+	if len(docs) < 2 {
+		return verificationErrorf("chart provenance has no files section")
+	}
+	if err := yaml.Unmarshal(docs[1], &files); err != nil {
+		return verificationErrorf("failed to parse chart provenance: %v", err)
+	}
+	chart, err := chartutil.LoadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return verificationErrorf("failed to load chart archive: %v", err)
+	}
+	name := fmt.Sprintf("%s-%s.tgz", chart.GetMetadata().GetName(), chart.GetMetadata().GetVersion())
+	if signed, ok := files.Files[name]; !ok || !strings.EqualFold(signed, digest) {
+		return verificationErrorf("chart digest %s of %s not signed by provenance", digest, name)
+	}
+	if _, err := openpgp.CheckDetachedSignature(keys, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		return verificationErrorf("chart provenance signature invalid: %v", err)
+	}
+	return nil
+}
+
+//readKeyring public keys of keyring file, binary (eg. pubring.gpg) or armored
+func readKeyring(keyring string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(keyring)
+	if err != nil {
+		return nil, verificationErrorf("failed to read keyring: %v", err)
+	}
+	keys, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil {
+		if keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err != nil {
+			return nil, verificationErrorf("failed to read keyring %s: %v", keyring, err)
+		}
+	}
+	return keys, nil
+}
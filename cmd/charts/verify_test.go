@@ -0,0 +1,103 @@
+package charts
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+//testSigner key pair signing provenance, and its public keyring written into dir
+func testSigner(t *testing.T, dir string, name string) (*openpgp.Entity, string) {
+	signer, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := &bytes.Buffer{}
+	if err := signer.Serialize(keyring); err != nil {
+		t.Fatal(err)
+	}
+	keyringPath := filepath.Join(dir, name+".gpg")
+	if err := ioutil.WriteFile(keyringPath, keyring.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return signer, keyringPath
+}
+
+//testProvenance provenance of file signed by signer, as 'helm package --sign' writes
+func testProvenance(t *testing.T, signer *openpgp.Entity, file string, digest string) []byte {
+	body := fmt.Sprintf("apiVersion: v1\nname: redis\nversion: 1.2.3\n\n...\nfiles:\n  %s: %s\n", file, digest)
+	prov := &bytes.Buffer{}
+	w, err := clearsign.Encode(prov, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return prov.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer, keyring := testSigner(t, dir, "signer")
+	_, otherKeyring := testSigner(t, dir, "other")
+	archive, other := testChartArchive(t, "redis", "1.2.3"), testChartArchive(t, "redis", "1.2.4")
+	archivePath := filepath.Join(dir, "chart.tgz")
+	if err := ioutil.WriteFile(archivePath, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := Digest(archive)
+
+	for _, c := range []struct {
+		name    string
+		prov    []byte
+		keyring string
+		digest  string
+		failure string
+	}{
+		{"signed", testProvenance(t, signer, "redis-1.2.3.tgz", digest), keyring, "", ""},
+		{"pinned digest", testProvenance(t, signer, "redis-1.2.3.tgz", digest), keyring, digest, ""},
+		{"digest mismatch", testProvenance(t, signer, "redis-1.2.3.tgz", digest), keyring, Digest(other), "digest mismatch"},
+		{"other file signed", testProvenance(t, signer, "other-1.2.3.tgz", digest), keyring, "", "not signed"},
+		{"other archive signed", testProvenance(t, signer, "redis-1.2.3.tgz", Digest(other)), keyring, "", "not signed"},
+		{"unknown signer", testProvenance(t, signer, "redis-1.2.3.tgz", digest), otherKeyring, "", "signature invalid"},
+		{"tampered", bytes.Replace(testProvenance(t, signer, "redis-1.2.3.tgz", digest), []byte("name: redis"), []byte("name: other"), 1), keyring, "", "signature invalid"},
+		{"not clearsigned", []byte("files: {}"), keyring, "", "not a clearsigned"},
+	} {
+		if err := ioutil.WriteFile(archivePath+".prov", c.prov, 0644); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := Verify(archivePath, c.digest, c.keyring)
+		if c.failure == "" {
+			if err != nil || actual != digest {
+				t.Errorf("%s: unexpected %q, %v", c.name, actual, err)
+			}
+			continue
+		}
+		if err == nil || !IsVerificationError(err) || !strings.Contains(err.Error(), c.failure) {
+			t.Errorf("%s: expected %q, got %v", c.name, c.failure, err)
+		}
+	}
+
+	os.Remove(archivePath + ".prov")
+	if _, err := Verify(archivePath, "", keyring); err == nil || !IsVerificationError(err) {
+		t.Errorf("verified without provenance: %v", err)
+	}
+	if actual, err := Verify(archivePath, "", ""); err != nil || actual != digest {
+		t.Errorf("unexpected %q, %v without keyring", actual, err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
+)
+
+//chartObjectKinds chart reference prefix -> kind of object holding chart archive
+var chartObjectKinds = map[string]string{
+	"configmap://": "ConfigMap",
+	"secret://":    "Secret",
+}
+
+//chartObjectRef chart archive in key of a ConfigMap (binaryData) or Secret, of form 'configmap://<name>/<key>' or 'secret://<name>/<key>'
+type chartObjectRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Key       string
+}
+
+//parseChartObjectRef parses chart object reference in namespace, nil if chart is not of the form
+func parseChartObjectRef(namespace string, chart string) (*chartObjectRef, error) {
+	for prefix, kind := range chartObjectKinds {
+		if !strings.HasPrefix(chart, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(chart, prefix), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("illegal chart %q, expect %s<name>/<key>", chart, prefix)
+		}
+		return &chartObjectRef{kind, namespace, parts[0], parts[1]}, nil
+	}
+	return nil, nil
+}
+
+func (ref *chartObjectRef) String() string {
+	return fmt.Sprintf("%s://%s/%s", strings.ToLower(ref.Kind), ref.Name, ref.Key)
+}
+
+//objectWatch starts watching object of ref, calling changed with its data when added or updated, until stop is closed
+type objectWatch func(ref *chartObjectRef, changed func(data map[string][]byte), stop <-chan struct{})
+
+//chartWatcher triggers an upgrade of resources whose chart object changed
+type chartWatcher struct {
+	lock    sync.Mutex
+	tracked map[string]*watchedChart
+	//watch of single objects, nil if chart objects are not watched
+	watch objectWatch
+	//watching object key -> stop of its watch, of objects referenced by tracked charts
+	watching map[string]chan struct{}
+}
+
+type watchedChart struct {
+	resource *v1alpha1.HelmApp
+	ref      *chartObjectRef
+	digest   string
+}
+
+func newChartWatcher() *chartWatcher {
+	return &chartWatcher{tracked: map[string]*watchedChart{}, watching: map[string]chan struct{}{}}
+}
+
+func (ref *chartObjectRef) objectKey() string {
+	return ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+}
+
+//Track watches chart object ref of r, loaded with archive digest
+func (w *chartWatcher) Track(r *v1alpha1.HelmApp, ref *chartObjectRef, digest string) {
+	resource := &v1alpha1.HelmApp{TypeMeta: r.TypeMeta}
+	resource.SetNamespace(r.GetNamespace())
+	resource.SetName(r.GetName())
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	previous, ok := w.tracked[pollKey(r)]
+	w.tracked[pollKey(r)] = &watchedChart{resource, ref, digest}
+	if ok && previous.ref.objectKey() != ref.objectKey() {
+		w.unwatch(previous.ref)
+	}
+	if key := ref.objectKey(); w.watch != nil && w.watching[key] == nil {
+		stop := make(chan struct{})
+		w.watching[key] = stop
+		w.watch(ref, func(data map[string][]byte) {
+			w.changed(ref.Kind, ref.Namespace, ref.Name, data)
+		}, stop)
+	}
+}
+
+//Tracked whether chart object of r is watched
+func (w *chartWatcher) Tracked(r *v1alpha1.HelmApp) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, ok := w.tracked[pollKey(r)]
+	return ok
+}
+
+//Untrack stops watching chart object of r
+func (w *chartWatcher) Untrack(r *v1alpha1.HelmApp) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if watched, ok := w.tracked[pollKey(r)]; ok {
+		delete(w.tracked, pollKey(r))
+		w.unwatch(watched.ref)
+	}
+}
+
+//unwatch stops watch of object of ref if no longer referenced, with lock held
+func (w *chartWatcher) unwatch(ref *chartObjectRef) {
+	key := ref.objectKey()
+	for _, watched := range w.tracked {
+		if watched.ref.objectKey() == key {
+			return
+		}
+	}
+	if stop, ok := w.watching[key]; ok {
+		close(stop)
+		delete(w.watching, key)
+	}
+}
+
+func (w *chartWatcher) changed(kind string, namespace string, name string, data map[string][]byte) {
+	w.lock.Lock()
+	changed := map[string]*watchedChart{}
+	for key, watched := range w.tracked {
+		ref := watched.ref
+		if ref.Kind == kind && ref.Namespace == namespace && ref.Name == name {
+			changed[key] = watched
+		}
+	}
+	w.lock.Unlock()
+	for key, watched := range changed {
+		archive, ok := data[watched.ref.Key]
+		if !ok {
+			continue
+		}
+		digest := charts.Digest(archive)
+		if digest == watched.digest {
+			continue
+		}
+		logger := resourceLogger(watched.resource, "watch")
+		logger.Printf("chart %s changed to %s", watched.ref, digest)
+		if err := touchChartRevision(watched.resource, digest); err != nil {
+			if apierrors.IsNotFound(err) {
+				w.Untrack(watched.resource)
+				continue
+			}
+			logger.Errorf("failed to trigger upgrade: %v", err)
+			continue
+		}
+		w.lock.Lock()
+		if w.tracked[key] == watched {
+			watched.digest = digest
+		}
+		w.lock.Unlock()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestChartWatcherWatchesReferencedObjects(t *testing.T) {
+	watcher, watching := newChartWatcher(), map[string]int{}
+	stops := map[string]<-chan struct{}{}
+	watcher.watch = func(ref *chartObjectRef, changed func(data map[string][]byte), stop <-chan struct{}) {
+		watching[ref.objectKey()]++
+		stops[ref.objectKey()] = stop
+	}
+	stopped := func(key string) bool {
+		select {
+		case <-stops[key]:
+			return true
+		default:
+			return false
+		}
+	}
+	a, b := testResource(nil), testResource(nil)
+	b.SetName("other")
+	charts, _ := parseChartObjectRef("default", "configmap://charts/redis.tgz")
+	other, _ := parseChartObjectRef("default", "secret://charts/redis.tgz")
+
+	watcher.Track(a, charts, "")
+	watcher.Track(a, charts, "sha256:abc")
+	watcher.Track(b, charts, "")
+	if watching[charts.objectKey()] != 1 {
+		t.Errorf("object watched %d times", watching[charts.objectKey()])
+	}
+	watcher.Untrack(a)
+	if stopped(charts.objectKey()) {
+		t.Error("watch of object still referenced stopped")
+	}
+	watcher.Track(b, other, "")
+	if !stopped(charts.objectKey()) || watching[other.objectKey()] != 1 {
+		t.Error("watch not moved to object referenced")
+	}
+	watcher.Untrack(b)
+	if !stopped(other.objectKey()) || len(watcher.watching) != 0 {
+		t.Error("watch of object no longer referenced not stopped")
+	}
+}
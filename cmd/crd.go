@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"strings"
 
 	"github.com/xiaopal/helm-app-operator/cmd/helmext"
@@ -10,91 +13,234 @@ import (
 	apiextclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/helm/pkg/chartutil"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 
-	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/apis/app/v1alpha1"
 	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
 	"github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/schema"
 )
 
-func initCRDResource() error {
+//crdPrinterColumns additionalPrinterColumns of CRD, not known by vendored apiextensions types
+var crdPrinterColumns = []map[string]interface{}{
+	{"name": "Phase", "type": "string", "JSONPath": ".status.phase"},
+	{"name": "Release", "type": "string", "JSONPath": ".status.release.name"},
+	{"name": "Revision", "type": "integer", "JSONPath": ".status.release.version"},
+	{"name": "Chart", "type": "string", "JSONPath": ".status.release.chart.metadata.version"},
+	{"name": "Age", "type": "date", "JSONPath": ".metadata.creationTimestamp"},
+}
+
+//initCRDResource creates or updates CRD of op, with status subresource, printer columns and openAPIV3Schema of spec
+func initCRDResource(op *option.Operator) error {
 	clientset, err := apiextclientset.NewForConfig(k8sclient.GetKubeConfig())
 	if err != nil {
 		return err
 	}
+	objects, err := internalclientset.NewForConfig(k8sclient.GetKubeConfig())
+	if err != nil {
+		return err
+	}
+	crd := crdManifest(op, clusterObjects{objects})
+	body, err := crdBody(crd)
+	if err != nil {
+		return err
+	}
+	client, result := clientset.ApiextensionsV1beta1().RESTClient(), &apiextv1beta1.CustomResourceDefinition{}
+	err = client.Post().Resource("customresourcedefinitions").Body(body).Do().Into(result)
+	if err == nil {
+		logger.Printf("CRD initialized: %s", op.CRD)
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(op.CRDName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	crd.SetResourceVersion(existing.GetResourceVersion())
+	crd.SetLabels(existing.GetLabels())
+	crd.SetAnnotations(existing.GetAnnotations())
+	if body, err = crdBody(crd); err != nil {
+		return err
+	}
+	if err := client.Put().Resource("customresourcedefinitions").Name(op.CRDName).Body(body).Do().Into(result); err != nil {
+		return err
+	}
+	logger.Printf("CRD updated: %s", op.CRD)
+	return nil
+}
+
+//crdManifest CRD of operator, with openAPIV3Schema of spec if --crd-validation,
+//objects are ConfigMaps and Secrets of configmap:// and secret:// charts
+func crdManifest(op *option.Operator, objects objectSource) *apiextv1beta1.CustomResourceDefinition {
 	crd := &apiextv1beta1.CustomResourceDefinition{
-		ObjectMeta: metav1.ObjectMeta{Name: option.OptionCRDName},
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apiextensions.k8s.io/v1beta1", Kind: "CustomResourceDefinition"},
+		ObjectMeta: metav1.ObjectMeta{Name: op.CRDName},
 		Spec: apiextv1beta1.CustomResourceDefinitionSpec{
-			Group:   option.OptionCRDGroup,
-			Version: option.OptionCRDVersion,
+			Group:   op.CRDGroup,
+			Version: op.CRDVersion,
 			Scope:   apiextv1beta1.NamespaceScoped,
 			Names: apiextv1beta1.CustomResourceDefinitionNames{
-				Plural: option.OptionCRDPlural,
-				Kind:   option.OptionCRDKind,
+				Plural:   op.CRDPlural,
+				Singular: op.CRDSingular,
+				Kind:     op.CRDKind,
+			},
+			Subresources: &apiextv1beta1.CustomResourceSubresources{
+				Status: &apiextv1beta1.CustomResourceSubresourceStatus{},
 			},
 		},
 	}
-	_, err = clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Create(crd)
-	if err == nil {
-		logger.Printf("CRD initialized: %s", option.OptionCRD)
-		return nil
+	if option.OptionCRDValidation {
+		spec, err := specSchema(op, objects)
+		if err != nil {
+			logger.Warnf("CRD %s without validation: %v", op.CRD, err)
+		} else {
+			crd.Spec.Validation = &apiextv1beta1.CustomResourceValidation{
+				OpenAPIV3Schema: &apiextv1beta1.JSONSchemaProps{
+					Type:       "object",
+					Properties: map[string]apiextv1beta1.JSONSchemaProps{"spec": *spec},
+				},
+			}
+		}
 	}
-	if apierrors.IsAlreadyExists(err) {
-		logger.Printf("CRD already initialized: %s", option.OptionCRD)
-		return nil
+	return crd
+}
+
+//crdBody JSON of crd with additionalPrinterColumns
+func crdBody(crd *apiextv1beta1.CustomResourceDefinition) ([]byte, error) {
+	bytes, err := json.Marshal(crd)
+	if err != nil {
+		return nil, err
 	}
-	return err
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(bytes, &object); err != nil {
+		return nil, err
+	}
+	object["spec"].(map[string]interface{})["additionalPrinterColumns"] = crdPrinterColumns
+	return json.Marshal(object)
+}
+
+//specSchema openAPIV3Schema of resource spec, converted from values schema (--values-schema or values.schema.json of chart),
+//or inferred from types of chart values
+func specSchema(op *option.Operator, objects objectSource) (*apiextv1beta1.JSONSchemaProps, error) {
+	if len(op.Chart) == 0 && len(op.ValuesSchemaFile()) == 0 {
+		return nil, fmt.Errorf("neither --chart nor --values-schema present")
+	}
+	var s *schema.Schema
+	if len(op.ValuesSchemaFile()) > 0 {
+		data, err := ioutil.ReadFile(op.ValuesSchemaFile())
+		if err != nil {
+			return nil, err
+		}
+		if s, err = schema.Parse(data); err != nil {
+			return nil, err
+		}
+	} else {
+		chart, err := readOperatorChart(op, objects)
+		if err != nil {
+			return nil, err
+		}
+		behavior := installerBehavior{operator: op}
+		if s, err = behavior.valuesSchema(chart); err != nil {
+			return nil, err
+		}
+		if s == nil {
+			defaults, err := chartutil.ReadValues([]byte(chart.GetValues().GetRaw()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse values of chart %s: %v", chart.GetMetadata().GetName(), err)
+			}
+			s = schema.Infer(map[string]interface{}(defaults))
+		}
+	}
+	s, err := s.OpenAPI()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	props := &apiextv1beta1.JSONSchemaProps{}
+	if err := json.Unmarshal(bytes, props); err != nil {
+		return nil, err
+	}
+	if props.Type == "" {
+		props.Type = "object"
+	}
+	return props, nil
+}
+
+//readOperatorChart loads default chart of op through chart sources, as resources without chart option would
+func readOperatorChart(op *option.Operator, objects objectSource) (*cpb.Chart, error) {
+	behavior := installerBehavior{op, objects, option.NewChartCache(), newChartPoller(), newChartWatcher()}
+	r := &v1alpha1.HelmApp{TypeMeta: metav1.TypeMeta{APIVersion: op.APIVersion, Kind: op.CRDKind}}
+	r.SetNamespace(option.OptionNamespace)
+	r.SetName(op.CRDSingular)
+	chartPath, err := behavior.TranslateChartPath(r, op.Chart)
+	if err != nil {
+		return nil, err
+	}
+	return behavior.ReadChart(r, chartPath)
 }
 
 func installCRDResource(resource string) error {
-	client, _, err := k8sclient.GetResourceClient(option.OptionAPIVersion, option.OptionCRDKind, option.OptionNamespace)
+	op := option.Operators[0]
+	client, _, err := k8sclient.GetResourceClient(op.APIVersion, op.CRDKind, option.OptionNamespace)
 	if err != nil {
 		return err
 	}
-	specValues, err := option.DecorateValues(map[string]interface{}{}, [][]byte{})
+	specValues, err := op.DecorateValues(map[string]interface{}{}, [][]byte{})
 	if err != nil {
 		return err
 	}
 	req := &v1alpha1.HelmApp{
 		TypeMeta: metav1.TypeMeta{
-			APIVersion: option.OptionAPIVersion,
-			Kind:       option.OptionCRDKind,
+			APIVersion: op.APIVersion,
+			Kind:       op.CRDKind,
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        resource,
-			Annotations: optionAnnotations(),
+			Name: resource,
 		},
 		Spec: specValues,
 	}
+	req.SetAnnotations(optionAnnotations(req))
 
 	target, err := client.Get(resource, metav1.GetOptions{})
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			_, err = client.Create(k8sutil.UnstructuredFromRuntimeObject(req))
-			logger.Printf("CRD resource installed: %s", option.OptionInstallResource)
+		if !apierrors.IsNotFound(err) {
+			return err
 		}
-		return err
+		if target, err = client.Create(k8sutil.UnstructuredFromRuntimeObject(req)); err != nil {
+			return err
+		}
+		logger.Printf("CRD resource installed: %s", option.OptionInstallResource)
+		return waitInstalled(client, resource, target)
 	}
 	if option.OptionInstallOnce {
 		logger.Printf("CRD resource exists: %s", option.OptionInstallResource)
-		return nil
+		return waitInstalled(client, resource, nil)
 	}
 	req.SetResourceVersion(target.GetResourceVersion())
-	if _, err = client.Update(k8sutil.UnstructuredFromRuntimeObject(req)); err != nil {
+	if target, err = client.Update(k8sutil.UnstructuredFromRuntimeObject(req)); err != nil {
 		return err
 	}
 	logger.Printf("CRD resource updated: %s", option.OptionInstallResource)
-	return nil
+	return waitInstalled(client, resource, target)
 }
 
 func uninstallCRDResource(resource string) error {
-	client, _, err := k8sclient.GetResourceClient(option.OptionAPIVersion, option.OptionCRDKind, option.OptionNamespace)
+	op := option.Operators[0]
+	client, _, err := k8sclient.GetResourceClient(op.APIVersion, op.CRDKind, option.OptionNamespace)
 	if err != nil {
 		return err
 	}
 	err = client.Delete(resource, &metav1.DeleteOptions{})
 	if err == nil {
 		logger.Printf("CRD resource uninstalled: %s", option.OptionUninstallResource)
-		return nil
+		return waitUninstalled(client, resource)
 	}
 	if apierrors.IsNotFound(err) {
 		logger.Printf("CRD resource not exists: %s", option.OptionUninstallResource)
@@ -103,14 +249,14 @@ func uninstallCRDResource(resource string) error {
 	return err
 }
 
-func optionAnnotations() map[string]string {
+func optionAnnotations(r *v1alpha1.HelmApp) map[string]string {
 	annotations := map[string]string{}
 	for _, option := range option.OptionInstallOptions {
 		name, value, eq := option, "", strings.Index(option, "=")
 		if eq >= 0 {
 			name, value = option[:eq], option[eq+1:]
 		}
-		annotations[helmext.OptionAnnotation(name)] = value
+		annotations[helmext.OptionAnnotation(r, name)] = value
 	}
 	return annotations
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/Masterminds/semver"
+	"github.com/golang/protobuf/proto"
+	"k8s.io/helm/pkg/chartutil"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/version"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
+)
+
+//resolvedDependencyIdle time after which dependencies resolved but not used since are forgotten
+const resolvedDependencyIdle = time.Hour
+
+//resolvedDependencies dir of dependencies fetched from repositories, by key of resolveDependency.
+//Entries whose dir was evicted from the chart cache, or idle for resolvedDependencyIdle, are pruned as others are stored
+var resolvedDependencies = struct {
+	sync.Mutex
+	entries map[string]*resolvedDependency
+}{entries: map[string]*resolvedDependency{}}
+
+type resolvedDependency struct {
+	path     string
+	resolved time.Time
+	lastUsed time.Time
+}
+
+//lookupResolvedDependency dir of dependency resolved by key no longer than maxAge ago (0 for any time), still in cache
+func lookupResolvedDependency(key string, maxAge time.Duration) (string, bool) {
+	resolvedDependencies.Lock()
+	defer resolvedDependencies.Unlock()
+	resolved, ok := resolvedDependencies.entries[key]
+	if !ok || maxAge > 0 && time.Since(resolved.resolved) >= maxAge {
+		return "", false
+	}
+	if _, err := os.Stat(resolved.path); err != nil {
+		delete(resolvedDependencies.entries, key)
+		return "", false
+	}
+	resolved.lastUsed = time.Now()
+	return resolved.path, true
+}
+
+//storeResolvedDependency records dir of dependency resolved by key, pruning entries evicted or idle
+func storeResolvedDependency(key string, path string) {
+	resolvedDependencies.Lock()
+	defer resolvedDependencies.Unlock()
+	for k, resolved := range resolvedDependencies.entries {
+		if time.Since(resolved.lastUsed) > resolvedDependencyIdle {
+			delete(resolvedDependencies.entries, k)
+		} else if _, err := os.Stat(resolved.path); err != nil {
+			delete(resolvedDependencies.entries, k)
+		}
+	}
+	now := time.Now()
+	resolvedDependencies.entries[key] = &resolvedDependency{path, now, now}
+}
+
+//resolveDependencies fetches dependencies of requirements.yaml missing from charts/ through chart sources,
+//pinned to versions of requirements.lock if any. condition/tags are evaluated later against release values.
+func (c installerBehavior) resolveDependencies(r *v1alpha1.HelmApp, chart *cpb.Chart, chartPath string) error {
+	reqs, err := chartutil.LoadRequirements(chart)
+	if err == chartutil.ErrRequirementsNotFound {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to parse requirements.yaml of %s: %v", chart.Metadata.Name, err)
+	}
+	locked, err := lockedDependencies(chart, reqs)
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(chart)
+	if err != nil {
+		return err
+	}
+	digest := charts.Digest(data)
+	for _, dep := range reqs.Dependencies {
+		if dependencyPresent(chart, dep) {
+			continue
+		}
+		constraint := dep.Version
+		if lock, ok := locked[dep.Name]; ok {
+			constraint = lock.Version
+		}
+		depPath, err := c.resolveDependency(r, digest, dep, constraint, chartPath)
+		if err != nil {
+			return fmt.Errorf("failed to fetch dependency %s of %s: %v", dep.Name, chart.Metadata.Name, err)
+		}
+		sub, err := c.cache.Load(depPath)
+		if err != nil {
+			return fmt.Errorf("failed to load dependency %s of %s: %v", dep.Name, chart.Metadata.Name, err)
+		}
+		if err := c.resolveDependencies(r, sub, depPath); err != nil {
+			return err
+		}
+		chart.Dependencies = append(chart.Dependencies, sub)
+	}
+	return nil
+}
+
+//resolveDependency dir of dependency, resolved once per chart digest so that constraints do not request the repository
+//every reconcile, again after --chart-refresh with 'fetch: always'
+func (c installerBehavior) resolveDependency(r *v1alpha1.HelmApp, digest string, dep *chartutil.Dependency, constraint string, chartPath string) (string, error) {
+	if strings.HasPrefix(dep.Repository, "file://") {
+		return c.fetchDependency(r, dep, constraint, chartPath)
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s/%s@%s", c.operator.Name, r.GetNamespace(), digest, dep.Repository, dep.Name, constraint)
+	_, maxAge := c.fetchAlways(r)
+	if depPath, ok := lookupResolvedDependency(key, maxAge); ok {
+		return depPath, nil
+	}
+	depPath, err := c.fetchDependency(r, dep, constraint, chartPath)
+	if err != nil {
+		return "", err
+	}
+	storeResolvedDependency(key, depPath)
+	return depPath, nil
+}
+
+//dependencyPresent whether dependency is vendored in charts/ (or fetched for another alias), any version if not given
+func dependencyPresent(chart *cpb.Chart, dep *chartutil.Dependency) bool {
+	for _, sub := range chart.Dependencies {
+		if sub.Metadata.Name == dep.Name && (dep.Version == "" || version.IsCompatibleRange(dep.Version, sub.Metadata.Version)) {
+			return true
+		}
+	}
+	return false
+}
+
+//lockedDependencies dependencies of requirements.lock by name, which must be in sync with requirements.yaml
+func lockedDependencies(chart *cpb.Chart, reqs *chartutil.Requirements) (map[string]*chartutil.Dependency, error) {
+	locked := map[string]*chartutil.Dependency{}
+	lock, err := chartutil.LoadRequirementsLock(chart)
+	if err == chartutil.ErrLockfileNotFound {
+		return locked, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to parse requirements.lock of %s: %v", chart.Metadata.Name, err)
+	}
+	for _, dep := range lock.Dependencies {
+		locked[dep.Name] = dep
+	}
+	for _, dep := range reqs.Dependencies {
+		lock, ok := locked[dep.Name]
+		if !ok || lock.Repository != dep.Repository {
+			return nil, fmt.Errorf("requirements.lock of %s is out of sync with requirements.yaml: %s", chart.Metadata.Name, dep.Name)
+		}
+		if dep.Version == "" {
+			continue
+		}
+		constraint, err := semver.NewConstraint(dep.Version)
+		if err != nil {
+			return nil, fmt.Errorf("illegal version %q of dependency %s: %v", dep.Version, dep.Name, err)
+		}
+		v, err := semver.NewVersion(lock.Version)
+		if err != nil || !constraint.Check(v) {
+			return nil, fmt.Errorf("requirements.lock of %s is out of sync with requirements.yaml: %s %s does not match %s", chart.Metadata.Name, dep.Name, lock.Version, dep.Version)
+		}
+	}
+	return locked, nil
+}
+
+//fetchDependency fetches dependency from its repository: 'file://<path>' relative to chart dir,
+//'@<repo>' or 'alias:<repo>' of --repo, 'http(s)://' chart repository, or 'oci://<registry>/<repository>'
+func (c installerBehavior) fetchDependency(r *v1alpha1.HelmApp, dep *chartutil.Dependency, constraint string, chartPath string) (string, error) {
+	repoURL := dep.Repository
+	switch {
+	case strings.HasPrefix(repoURL, "file://"):
+		if info, err := os.Stat(chartPath); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("%s not available for chart not in a directory", repoURL)
+		}
+		depPath := strings.TrimPrefix(repoURL, "file://")
+		if !filepath.IsAbs(depPath) {
+			depPath = filepath.Join(chartPath, depPath)
+		}
+		return depPath, nil
+	case charts.IsOCIReference(repoURL):
+		ref, err := charts.ParseOCIReference(strings.TrimSuffix(repoURL, "/")+"/"+dep.Name, constraint)
+		if err != nil {
+			return "", err
+		}
+		registry, err := c.ociRegistry(r)
+		if err != nil {
+			return "", err
+		}
+		_, maxAge := c.fetchAlways(r)
+		var depPath string
+		err = withFetchTimeout(r, func(ctx context.Context) (err error) {
+			depPath, _, err = registry.Fetch(ctx, c.cache, ref, maxAge)
+			return err
+		})
+		return depPath, err
+	case strings.HasPrefix(repoURL, "@") || strings.HasPrefix(repoURL, "alias:"):
+		name := strings.TrimPrefix(strings.TrimPrefix(repoURL, "@"), "alias:")
+		repo, ok := option.OptionRepositories[name]
+		if !ok {
+			return "", fmt.Errorf("repository %s not configured with --repo", name)
+		}
+		return c.fetchRepositoryDependency(r, repo, dep.Name, constraint)
+	case strings.HasPrefix(repoURL, "http://") || strings.HasPrefix(repoURL, "https://"):
+		repo := &charts.Repository{Name: repoURL, URL: strings.TrimSuffix(repoURL, "/") + "/"}
+		for _, configured := range option.OptionRepositories {
+			if configured.URL == repo.URL {
+				repo = configured
+			}
+		}
+		return c.fetchRepositoryDependency(r, repo, dep.Name, constraint)
+	}
+	return "", fmt.Errorf("unsupported repository %q", repoURL)
+}
+
+func (c installerBehavior) fetchRepositoryDependency(r *v1alpha1.HelmApp, repo *charts.Repository, name string, constraint string) (string, error) {
+	var depPath string
+	err := withFetchTimeout(r, func(ctx context.Context) (err error) {
+		depPath, _, err = repo.Fetch(ctx, c.cache, name, constraint, charts.Verification{})
+		return err
+	})
+	return depPath, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+//testRequirementsChart chart of requirements.yaml, with vendored dependencies
+func testRequirementsChart(requirements string, vendored ...*cpb.Chart) *cpb.Chart {
+	return &cpb.Chart{
+		Metadata:     &cpb.Metadata{ApiVersion: "v1", Name: "app", Version: "1.0.0"},
+		Files:        []*any.Any{{TypeUrl: "requirements.yaml", Value: []byte(requirements)}},
+		Dependencies: vendored,
+	}
+}
+
+func TestDependencyWithoutVersionPresent(t *testing.T) {
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+	redis := &cpb.Chart{Metadata: &cpb.Metadata{ApiVersion: "v1", Name: "redis", Version: "1.2.3"}}
+	chart := testRequirementsChart("dependencies:\n- name: redis\n  repository: http://127.0.0.1:1/\n", redis)
+	if err := behavior.resolveDependencies(testResource(nil), chart, ""); err != nil {
+		t.Errorf("vendored dependency without version fetched: %v", err)
+	}
+	if len(chart.Dependencies) != 1 {
+		t.Errorf("unexpected dependencies %v", chart.Dependencies)
+	}
+}
+
+func TestDependencyResolvedOnce(t *testing.T) {
+	requests := map[string]int{}
+	archive := testChartArchive(t, "redis", "1.2.7")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		switch req.URL.Path {
+		case "/index.yaml":
+			w.Write([]byte("apiVersion: v1\nentries:\n  redis:\n  - {name: redis, version: 1.2.7, urls: [redis-1.2.7.tgz]}\n"))
+		case "/redis-1.2.7.tgz":
+			w.Write(archive)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+	chart := testRequirementsChart(fmt.Sprintf("dependencies:\n- name: redis\n  version: ~1.2\n  repository: %s\n", server.URL))
+
+	for i := 0; i < 2; i++ {
+		loaded := proto.Clone(chart).(*cpb.Chart)
+		if err := behavior.resolveDependencies(testResource(nil), loaded, ""); err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded.Dependencies) != 1 || loaded.Dependencies[0].Metadata.Version != "1.2.7" {
+			t.Errorf("unexpected dependencies %v", loaded.Dependencies)
+		}
+	}
+	if n := requests["/index.yaml"]; n != 1 {
+		t.Errorf("constraint resolved again, index requested %d times", n)
+	}
+}
+
+func TestResolvedDependenciesPruned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dependencies-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storeResolvedDependency("evicted", dir+"/evicted")
+	storeResolvedDependency("idle", dir)
+	resolvedDependencies.Lock()
+	resolvedDependencies.entries["idle"].lastUsed = time.Now().Add(-2 * resolvedDependencyIdle)
+	resolvedDependencies.Unlock()
+	storeResolvedDependency("used", dir)
+
+	if _, ok := lookupResolvedDependency("used", 0); !ok {
+		t.Error("resolved dependency forgotten")
+	}
+	if _, ok := lookupResolvedDependency("used", time.Nanosecond); ok {
+		t.Error("dependency resolved longer than max age ago reused")
+	}
+	resolvedDependencies.Lock()
+	defer resolvedDependencies.Unlock()
+	for _, key := range []string{"evicted", "idle"} {
+		if _, ok := resolvedDependencies.entries[key]; ok {
+			t.Errorf("%s dependency not pruned", key)
+		}
+	}
+	delete(resolvedDependencies.entries, "used")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/ghodss/yaml"
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
+	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/helm/pkg/releaseutil"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+	"github.com/xiaopal/helm-app-operator/cmd/textdiff"
+)
+
+//diffResources diffs deployed releases of resources in file against their rendering by the operator,
+//writes a unified diff of each changed object to out, returns whether anything differs
+func diffResources(file string, out io.Writer) (bool, error) {
+	manifests, err := readManifests(file)
+	if err != nil {
+		return false, err
+	}
+	storageBackend, err := option.GetStorageBackend()
+	if err != nil {
+		return false, err
+	}
+	clientset, err := internalclientset.NewForConfig(k8sclient.GetKubeConfig())
+	if err != nil {
+		return false, err
+	}
+	kubeClient, err := option.KubeClient()
+	if err != nil {
+		return false, err
+	}
+	chartCache, installers := option.NewChartCache(), map[schema.GroupVersionKind]helmext.Installer{}
+	for _, op := range option.Operators {
+		installers[schema.FromAPIVersionAndKind(op.APIVersion, op.CRDKind)] = helmext.NewInstallerWithBehavior(storageBackend, kubeClient, op.Chart,
+			installerBehavior{op, clusterObjects{clientset}, chartCache, newChartPoller(), newChartWatcher()})
+	}
+	differs := false
+	for _, manifest := range manifests {
+		r, installer, err := parseResource(manifest, installers)
+		if err != nil {
+			return false, err
+		}
+		liveManifest := ""
+		if live, err := storageBackend.Deployed(installer.ReleaseName(r)); err == nil {
+			liveManifest = live.GetManifest()
+		} else if !strings.Contains(err.Error(), "no deployed releases") {
+			return false, err
+		}
+		if live := r.DeepCopy(); sdk.Get(live) == nil {
+			//values of resource include outputs of hooks recorded in its live status
+			r.Status.Outputs = live.Status.Outputs
+		}
+		release, err := installer.DryRunRelease(r)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", resourceKey(r), err)
+		}
+		changed, err := diffManifests(liveManifest, release.GetManifest(), r.GetNamespace(), out)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", resourceKey(r), err)
+		}
+		differs = differs || changed
+	}
+	return differs, nil
+}
+
+//diffManifests writes unified diff of objects changed from live to rendered manifests, data of Secrets masked
+func diffManifests(live string, rendered string, namespace string, out io.Writer) (bool, error) {
+	liveObjects, err := manifestObjects(live, namespace)
+	if err != nil {
+		return false, err
+	}
+	renderedObjects, err := manifestObjects(rendered, namespace)
+	if err != nil {
+		return false, err
+	}
+	keys := []string{}
+	for key := range liveObjects {
+		keys = append(keys, key)
+	}
+	for key := range renderedObjects {
+		if _, ok := liveObjects[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	changed := false
+	for _, key := range keys {
+		from, to := liveObjects[key], renderedObjects[key]
+		if kind, _ := firstObject(from, to)["kind"].(string); kind == "Secret" {
+			maskSecretData(from, to)
+		}
+		fromText, fromName, err := objectText(from, "live/"+key)
+		if err != nil {
+			return false, err
+		}
+		toText, toName, err := objectText(to, "rendered/"+key)
+		if err != nil {
+			return false, err
+		}
+		if diff := textdiff.Unified(fromText, toText, fromName, toName, option.OptionDiffContext); diff != "" {
+			fmt.Fprint(out, diff)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+//manifestObjects objects of manifests keyed by '<namespace>/<kind>/<name>'
+func manifestObjects(manifests string, namespace string) (map[string]map[string]interface{}, error) {
+	objects := map[string]map[string]interface{}{}
+	for _, manifest := range releaseutil.SplitManifests(manifests) {
+		object := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(manifest), &object); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %v", err)
+		}
+		kind, _ := object["kind"].(string)
+		if kind == "" {
+			continue
+		}
+		metadata, _ := object["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		ns, _ := metadata["namespace"].(string)
+		if ns == "" {
+			ns = namespace
+		}
+		objects[fmt.Sprintf("%s/%s/%s", ns, kind, name)] = object
+	}
+	return objects, nil
+}
+
+func firstObject(objects ...map[string]interface{}) map[string]interface{} {
+	for _, object := range objects {
+		if object != nil {
+			return object
+		}
+	}
+	return nil
+}
+
+//maskSecretData replaces values of Secret data and stringData, marking values changed from live to rendered
+func maskSecretData(live map[string]interface{}, rendered map[string]interface{}) {
+	for _, field := range []string{"data", "stringData"} {
+		liveData, _ := live[field].(map[string]interface{})
+		renderedData, _ := rendered[field].(map[string]interface{})
+		for key, value := range renderedData {
+			if liveValue, ok := liveData[key]; ok && fmt.Sprint(liveValue) == fmt.Sprint(value) {
+				renderedData[key] = "(masked)"
+			} else {
+				renderedData[key] = "(masked, changed)"
+			}
+		}
+		for key := range liveData {
+			liveData[key] = "(masked)"
+		}
+	}
+}
+
+//objectText YAML of object and its diff name, empty and /dev/null if absent
+func objectText(object map[string]interface{}, name string) (string, string, error) {
+	if object == nil {
+		return "", "/dev/null", nil
+	}
+	bytes, err := yaml.Marshal(object)
+	if err != nil {
+		return "", "", err
+	}
+	return string(bytes), name, nil
+}
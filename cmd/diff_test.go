@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+)
+
+const testLiveManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  a: "1"
+  b: "2"
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: credentials
+data:
+  password: b2xk
+  user: YWRtaW4=
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed
+  namespace: other
+`
+
+const testRenderedManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  a: "1"
+  b: "3"
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: credentials
+data:
+  password: bmV3
+  user: YWRtaW4=
+  token: dG9rZW4=
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: added
+`
+
+func TestDiffManifests(t *testing.T) {
+	defer func(context int) { option.OptionDiffContext = context }(option.OptionDiffContext)
+	option.OptionDiffContext = 3
+	out := &bytes.Buffer{}
+	changed, err := diffManifests(testLiveManifest, testRenderedManifest, "default", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := out.String()
+	if !changed {
+		t.Errorf("changes not reported")
+	}
+	for _, expected := range []string{
+		"--- live/default/ConfigMap/config\n+++ rendered/default/ConfigMap/config\n",
+		"-  b: \"2\"\n+  b: \"3\"\n",
+		"--- /dev/null\n+++ rendered/default/Service/added\n",
+		"--- live/other/Service/removed\n+++ /dev/null\n",
+		"-  password: (masked)\n+  password: (masked, changed)\n",
+		"+  token: (masked, changed)\n",
+	} {
+		if !strings.Contains(diff, expected) {
+			t.Errorf("diff without %q:\n%s", expected, diff)
+		}
+	}
+	for _, secret := range []string{"b2xk", "bmV3", "YWRtaW4=", "dG9rZW4="} {
+		if strings.Contains(diff, secret) {
+			t.Errorf("secret data %s not masked:\n%s", secret, diff)
+		}
+	}
+	if !strings.Contains(diff, "   user: (masked)\n") {
+		t.Errorf("unchanged secret key marked changed:\n%s", diff)
+	}
+
+	out.Reset()
+	if changed, err := diffManifests(testLiveManifest, testLiveManifest, "default", out); err != nil || changed || out.Len() > 0 {
+		t.Errorf("unchanged manifests reported changed: %v\n%s", err, out)
+	}
+}
@@ -1,19 +1,48 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/apis/app/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
 	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	"github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/helm/pkg/storage"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
 	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+	valuesschema "github.com/xiaopal/helm-app-operator/cmd/schema"
 )
 
+//kindHandlers dispatches events to the handler of object kind
+type kindHandlers map[schema.GroupVersionKind]sdk.Handler
+
+func (hs kindHandlers) Handle(ctx context.Context, event sdk.Event) error {
+	if h, ok := hs[event.Object.GetObjectKind().GroupVersionKind()]; ok {
+		return h.Handle(ctx, event)
+	}
+	return nil
+}
+
 type handler struct {
+	operator   *option.Operator
 	controller helmext.Installer
+	//releases storage of releases to check drift against, nil to skip
+	releases *storage.Storage
+	//tracker tracks moving charts of resources on every event, nil to skip
+	tracker chartTracker
 }
 
 func (h *handler) Handle(ctx context.Context, event sdk.Event) error {
@@ -23,9 +52,11 @@ func (h *handler) Handle(ctx context.Context, event sdk.Event) error {
 			//ignore delete event
 			return nil
 		}
+		defer beginReconcile(o)()
+		logger := resourceLogger(o, "handler")
 		finalizerFound, finalizerRemains := false, []string{}
 		for _, v := range o.GetFinalizers() {
-			if v == helmext.OperatorName() {
+			if v == helmext.OperatorName(o) {
 				finalizerFound = true
 			} else {
 				finalizerRemains = append(finalizerRemains, v)
@@ -35,76 +66,270 @@ func (h *handler) Handle(ctx context.Context, event sdk.Event) error {
 			if !finalizerFound {
 				return nil
 			}
-			logger.Printf("Uninstalling %s", strings.Join([]string{o.GetNamespace(), o.GetName()}, "/"))
-			if err := execHook(o, "pre-uninstall"); err != nil {
+			logger.Printf("Uninstalling %s", resourceKey(o))
+			revisionEnvs := []string{"EVENT_PREVIOUS_REVISION=" + revisionOf(o)}
+			if err := execHook(h.operator, o, "pre-uninstall", revisionEnvs...); err != nil {
+				if isHookTimeoutError(err) {
+					h.updateFailure(o, err, revisionEnvs...)
+				}
 				return err
 			}
 			updatedResource, err := h.controller.UninstallRelease(o)
 			if err != nil {
 				if strings.Contains(err.Error(), "not found") {
-					logger.Printf("%s already uninstalled", strings.Join([]string{o.GetNamespace(), o.GetName()}, "/"))
+					logger.Printf("%s already uninstalled", resourceKey(o))
 					return nil
 				}
-				logger.Printf("failed to uninstall release: %v", err.Error())
+				logger.Errorf("failed to uninstall release: %v", err.Error())
 				return err
 			}
 			if !event.Deleted {
 				updatedResource.SetFinalizers(finalizerRemains)
-				err = sdk.Update(updatedResource)
+				err = h.updateResource(updatedResource)
 				if err != nil {
-					logger.Printf("failed to update custom resource status: %v", err.Error())
+					logger.Errorf("failed to update custom resource status: %v", err.Error())
 					return err
 				}
 			}
-			if err := execHook(updatedResource, "post-uninstall"); err != nil {
+			deployedRevisions.Delete(helmext.ReleaseName(o))
+			if err := execHook(h.operator, updatedResource, "post-uninstall", revisionEnvs...); err != nil {
 				return err
 			}
-			logger.Printf("%s uninstalled", strings.Join([]string{o.GetNamespace(), o.GetName()}, "/"))
+			logger.Printf("%s uninstalled", resourceKey(o))
 			return nil
 		}
+		if h.tracker != nil {
+			//before checksum, which skips unchanged resources
+			h.tracker.TrackChart(o)
+		}
+		origin := o.DeepCopy()
 		if updated, err := h.updateChecksum(o); err != nil {
-			logger.Printf("failed to update checksum: %v", err.Error())
+			logger.Errorf("failed to update checksum: %v", err.Error())
 			return err
 		} else if !updated {
-			//unchanged, continue
-			return nil
+			if drifted, err := h.checkDrift(o); err != nil || !drifted {
+				//unchanged, continue
+				if err == nil {
+					err = h.stampSpecChecksum(o)
+				}
+				return err
+			}
+		}
+		action := "install"
+		if o.Status.Release != nil {
+			action = "upgrade"
 		}
-		logger.Printf("Installing %s", strings.Join([]string{o.GetNamespace(), o.GetName()}, "/"))
-		if err := execHook(o, "pre-install"); err != nil {
+		annoRollback := helmext.OptionAnnotation(o, helmext.OptionRollbackRevision)
+		if _, ok := o.GetAnnotations()[annoRollback]; ok {
+			action = "rollback"
+		}
+		revisionEnvs := []string{"EVENT_PREVIOUS_REVISION=" + revisionOf(o)}
+		logger.Printf("Installing %s (%s)", resourceKey(o), action)
+		if err := execHook(h.operator, o, "pre-"+action, revisionEnvs...); err != nil {
+			h.updateFailure(origin, err, revisionEnvs...)
 			return err
 		}
 		updatedResource, err := h.controller.InstallRelease(o)
 		if err != nil {
-			logger.Printf("failed to install release: %v", err.Error())
+			logger.Errorf("failed to install release: %v", err.Error())
+			h.updateFailure(origin, err, revisionEnvs...)
 			return err
 		}
+		deployedRevisions.Store(helmext.ReleaseName(o), updatedResource.Status.Release.GetVersion())
+		//rollback applied, see updateChecksum
+		annotations := updatedResource.GetAnnotations()
+		delete(annotations, annoRollback)
+		updatedResource.SetAnnotations(annotations)
 		if !finalizerFound {
-			updatedResource.SetFinalizers(append(finalizerRemains, helmext.OperatorName()))
+			updatedResource.SetFinalizers(append(finalizerRemains, helmext.OperatorName(o)))
 		}
-		err = sdk.Update(updatedResource)
+		logger = resourceLogger(updatedResource, "handler")
+		err = h.updateResource(updatedResource)
 		if err != nil {
-			logger.Printf("failed to update custom resource status: %v", err.Error())
+			logger.Errorf("failed to update custom resource status: %v", err.Error())
 			return err
 		}
-		if err := execHook(updatedResource, "post-install"); err != nil {
+		outputs := updatedResource.Status.Outputs
+		revisionEnvs = append(revisionEnvs, "EVENT_REVISION="+revisionOf(updatedResource))
+		if err := execHook(h.operator, updatedResource, "post-"+action, revisionEnvs...); err != nil {
+			if isHookTimeoutError(err) {
+				h.updateFailure(updatedResource, err, revisionEnvs...)
+			}
 			return err
 		}
-		logger.Printf("%s updated", strings.Join([]string{o.GetNamespace(), o.GetName()}, "/"))
+		if !statusEqual(v1alpha1.HelmAppStatus{Outputs: outputs}, v1alpha1.HelmAppStatus{Outputs: updatedResource.Status.Outputs}) {
+			if err := h.updateResource(updatedResource); err != nil {
+				logger.Errorf("failed to update custom resource status: %v", err.Error())
+				return err
+			}
+		}
+		logger.Printf("%s updated", resourceKey(o))
 	}
 	return nil
 }
 
+//updateFailure records failure in status of r, which keeps the last checksum so the change is retried.
+//on-failure hook runs with envs and EVENT_ERROR once per distinct failure
+func (h *handler) updateFailure(r *v1alpha1.HelmApp, err error, envs ...string) {
+	reason, annoSpecChecksum, checksum := failureReason(err), helmext.OptionAnnotation(r, optionSpecChecksum), specChecksum(r)
+	if r.Status.Phase == v1alpha1.PhaseFailed && r.Status.Reason == reason && r.Status.Message == err.Error() &&
+		r.GetAnnotations()[annoSpecChecksum] == checksum {
+		return
+	}
+	annotations := r.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[annoSpecChecksum] = checksum
+	r.SetAnnotations(annotations)
+	//failure of on-failure hook is only logged by execHook
+	execHook(h.operator, r, "on-failure", append(envs, "EVENT_ERROR="+err.Error())...)
+	r.Status = *r.Status.SetPhase(v1alpha1.PhaseFailed, reason, err.Error())
+	if err := h.updateResource(r); err != nil {
+		resourceLogger(r, "handler").Errorf("failed to update custom resource status: %v", err.Error())
+	}
+}
+
+//deployedRevisions release name -> revision last installed by operator, ahead of status of resources in cache
+var deployedRevisions sync.Map
+
+//revisionOf revision of release in status of r, empty if none
+func revisionOf(r *v1alpha1.HelmApp) string {
+	if r.Status.Release == nil {
+		return ""
+	}
+	return strconv.Itoa(int(r.Status.Release.GetVersion()))
+}
+
+//checkDrift whether release of r was changed out of band (eg. by helm rollback or delete), that is, its deployed revision
+//is not the one last installed by operator, in which case on-drift hook runs and the release is to be applied again
+func (h *handler) checkDrift(r *v1alpha1.HelmApp) (bool, error) {
+	if h.releases == nil || r.Status.Release == nil || r.Status.Phase != v1alpha1.PhaseApplied {
+		return false, nil
+	}
+	installed := r.Status.Release.GetVersion()
+	if revision, ok := deployedRevisions.Load(helmext.ReleaseName(r)); ok {
+		installed = revision.(int32)
+	}
+	current := ""
+	if deployed, err := h.releases.Deployed(helmext.ReleaseName(r)); err == nil {
+		if deployed.GetVersion() == installed {
+			return false, nil
+		}
+		current = strconv.Itoa(int(deployed.GetVersion()))
+	} else if !strings.Contains(err.Error(), "no deployed releases") {
+		resourceLogger(r, "handler").Warnf("failed to check drift: %v", err.Error())
+		return false, nil
+	}
+	resourceLogger(r, "handler").Warnf("release drifted, revision %q deployed instead of %d", current, installed)
+	return true, execHook(h.operator, r, "on-drift", "EVENT_REVISION="+current, fmt.Sprintf("EVENT_PREVIOUS_REVISION=%d", installed))
+}
+
+//updateResource updates r, and its status through the status subresource if enabled by CRD,
+//in which case apiserver ignores status of the update
+func (h *handler) updateResource(r *v1alpha1.HelmApp) error {
+	status := r.Status
+	if err := sdk.Update(r); err != nil {
+		return err
+	}
+	if statusEqual(r.Status, status) {
+		return nil
+	}
+	client, err := statusClients().ClientForGroupVersionKind(r.GroupVersionKind())
+	if err != nil {
+		return err
+	}
+	resource := &metav1.APIResource{Name: h.operator.CRDPlural + "/status", Namespaced: true, Kind: h.operator.CRDKind}
+	r.Status = status
+	result, err := client.Resource(resource, r.GetNamespace()).Update(k8sutil.UnstructuredFromRuntimeObject(r))
+	if err != nil {
+		return err
+	}
+	return k8sutil.UnstructuredIntoRuntimeObject(result, r)
+}
+
+var statusClientPool struct {
+	once sync.Once
+	pool dynamic.ClientPool
+}
+
+func statusClients() dynamic.ClientPool {
+	statusClientPool.once.Do(func() {
+		statusClientPool.pool = dynamic.NewDynamicClientPool(k8sclient.GetKubeConfig())
+	})
+	return statusClientPool.pool
+}
+
+func statusEqual(a v1alpha1.HelmAppStatus, b v1alpha1.HelmAppStatus) bool {
+	bytesA, errA := json.Marshal(a)
+	bytesB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(bytesA, bytesB)
+}
+
+func failureReason(err error) v1alpha1.ConditionReason {
+	switch {
+	case charts.IsVerificationError(err):
+		return v1alpha1.ReasonChartVerificationFailed
+	case valuesschema.IsValidationError(err):
+		return v1alpha1.ReasonValuesInvalid
+	case isHookTimeoutError(err):
+		return v1alpha1.ReasonHookTimedOut
+	}
+	return v1alpha1.ReasonApplyFailed
+}
+
+//optionSpecChecksum option of specChecksum of resource last applied or failed, written along with its status
+const optionSpecChecksum = "spec-checksum"
+
+//specChecksum checksum of what the resource itself submits: name, labels, options and spec, leaving out options
+//written by operator. install --wait computes it of the submitted resource, and waits for it to be applied
+func specChecksum(r *v1alpha1.HelmApp) string {
+	annotations := map[string]string{}
+	for k, v := range r.GetAnnotations() {
+		switch k {
+		case helmext.OptionAnnotation(r, "checksum"), helmext.OptionAnnotation(r, optionSpecChecksum),
+			helmext.OptionAnnotation(r, helmext.OptionRollbackRevision), helmext.OptionAnnotation(r, helmext.OptionChartRevision):
+		default:
+			annotations[k] = v
+		}
+	}
+	bytes, _ := json.Marshal([]interface{}{r.GetName(), r.GetNamespace(), r.GetLabels(), annotations, r.Spec})
+	return fmt.Sprintf("%x", sha1.Sum(bytes))
+}
+
+//stampSpecChecksum writes spec-checksum annotation of unchanged r, eg. applied before the annotation was introduced,
+//so that install --wait of the same spec sees it applied
+func (h *handler) stampSpecChecksum(r *v1alpha1.HelmApp) error {
+	annoSpecChecksum, checksum := helmext.OptionAnnotation(r, optionSpecChecksum), specChecksum(r)
+	if r.GetAnnotations()[annoSpecChecksum] == checksum || r.Status.Phase != v1alpha1.PhaseApplied && r.Status.Phase != v1alpha1.PhaseFailed {
+		return nil
+	}
+	annotations := r.GetAnnotations()
+	annotations[annoSpecChecksum] = checksum
+	r.SetAnnotations(annotations)
+	return h.updateResource(r)
+}
+
+//updateChecksum sets checksum annotation of r, returns whether it changed or a rollback is pending.
+//rollback-revision option is left out of checksum, as it is removed once the rollback is applied
 func (h *handler) updateChecksum(r *v1alpha1.HelmApp) (bool, error) {
-	annoChecksum := helmext.OptionAnnotation("checksum")
-	annotations, lastChecksum := map[string]string{}, ""
+	annoChecksum, annoRollback := helmext.OptionAnnotation(r, "checksum"), helmext.OptionAnnotation(r, helmext.OptionRollbackRevision)
+	annoSpecChecksum := helmext.OptionAnnotation(r, optionSpecChecksum)
+	annotations, checked, lastChecksum := map[string]string{}, map[string]string{}, ""
 	for k, v := range r.GetAnnotations() {
 		if k == annoChecksum {
 			lastChecksum = v
-		} else {
-			annotations[k] = v
+			continue
+		}
+		annotations[k] = v
+		if k != annoRollback && k != annoSpecChecksum {
+			checked[k] = v
 		}
 	}
-	values, err := h.controller.ReleaseValues(r)
+	//outputs of hooks are left out, so they are kept until hooks run again on changes of resource
+	unhooked := r.DeepCopy()
+	unhooked.Status.Outputs = nil
+	values, err := h.controller.ReleaseValues(unhooked)
 	if err != nil {
 		return false, err
 	}
@@ -112,7 +337,7 @@ func (h *handler) updateChecksum(r *v1alpha1.HelmApp) (bool, error) {
 		r.GetName(),
 		r.GetNamespace(),
 		r.GetLabels(),
-		annotations,
+		checked,
 		values,
 		r.GetDeletionTimestamp(),
 	})
@@ -120,8 +345,8 @@ func (h *handler) updateChecksum(r *v1alpha1.HelmApp) (bool, error) {
 		return false, err
 	}
 	checksum := fmt.Sprintf("%x", sha1.Sum(bytes))
-	if checksum != lastChecksum {
-		annotations[annoChecksum] = checksum
+	if _, rollback := annotations[annoRollback]; checksum != lastChecksum || rollback {
+		annotations[annoChecksum], annotations[annoSpecChecksum] = checksum, specChecksum(r)
 		r.SetAnnotations(annotations)
 		return true, nil
 	}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
+	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/storage"
+)
+
+type healthChecker struct {
+	storageBackend *storage.Storage
+	chartCache     *charts.Cache
+	clients        map[schema.GroupVersionKind]dynamic.ResourceInterface
+
+	lock     sync.Mutex
+	handling map[int64]time.Time
+	seq      int64
+	//synced kinds whose sdk informer has synced its cache
+	synced map[schema.GroupVersionKind]bool
+}
+
+func newHealthChecker(storageBackend *storage.Storage, chartCache *charts.Cache) (*healthChecker, error) {
+	clients := map[schema.GroupVersionKind]dynamic.ResourceInterface{}
+	for _, op := range option.Operators {
+		client, _, err := k8sclient.GetResourceClient(op.APIVersion, op.CRDKind, option.OptionNamespace)
+		if err != nil {
+			return nil, err
+		}
+		clients[schema.FromAPIVersionAndKind(op.APIVersion, op.CRDKind)] = client
+	}
+	return &healthChecker{
+		storageBackend: storageBackend,
+		chartCache:     chartCache,
+		clients:        clients,
+		handling:       map[int64]time.Time{},
+		synced:         map[schema.GroupVersionKind]bool{},
+	}, nil
+}
+
+type trackedHandler struct {
+	sdk.Handler
+	health *healthChecker
+}
+
+func (h trackedHandler) Handle(ctx context.Context, event sdk.Event) error {
+	c := h.health
+	c.lock.Lock()
+	//the sdk informer hands out events only once its cache synced
+	c.synced[event.Object.GetObjectKind().GroupVersionKind()] = true
+	c.seq++
+	id := c.seq
+	c.handling[id] = time.Now()
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.handling, id)
+		c.lock.Unlock()
+	}()
+	return h.Handler.Handle(ctx, event)
+}
+
+//Track wraps handler to record in-flight reconciles
+func (c *healthChecker) Track(handler sdk.Handler) sdk.Handler {
+	return trackedHandler{handler, c}
+}
+
+//Run serves /healthz and /readyz until ctx done
+func (c *healthChecker) Run(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probeHandler(c.Alive))
+	mux.HandleFunc("/readyz", probeHandler(c.Ready))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Printf("serving health probes on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Printf("health probes stopped: %v", err)
+	}
+}
+
+//Alive reports process alive and no reconcile wedged
+func (c *healthChecker) Alive() error {
+	if option.OptionHealthStallTimeout <= 0 {
+		return nil
+	}
+	timeout := time.Duration(option.OptionHealthStallTimeout) * time.Second
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, started := range c.handling {
+		if elapsed := time.Since(started); elapsed > timeout {
+			return fmt.Errorf("reconcile running for %v", elapsed.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+//Ready reports caches synced, storage reachable and chart loadable
+func (c *healthChecker) Ready() error {
+	for gvk, client := range c.clients {
+		if err := c.checkSynced(gvk, client); err != nil {
+			return fmt.Errorf("caches not synced: %v", err)
+		}
+	}
+	if err := c.checkStorage(); err != nil {
+		return fmt.Errorf("storage unreachable: %v", err)
+	}
+	for _, op := range option.Operators {
+		if err := c.checkChart(op.Chart); err != nil {
+			return fmt.Errorf("chart of %s not loadable: %v", op.CRDKind, err)
+		}
+	}
+	return nil
+}
+
+//checkSynced whether the sdk informer of kind synced, seen by its first event handled. A kind without resources
+//has no events, so a single item is listed to tell it apart from an informer still listing
+func (c *healthChecker) checkSynced(gvk schema.GroupVersionKind, client dynamic.ResourceInterface) error {
+	c.lock.Lock()
+	synced := c.synced[gvk]
+	c.lock.Unlock()
+	if synced {
+		return nil
+	}
+	list, err := client.List(metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 {
+		return fmt.Errorf("%s not handled yet", gvk.Kind)
+	}
+	c.lock.Lock()
+	c.synced[gvk] = true
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *healthChecker) checkStorage() error {
+	_, err := c.storageBackend.Query(map[string]string{"OWNER": "TILLER", "NAME": "readyz-probe"})
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		return nil
+	}
+	return err
+}
+
+func (c *healthChecker) checkChart(chartPath string) error {
+	if _, err := os.Stat(chartPath); err != nil {
+		if os.IsNotExist(err) && option.OptionFetchExec != "" {
+			//fetched on demand
+			return nil
+		}
+		return err
+	}
+	if isChart, _ := chartutil.IsChartDir(chartPath); !isChart {
+		//charts directory, chart selected per resource
+		return nil
+	}
+	_, err := c.chartCache.Load(chartPath)
+	return err
+}
+
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
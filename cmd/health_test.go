@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+//testListClient resource client listing items, other methods unimplemented
+type testListClient struct {
+	dynamic.ResourceInterface
+	items []unstructured.Unstructured
+	lists int
+}
+
+func (c *testListClient) List(opts metav1.ListOptions) (runtime.Object, error) {
+	c.lists++
+	return &unstructured.UnstructuredList{Items: c.items}, nil
+}
+
+func TestHealthSynced(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "TestApp"}
+	resource := unstructured.Unstructured{}
+	resource.SetGroupVersionKind(gvk)
+	resource.SetName("test")
+	empty, populated := &testListClient{}, &testListClient{items: []unstructured.Unstructured{resource}}
+	c := &healthChecker{handling: map[int64]time.Time{}, synced: map[schema.GroupVersionKind]bool{}}
+
+	if err := c.checkSynced(gvk, empty); err != nil {
+		t.Errorf("kind without resources not synced: %v", err)
+	}
+	if err := c.checkSynced(gvk, empty); err != nil || empty.lists != 1 {
+		t.Errorf("synced kind listed again: %v, %d lists", err, empty.lists)
+	}
+
+	c.synced = map[schema.GroupVersionKind]bool{}
+	if err := c.checkSynced(gvk, populated); err == nil {
+		t.Error("kind with resources synced before handled")
+	}
+	handler := c.Track(kindHandlers{})
+	if err := handler.Handle(context.Background(), sdk.Event{Object: &resource}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkSynced(gvk, populated); err != nil {
+		t.Errorf("kind not synced after handled: %v", err)
+	}
+}
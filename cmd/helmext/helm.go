@@ -2,13 +2,15 @@ package helmext
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 
-	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/apis/app/v1alpha1"
 	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
 	"github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
 	yaml "gopkg.in/yaml.v2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/helm/pkg/chartutil"
@@ -26,16 +28,35 @@ import (
 const (
 	//OptionChart option chart
 	OptionChart = "chart"
+	//OptionChartVersion option chart version constraint
+	OptionChartVersion = "chart-version"
+	//OptionChartDigest option sha256 digest of chart archive
+	OptionChartDigest = "chart-digest"
+	//OptionVerify option verify chart provenance
+	OptionVerify = "verify"
+	//OptionChartPullSecret option secret of chart source credentials, docker config for oci charts, basic auth for git charts
+	OptionChartPullSecret = "chart-pull-secret"
+	//OptionStrictValues option reject values not declared in values schema
+	OptionStrictValues = "strict-values"
+	//OptionChartRevision option set to trigger upgrade when chart source moved
+	OptionChartRevision = "chart-revision"
+	//OptionRollbackRevision option set by rollback command, revision the spec was rolled back to
+	OptionRollbackRevision = "rollback-revision"
 	//OptionRelease option release
 	OptionRelease = "release"
 	//OptionForce option force
 	OptionForce = "force"
 )
 
+var (
+	operatorNames sync.Map
+)
+
 // Installer can install and uninstall Helm releases given a custom resource
 // which provides runtime values for the Chart.
 type Installer interface {
 	InstallRelease(r *v1alpha1.HelmApp) (*v1alpha1.HelmApp, error)
+	DryRunRelease(r *v1alpha1.HelmApp) (*release.Release, error)
 	UninstallRelease(r *v1alpha1.HelmApp) (*v1alpha1.HelmApp, error)
 	ReleaseName(r *v1alpha1.HelmApp) string
 	ReleaseValues(r *v1alpha1.HelmApp) (map[string]interface{}, error)
@@ -44,9 +65,11 @@ type Installer interface {
 
 type installer struct {
 	storageBackend   *storage.Storage
-	tillerKubeClient *kube.Client
+	tillerKubeClient environment.KubeClient
 	chartPath        string
 	behavior         interface{}
+	//clientset of tiller, defaults to client of kube config
+	clientset internalclientset.Interface
 }
 
 // NewInstaller returns a new Helm installer capable of installing and uninstalling releases.
@@ -56,55 +79,116 @@ func NewInstaller(storageBackend *storage.Storage, tillerKubeClient *kube.Client
 
 // NewInstallerWithBehavior returns a new Helm installer capable of installing and uninstalling releases.
 func NewInstallerWithBehavior(storageBackend *storage.Storage, tillerKubeClient *kube.Client, chartPath string, behavior interface{}) Installer {
-	return installer{storageBackend, tillerKubeClient, chartPath, behavior}
+	return installer{storageBackend: storageBackend, tillerKubeClient: tillerKubeClient, chartPath: chartPath, behavior: behavior}
 }
 
 // InstallRelease accepts a custom resource, installs a Helm release using Tiller,
 // and returns the custom resource with updated `status`.
 func (c installer) InstallRelease(r *v1alpha1.HelmApp) (*v1alpha1.HelmApp, error) {
-	chart, cr, err := c.LoadChart(r, c.chartPath)
+	updatedRelease, err := c.applyRelease(r, false)
 	if err != nil {
 		return r, err
 	}
 
-	var updatedRelease *release.Release
+	r.Status = *r.Status.SetRelease(updatedRelease)
+	// TODO(alecmerdler): Call `r.Status.SetPhase()` with `NOTES.txt` of rendered Chart
+	r.Status = *r.Status.SetPhase(v1alpha1.PhaseApplied, v1alpha1.ReasonApplySuccessful, "")
+
+	return r, nil
+}
+
+// DryRunRelease accepts a custom resource, renders its Helm release using Tiller without applying it,
+// and returns the rendered release.
+func (c installer) DryRunRelease(r *v1alpha1.HelmApp) (*release.Release, error) {
+	return c.applyRelease(r, true)
+}
+
+func (c installer) applyRelease(r *v1alpha1.HelmApp, dryRun bool) (*release.Release, error) {
+	chart, cr, err := c.LoadChart(r, c.chartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := releaseConfig(r, cr)
+	if err != nil {
+		return nil, err
+	}
 	latestRelease, err := c.storageBackend.Last(c.ReleaseName(r))
 
 	tiller := c.tillerRendererForCR(r)
-	c.syncReleaseStatus(r.Status)
+	if !dryRun {
+		c.syncReleaseStatus(r.Status)
+	}
 
 	if err != nil || latestRelease == nil {
 		installReq := &services.InstallReleaseRequest{
 			Namespace: r.GetNamespace(),
 			Name:      c.ReleaseName(r),
 			Chart:     chart,
-			Values:    &cpb.Config{Raw: string(cr)},
+			Values:    config,
 			ReuseName: c.OptionForce(r),
+			DryRun:    dryRun,
 		}
 		releaseResponse, err := tiller.InstallRelease(context.TODO(), installReq)
 		if err != nil {
-			return r, err
-		}
-		updatedRelease = releaseResponse.GetRelease()
-	} else {
-		updateReq := &services.UpdateReleaseRequest{
-			Name:   c.ReleaseName(r),
-			Chart:  chart,
-			Values: &cpb.Config{Raw: string(cr)},
-			Force:  c.OptionForce(r),
+			return nil, err
 		}
-		releaseResponse, err := tiller.UpdateRelease(context.TODO(), updateReq)
+		return releaseResponse.GetRelease(), nil
+	}
+	updateReq := &services.UpdateReleaseRequest{
+		Name:   c.ReleaseName(r),
+		Chart:  chart,
+		Values: config,
+		Force:  c.OptionForce(r),
+		DryRun: dryRun,
+	}
+	releaseResponse, err := tiller.UpdateRelease(context.TODO(), updateReq)
+	if err != nil {
+		return nil, err
+	}
+	return releaseResponse.GetRelease(), nil
+}
+
+//recordedSpec, recordedChart keys of release config values, which charts are not rendered with,
+//recording spec and chart status of resource for rollbacks
+const (
+	recordedSpec  = "helm-app-operator/spec"
+	recordedChart = "helm-app-operator/chart"
+)
+
+//releaseConfig config of release values, recording spec and chart status of r
+func releaseConfig(r *v1alpha1.HelmApp, values []byte) (*cpb.Config, error) {
+	spec, err := json.Marshal(r.Spec)
+	if err != nil {
+		return nil, err
+	}
+	config := &cpb.Config{Raw: string(values), Values: map[string]*cpb.Value{recordedSpec: {Value: string(spec)}}}
+	if r.Status.Chart != nil {
+		chart, err := json.Marshal(r.Status.Chart)
 		if err != nil {
-			return r, err
+			return nil, err
 		}
-		updatedRelease = releaseResponse.GetRelease()
+		config.Values[recordedChart] = &cpb.Value{Value: string(chart)}
 	}
+	return config, nil
+}
 
-	r.Status = *r.Status.SetRelease(updatedRelease)
-	// TODO(alecmerdler): Call `r.Status.SetPhase()` with `NOTES.txt` of rendered Chart
-	r.Status = *r.Status.SetPhase(v1alpha1.PhaseApplied, v1alpha1.ReasonApplySuccessful, "")
-
-	return r, nil
+//RecordedResource spec and chart status (nil if none) of resource installing rel, ok false if not recorded
+func RecordedResource(rel *release.Release) (spec v1alpha1.HelmAppSpec, chart *v1alpha1.HelmAppChartStatus, ok bool, err error) {
+	values := rel.GetConfig().GetValues()
+	if values[recordedSpec] == nil {
+		return nil, nil, false, nil
+	}
+	if err := json.Unmarshal([]byte(values[recordedSpec].GetValue()), &spec); err != nil {
+		return nil, nil, false, fmt.Errorf("failed to parse spec recorded on release %s: %v", rel.GetName(), err)
+	}
+	if values[recordedChart] != nil {
+		chart = &v1alpha1.HelmAppChartStatus{}
+		if err := json.Unmarshal([]byte(values[recordedChart].GetValue()), chart); err != nil {
+			return nil, nil, false, fmt.Errorf("failed to parse chart recorded on release %s: %v", rel.GetName(), err)
+		}
+	}
+	return spec, chart, true, nil
 }
 
 // UninstallRelease accepts a custom resource, uninstalls the existing Helm release
@@ -146,7 +230,10 @@ func (c installer) tillerRendererForCR(r *v1alpha1.HelmApp) *tiller.ReleaseServe
 		KubeClient: c.tillerKubeClient,
 	}
 
-	internalClientSet, _ := internalclientset.NewForConfig(k8sclient.GetKubeConfig())
+	internalClientSet := c.clientset
+	if internalClientSet == nil {
+		internalClientSet, _ = internalclientset.NewForConfig(k8sclient.GetKubeConfig())
+	}
 
 	server := tiller.NewReleaseServer(env, internalClientSet, false)
 	server.Log = c.Logger(r)
@@ -166,19 +253,27 @@ func ReleaseOptionBool(r *v1alpha1.HelmApp, option string, defaultVal bool) bool
 
 //ReleaseOption release option
 func ReleaseOption(r *v1alpha1.HelmApp, option string, defaultVal string) string {
-	if val, ok := r.Annotations[OptionAnnotation(option)]; ok {
+	if val, ok := r.Annotations[OptionAnnotation(r, option)]; ok {
 		return val
 	}
 	return defaultVal
 }
 
 //OptionAnnotation option annotation key
-func OptionAnnotation(option string) string {
-	return fmt.Sprintf("%s/%s", OperatorName(), option)
+func OptionAnnotation(r *v1alpha1.HelmApp, option string) string {
+	return fmt.Sprintf("%s/%s", OperatorName(r), option)
+}
+
+//RegisterOperator operator name of kind, used as option annotation prefix and finalizer
+func RegisterOperator(apiVersion, kind, name string) {
+	operatorNames.Store(fmt.Sprintf("%s/%s", apiVersion, kind), name)
 }
 
 //OperatorName operator name
-func OperatorName() string {
+func OperatorName(r *v1alpha1.HelmApp) string {
+	if name, ok := operatorNames.Load(fmt.Sprintf("%s/%s", r.APIVersion, r.Kind)); ok {
+		return name.(string)
+	}
 	if name, err := k8sutil.GetOperatorName(); err == nil {
 		return name
 	}
@@ -187,7 +282,7 @@ func OperatorName() string {
 
 //ReleaseName release name
 func ReleaseName(r *v1alpha1.HelmApp) string {
-	return ReleaseOption(r, OptionRelease, fmt.Sprintf("%s-%s", OperatorName(), r.GetName()))
+	return ReleaseOption(r, OptionRelease, fmt.Sprintf("%s-%s", OperatorName(r), r.GetName()))
 }
 
 // TranslateChartPath loading chart path
@@ -227,6 +322,16 @@ type BehaviorChartPath interface {
 	TranslateChartPath(r *v1alpha1.HelmApp, chartPath string) (string, error)
 }
 
+//BehaviorReadChart customize reading chart from path
+type BehaviorReadChart interface {
+	ReadChart(r *v1alpha1.HelmApp, chartPath string) (*cpb.Chart, error)
+}
+
+//BehaviorValidateValues validate release values against chart
+type BehaviorValidateValues interface {
+	ValidateValues(r *v1alpha1.HelmApp, chart *cpb.Chart, values map[string]interface{}) error
+}
+
 func (c installer) ReleaseName(r *v1alpha1.HelmApp) string {
 	if behavior, ok := c.behavior.(BehaviorReleaseName); ok {
 		return behavior.ReleaseName(r)
@@ -261,6 +366,22 @@ func (c installer) LoadChart(r *v1alpha1.HelmApp, chartPath string) (*cpb.Chart,
 		return nil, nil, err
 	}
 
+	chartPath, err = c.TranslateChartPath(r, chartPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chart, err := c.ReadChart(r, chartPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if behavior, ok := c.behavior.(BehaviorValidateValues); ok {
+		if err := behavior.ValidateValues(r, chart, values); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// enable .Values.global.ownerReferences
 	global := map[string]interface{}{
 		"ownerReferences": []metav1.OwnerReference{*metav1.NewControllerRef(r, r.GroupVersionKind())},
@@ -279,18 +400,23 @@ func (c installer) LoadChart(r *v1alpha1.HelmApp, chartPath string) (*cpb.Chart,
 		return nil, nil, err
 	}
 
-	chartPath, err = c.TranslateChartPath(r, chartPath)
-	if err != nil {
+	// disable dependencies by condition/tags of release values, as helm client does before sending chart to tiller
+	if err := chartutil.ProcessRequirementsEnabled(chart, &cpb.Config{Raw: string(valueYaml)}); err != nil {
 		return nil, nil, err
 	}
-
-	chart, err := chartutil.Load(chartPath)
-	if err != nil {
+	if err := chartutil.ProcessRequirementsImportValues(chart); err != nil {
 		return nil, nil, err
 	}
 	return chart, valueYaml, nil
 }
 
+func (c installer) ReadChart(r *v1alpha1.HelmApp, chartPath string) (*cpb.Chart, error) {
+	if behavior, ok := c.behavior.(BehaviorReadChart); ok {
+		return behavior.ReadChart(r, chartPath)
+	}
+	return chartutil.Load(chartPath)
+}
+
 func (c installer) Logger(r *v1alpha1.HelmApp) func(string, ...interface{}) {
 	if behavior, ok := c.behavior.(BehaviorLogger); ok {
 		return behavior.Logger(r)
@@ -0,0 +1,81 @@
+package helmext
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/storage"
+	"k8s.io/helm/pkg/storage/driver"
+	"k8s.io/helm/pkg/tiller/environment"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+)
+
+// NewOfflineInstaller returns a Helm installer rendering releases without a cluster connection,
+// against given kubernetes version and api versions (in addition to v1). Only DryRunRelease is supported.
+func NewOfflineInstaller(chartPath string, kubeVersion string, apiVersions []string, behavior interface{}) (Installer, error) {
+	clientset, err := newOfflineClientset(kubeVersion, apiVersions)
+	if err != nil {
+		return nil, err
+	}
+	return installer{
+		storageBackend:   storage.Init(driver.NewMemory()),
+		tillerKubeClient: &environment.PrintingKubeClient{Out: ioutil.Discard},
+		chartPath:        chartPath,
+		behavior:         behavior,
+		clientset:        clientset,
+	}, nil
+}
+
+//offlineClientset clientset of tiller, only discovery of server version and groups is served
+type offlineClientset struct {
+	internalclientset.Interface
+	discovery offlineDiscovery
+}
+
+func (c offlineClientset) Discovery() discovery.DiscoveryInterface {
+	return c.discovery
+}
+
+type offlineDiscovery struct {
+	discovery.DiscoveryInterface
+	version *version.Info
+	groups  *metav1.APIGroupList
+}
+
+func (d offlineDiscovery) ServerVersion() (*version.Info, error) {
+	return d.version, nil
+}
+
+func (d offlineDiscovery) ServerGroups() (*metav1.APIGroupList, error) {
+	return d.groups, nil
+}
+
+func newOfflineClientset(kubeVersion string, apiVersions []string) (offlineClientset, error) {
+	info := *chartutil.DefaultKubeVersion
+	if kubeVersion != "" {
+		parts := strings.SplitN(strings.TrimPrefix(strings.SplitN(kubeVersion, "+", 2)[0], "v"), ".", 3)
+		if len(parts) < 2 {
+			return offlineClientset{}, fmt.Errorf("illegal kubernetes version %q, expect v<major>.<minor>[.<patch>]", kubeVersion)
+		}
+		info.Major, info.Minor, info.GitVersion = parts[0], parts[1], "v"+strings.TrimPrefix(kubeVersion, "v")
+	}
+	groups, indexes := &metav1.APIGroupList{}, map[string]int{}
+	for _, apiVersion := range append([]string{"v1"}, apiVersions...) {
+		group, groupVersion := "", metav1.GroupVersionForDiscovery{GroupVersion: apiVersion, Version: apiVersion}
+		if slash := strings.LastIndex(apiVersion, "/"); slash >= 0 {
+			group, groupVersion.Version = apiVersion[:slash], apiVersion[slash+1:]
+		}
+		i, ok := indexes[group]
+		if !ok {
+			i, indexes[group] = len(groups.Groups), len(groups.Groups)
+			groups.Groups = append(groups.Groups, metav1.APIGroup{Name: group})
+		}
+		groups.Groups[i].Versions = append(groups.Groups[i].Versions, groupVersion)
+	}
+	return offlineClientset{discovery: offlineDiscovery{version: &info, groups: groups}}, nil
+}
@@ -2,72 +2,257 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/xiaopal/helm-app-operator/cmd/option"
 
-	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/apis/app/v1alpha1"
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
 	"github.com/xiaopal/helm-app-operator/cmd/helmext"
 )
 
-func execHook(r *v1alpha1.HelmApp, hook string) error {
-	script := helmext.ReleaseOption(r, hook, "")
+//hookFallbacks hook whose script runs for a hook without its own, as install hooks ran for every upgrade
+//before upgrade and rollback hooks were distinguished
+var hookFallbacks = map[string]string{
+	"pre-upgrade":   "pre-install",
+	"post-upgrade":  "post-install",
+	"pre-rollback":  "pre-upgrade",
+	"post-rollback": "post-upgrade",
+}
+
+//hookScript script of hook, or of its fallbacks, and the hook it is option of
+func hookScript(r *v1alpha1.HelmApp, hook string) (string, string) {
+	for h := hook; h != ""; h = hookFallbacks[h] {
+		if script := helmext.ReleaseOption(r, h, ""); len(script) > 0 {
+			return script, h
+		}
+	}
+	return "", hook
+}
+
+//execHook runs script of hook with envs, EVENT_TYPE is hook even if script of a fallback runs.
+//Output is recorded under the hook the script is option of
+func execHook(op *option.Operator, r *v1alpha1.HelmApp, hook string, envs ...string) error {
+	script, source := hookScript(r, hook)
 	if len(script) == 0 {
 		return nil
 	}
 	if !option.OptionHooks {
-		logger.Println("skipped, hooks disabled")
+		resourceLogger(r, hook).Println("skipped, hooks disabled")
 		return nil
 	}
-	return execEvent(r, hook, script)
+	output, err := runHook(op, r, hook, script, envs...)
+	if err != nil {
+		return err
+	}
+	return setHookOutput(r, source, output)
 }
 
-func execEvent(r *v1alpha1.HelmApp, event string, script string, envs ...string) error {
-	cmd := exec.Command("/bin/bash", "-c", script)
-	cmd.Env = append( append(os.Environ(), envs...),
-		fmt.Sprintf("EVENT_TYPE=%s", event),
-		fmt.Sprintf("EVENT_API_VERSION=%s", option.OptionAPIVersion),
-		fmt.Sprintf("EVENT_KIND=%s", option.OptionCRDKind),
-		fmt.Sprintf("EVENT_NAMESPACE=%s", r.GetNamespace()),
-		fmt.Sprintf("EVENT_RESOURCE_TYPE=%s.%s", option.OptionCRDPlural, option.OptionCRDGroup),
-		fmt.Sprintf("EVENT_RESOURCE=%s", r.GetName()),
-		fmt.Sprintf("EVENT_RELEASE=%s", helmext.ReleaseName(r)),
-	)
-	logger := option.NewLogger(event)
-	if err := pipeCmd(cmd, logger); err != nil {
-		logger.Printf("failed to setup command: %v", err.Error())
-		return err
+//runHook runs hook script in operator, or as a job with --hook-mode=job, returning what it wrote to EVENT_OUTPUT
+func runHook(op *option.Operator, r *v1alpha1.HelmApp, hook string, script string, envs ...string) ([]byte, error) {
+	if option.OptionHookMode == option.HookModeJob {
+		return runHookJob(op, r, hook, script, envs...)
 	}
-	if err := cmd.Run(); err != nil {
-		logger.Printf("failed to run command: %v", err.Error())
-		return err
+	file, err := ioutil.TempFile("", "hook-output-")
+	if err != nil {
+		return nil, err
 	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err := execEvent(op, r, hook, script, append(envs, fmt.Sprintf("EVENT_OUTPUT=%s", file.Name()))...); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file.Name())
+}
+
+//setHookOutput records YAML output of hook in status of r, replacing its last output.
+//Outputs are merged into release values by ReleaseValues until the hook runs again
+func setHookOutput(r *v1alpha1.HelmApp, hook string, output []byte) error {
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(output, &values); err != nil {
+		return fmt.Errorf("illegal output of %s: %v", hook, err)
+	}
+	outputs := map[string]v1alpha1.HelmAppSpec{}
+	for k, v := range r.Status.Outputs {
+		if k != hook {
+			outputs[k] = v
+		}
+	}
+	if len(values) > 0 {
+		outputs[hook] = values
+	}
+	if len(outputs) == 0 {
+		outputs = nil
+	}
+	r.Status.Outputs = outputs
 	return nil
 }
 
-func pipeCmd(cmd *exec.Cmd, logger *log.Logger) error {
-	stdout, err := cmd.StdoutPipe()
+//hookOutputs outputs of hooks as value yamls, in order of hook names
+func hookOutputs(r *v1alpha1.HelmApp) ([][]byte, error) {
+	hooks := []string{}
+	for hook := range r.Status.Outputs {
+		hooks = append(hooks, hook)
+	}
+	sort.Strings(hooks)
+	valueYamls := [][]byte{}
+	for _, hook := range hooks {
+		valueYaml, err := json.Marshal(r.Status.Outputs[hook])
+		if err != nil {
+			return nil, err
+		}
+		valueYamls = append(valueYamls, valueYaml)
+	}
+	return valueYamls, nil
+}
+
+//hookContext context of hook and fetch commands, cancelled on operator shutdown
+var hookContext, cancelHooks = context.WithCancel(context.Background())
+
+//runningHooks hook and fetch commands in flight
+var runningHooks sync.WaitGroup
+
+//hookTimeoutError hook or fetch command killed on timeout
+type hookTimeoutError struct {
+	Event   string
+	Timeout time.Duration
+}
+
+func (e *hookTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.Event, e.Timeout)
+}
+
+//isHookTimeoutError whether err is a hookTimeoutError
+func isHookTimeoutError(err error) bool {
+	_, ok := err.(*hookTimeoutError)
+	return ok
+}
+
+//hookTimeout timeout of event: '<event>-timeout' option of resource or of its fallbacks, in seconds or as duration (eg. 90s, 5m),
+//or --hook-timeout
+func hookTimeout(r *v1alpha1.HelmApp, event string) (time.Duration, error) {
+	value, name := "", event
+	for h := event; h != "" && len(value) == 0; h = hookFallbacks[h] {
+		value, name = helmext.ReleaseOption(r, h+"-timeout", ""), h
+	}
+	if len(value) == 0 {
+		return time.Duration(option.OptionHookTimeout) * time.Second, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("illegal %s-timeout option %q", name, value)
+	}
+	return timeout, nil
+}
+
+func execEvent(op *option.Operator, r *v1alpha1.HelmApp, event string, script string, envs ...string) error {
+	logger := resourceLogger(r, event)
+	timeout, err := hookTimeout(r, event)
 	if err != nil {
+		logger.Errorf("failed to setup command: %v", err.Error())
 		return err
 	}
-	stderr, err := cmd.StderrPipe()
+	ctx, cancel := context.WithCancel(hookContext)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(hookContext, timeout)
+	}
+	defer cancel()
+	cmd := exec.Command("/bin/bash", "-c", script)
+	//own process group, so processes started by script are killed along
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(), eventEnv(op, r, event, envs...)...)
+	closeWriters, err := pipeCmd(cmd, logger)
 	if err != nil {
+		logger.Errorf("failed to setup command: %v", err.Error())
 		return err
 	}
+	runningHooks.Add(1)
+	defer runningHooks.Done()
+	err = cmd.Start()
+	closeWriters()
+	if err != nil {
+		logger.Errorf("failed to run command: %v", err.Error())
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			logger.Errorf("failed to run command: %v", err.Error())
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		if hookContext.Err() != nil {
+			err = fmt.Errorf("%s cancelled on shutdown", event)
+		} else {
+			err = &hookTimeoutError{event, timeout}
+		}
+		logger.Errorf("killed command: %v", err.Error())
+		return err
+	}
+}
+
+//eventEnv environment of event command, EVENT_* variables after envs
+func eventEnv(op *option.Operator, r *v1alpha1.HelmApp, event string, envs ...string) []string {
+	return append(append([]string{}, envs...),
+		fmt.Sprintf("EVENT_TYPE=%s", event),
+		fmt.Sprintf("EVENT_API_VERSION=%s", op.APIVersion),
+		fmt.Sprintf("EVENT_KIND=%s", op.CRDKind),
+		fmt.Sprintf("EVENT_NAMESPACE=%s", r.GetNamespace()),
+		fmt.Sprintf("EVENT_RESOURCE_TYPE=%s.%s", op.CRDPlural, op.CRDGroup),
+		fmt.Sprintf("EVENT_RESOURCE=%s", r.GetName()),
+		fmt.Sprintf("EVENT_RELEASE=%s", helmext.ReleaseName(r)),
+	)
+}
+
+//pipeCmd forwards stdout and stderr of cmd to logger until closed by all processes of cmd, returns func to
+//close write ends of operator once cmd started, so that output is not lost to Wait closing pipes early
+func pipeCmd(cmd *exec.Cmd, logger *logrus.Entry) (func(), error) {
+	writers := []*os.File{}
+	closeWriters := func() {
+		for _, w := range writers {
+			w.Close()
+		}
+	}
 	forward := func(r io.ReadCloser) {
+		defer r.Close()
 		o := bufio.NewScanner(r)
 		for o.Scan() {
 			logger.Println(o.Text())
 		}
 		if err := o.Err(); err != nil {
-			logger.Printf("ERROR: %v", err.Error())
+			logger.Errorf("ERROR: %v", err.Error())
 		}
 	}
-	go forward(stdout)
-	go forward(stderr)
-	return nil
+	for _, out := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeWriters()
+			return nil, err
+		}
+		*out, writers = w, append(writers, w)
+		go forward(r)
+	}
+	return closeWriters, nil
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/kubernetes/pkg/apis/batch"
+	api "k8s.io/kubernetes/pkg/apis/core"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+//hookJobPoll interval of polling hook jobs
+const hookJobPoll = 2 * time.Second
+
+//hookOutputPath EVENT_OUTPUT of jobs, termination message of hook container, at most 4096 bytes
+const hookOutputPath = "/dev/termination-log"
+
+//hookEventSize bytes of hook output collected into one event
+const hookEventSize = 1024
+
+var hookClientset struct {
+	once      sync.Once
+	clientset internalclientset.Interface
+	err       error
+}
+
+func hookClients() (internalclientset.Interface, error) {
+	hookClientset.once.Do(func() {
+		hookClientset.clientset, hookClientset.err = internalclientset.NewForConfig(k8sclient.GetKubeConfig())
+	})
+	return hookClientset.clientset, hookClientset.err
+}
+
+//runHookJob runs hook script as a job in namespace of resource, with image and service account of
+//hook-image and hook-service-account options. Output of job is logged and recorded as events of resource,
+//and job is deleted once completed, failed, timed out or cancelled. EVENT_OUTPUT of job is its termination message,
+//returned once completed
+func runHookJob(op *option.Operator, r *v1alpha1.HelmApp, event string, script string, envs ...string) ([]byte, error) {
+	logger := resourceLogger(r, event)
+	timeout, err := hookTimeout(r, event)
+	if err != nil {
+		logger.Errorf("failed to setup job: %v", err.Error())
+		return nil, err
+	}
+	clientset, err := hookClients()
+	if err != nil {
+		logger.Errorf("failed to setup job: %v", err.Error())
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(hookContext)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(hookContext, timeout)
+	}
+	defer cancel()
+	runningHooks.Add(1)
+	defer runningHooks.Done()
+	jobs := clientset.Batch().Jobs(r.GetNamespace())
+	job, err := jobs.Create(hookJob(op, r, event, script, timeout, eventEnv(op, r, event, append(envs, "EVENT_OUTPUT="+hookOutputPath)...)))
+	if err != nil {
+		logger.Errorf("failed to create job: %v", err.Error())
+		return nil, err
+	}
+	logger = logger.WithField("job", job.GetName())
+	logger.Infof("created job")
+	defer func() {
+		background := metav1.DeletePropagationBackground
+		if err := jobs.Delete(job.GetName(), &metav1.DeleteOptions{PropagationPolicy: &background}); err != nil && !apierrors.IsNotFound(err) {
+			logger.Warnf("failed to delete job: %v", err.Error())
+		}
+	}()
+	var logs chan struct{}
+	pod := ""
+	waitLogs := func() {
+		if logs != nil {
+			select {
+			case <-logs:
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+	ticker := time.NewTicker(hookJobPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if hookContext.Err() != nil {
+				err = fmt.Errorf("%s cancelled on shutdown", event)
+			} else {
+				err = &hookTimeoutError{event, timeout}
+			}
+			logger.Errorf("killed job: %v", err.Error())
+			recordHookEvent(clientset, r, api.EventTypeWarning, "HookFailed", err.Error())
+			return nil, err
+		case <-ticker.C:
+		}
+		if job, err = jobs.Get(job.GetName(), metav1.GetOptions{}); err != nil {
+			logger.Errorf("failed to get job: %v", err.Error())
+			return nil, err
+		}
+		if logs == nil {
+			if pod = hookJobPod(clientset, job); pod != "" {
+				logs = make(chan struct{})
+				go func() {
+					defer close(logs)
+					streamHookLogs(clientset, r, event, pod, logger)
+				}()
+			}
+		}
+		for _, condition := range job.Status.Conditions {
+			if condition.Status != api.ConditionTrue {
+				continue
+			}
+			switch condition.Type {
+			case batch.JobComplete:
+				waitLogs()
+				recordHookEvent(clientset, r, api.EventTypeNormal, "HookSucceeded", fmt.Sprintf("%s job %s succeeded", event, job.GetName()))
+				return hookJobOutput(clientset, r.GetNamespace(), pod)
+			case batch.JobFailed:
+				waitLogs()
+				err = fmt.Errorf("%s job %s failed: %s", event, job.GetName(), condition.Message)
+				if condition.Reason == "DeadlineExceeded" {
+					err = &hookTimeoutError{event, timeout}
+				}
+				logger.Errorf("failed to run job: %v", err.Error())
+				recordHookEvent(clientset, r, api.EventTypeWarning, "HookFailed", err.Error())
+				return nil, err
+			}
+		}
+	}
+}
+
+//hookJob job of hook script, owned by resource
+func hookJob(op *option.Operator, r *v1alpha1.HelmApp, event string, script string, timeout time.Duration, env []string) *batch.Job {
+	prefix := fmt.Sprintf("%s-%s", helmext.ReleaseName(r), event)
+	if max := validation.DNS1123LabelMaxLength - 6; len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	labels := map[string]string{
+		"app":     op.Name,
+		"release": helmext.ReleaseName(r),
+		"hook":    event,
+	}
+	vars := []api.EnvVar{}
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		vars = append(vars, api.EnvVar{Name: kv[0], Value: kv[1]})
+	}
+	backoffLimit, controller := int32(0), true
+	job := &batch.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: strings.TrimRight(prefix, "-.") + "-",
+			Namespace:    r.GetNamespace(),
+			Labels:       labels,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: op.APIVersion,
+				Kind:       op.CRDKind,
+				Name:       r.GetName(),
+				UID:        r.GetUID(),
+				Controller: &controller,
+			}},
+		},
+		Spec: batch.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: api.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: api.PodSpec{
+					RestartPolicy:      api.RestartPolicyNever,
+					ServiceAccountName: helmext.ReleaseOption(r, "hook-service-account", option.OptionHookServiceAccount),
+					Containers: []api.Container{{
+						Name:                     "hook",
+						Image:                    helmext.ReleaseOption(r, "hook-image", option.OptionHookImage),
+						Command:                  []string{"/bin/bash", "-c", script},
+						Env:                      vars,
+						TerminationMessagePath:   hookOutputPath,
+						TerminationMessagePolicy: api.TerminationMessageReadFile,
+					}},
+				},
+			},
+		},
+	}
+	if timeout > 0 {
+		seconds := int64(timeout / time.Second)
+		job.Spec.ActiveDeadlineSeconds = &seconds
+	}
+	return job
+}
+
+//hookJobOutput termination message of hook container of pod, which is EVENT_OUTPUT of job
+func hookJobOutput(clientset internalclientset.Interface, namespace string, pod string) ([]byte, error) {
+	if pod == "" {
+		return nil, nil
+	}
+	p, err := clientset.Core().Pods(namespace).Get(pod, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get output: %v", err)
+	}
+	for _, status := range p.Status.ContainerStatuses {
+		if status.Name == "hook" && status.State.Terminated != nil {
+			return []byte(status.State.Terminated.Message), nil
+		}
+	}
+	return nil, nil
+}
+
+//hookJobPod name of started pod of job, empty if not started yet
+func hookJobPod(clientset internalclientset.Interface, job *batch.Job) string {
+	pods, err := clientset.Core().Pods(job.GetNamespace()).List(metav1.ListOptions{LabelSelector: "job-name=" + job.GetName()})
+	if err != nil {
+		return ""
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != api.PodPending && pod.Status.Phase != "" {
+			return pod.GetName()
+		}
+	}
+	return ""
+}
+
+//streamHookLogs follows output of hook pod into logger, and events of resource in chunks of hookEventSize
+func streamHookLogs(clientset internalclientset.Interface, r *v1alpha1.HelmApp, event string, pod string, logger *logrus.Entry) {
+	stream, err := clientset.Core().Pods(r.GetNamespace()).GetLogs(pod, &api.PodLogOptions{Container: "hook", Follow: true}).Stream()
+	if err != nil {
+		logger.Warnf("failed to stream logs: %v", err.Error())
+		return
+	}
+	defer stream.Close()
+	chunk := []string{}
+	size := 0
+	flush := func() {
+		if len(chunk) > 0 {
+			recordHookEvent(clientset, r, api.EventTypeNormal, "HookOutput", fmt.Sprintf("%s: %s", event, strings.Join(chunk, "\n")))
+			chunk, size = []string{}, 0
+		}
+	}
+	o := bufio.NewScanner(stream)
+	for o.Scan() {
+		line := o.Text()
+		logger.Println(line)
+		if size+len(line) > hookEventSize {
+			flush()
+		}
+		chunk, size = append(chunk, line), size+len(line)+1
+	}
+	flush()
+	if err := o.Err(); err != nil {
+		logger.Warnf("failed to stream logs: %v", err.Error())
+	}
+}
+
+//recordHookEvent records event of resource, failures are only logged
+func recordHookEvent(clientset internalclientset.Interface, r *v1alpha1.HelmApp, eventType string, reason string, message string) {
+	now := metav1.Now()
+	_, err := clientset.Core().Events(r.GetNamespace()).Create(&api.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: r.GetName() + ".", Namespace: r.GetNamespace()},
+		InvolvedObject: api.ObjectReference{
+			APIVersion:      r.APIVersion,
+			Kind:            r.Kind,
+			Name:            r.GetName(),
+			Namespace:       r.GetNamespace(),
+			UID:             r.GetUID(),
+			ResourceVersion: r.GetResourceVersion(),
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source:         api.EventSource{Component: helmext.OperatorName(r)},
+	})
+	if err != nil {
+		logger.Warnf("failed to record event of %s: %v", resourceKey(r), err)
+	}
+}
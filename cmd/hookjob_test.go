@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestHookJobLabelsOperatorOfResource(t *testing.T) {
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+	r := testResource(nil)
+	job := hookJob(behavior.operator, r, "pre-install", "true", 0, []string{"EVENT_TYPE=pre-install"})
+	if app := job.Labels["app"]; app != "test-operator" {
+		t.Errorf("job labeled with app %q", app)
+	}
+	if app := job.Spec.Template.Labels["app"]; app != "test-operator" {
+		t.Errorf("pod labeled with app %q", app)
+	}
+}
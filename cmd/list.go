@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/ghodss/yaml"
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
+	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+const (
+	//orphanReleaseMissing resource whose release is missing from storage
+	orphanReleaseMissing = "ReleaseMissing"
+	//orphanResourceMissing release of operator without resource
+	orphanResourceMissing = "ResourceMissing"
+)
+
+//listEntry resource joined with its release
+type listEntry struct {
+	Namespace       string `json:"namespace"`
+	Kind            string `json:"kind,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Release         string `json:"release"`
+	Revision        int32  `json:"revision,omitempty"`
+	ChartVersion    string `json:"chartVersion,omitempty"`
+	Phase           string `json:"phase,omitempty"`
+	LastTransition  string `json:"lastTransition,omitempty"`
+	ChecksumCurrent bool   `json:"checksumCurrent"`
+	Orphan          string `json:"orphan,omitempty"`
+}
+
+//listResources writes resources of configured kinds in --namespace joined with their releases, and orphan releases
+func listResources(out io.Writer) error {
+	storageBackend, err := option.GetStorageBackend()
+	if err != nil {
+		return err
+	}
+	clientset, err := internalclientset.NewForConfig(k8sclient.GetKubeConfig())
+	if err != nil {
+		return err
+	}
+	stored, err := storageBackend.ListReleases()
+	if err != nil {
+		return err
+	}
+	//latest revision of each release
+	releases := map[string]*release.Release{}
+	for _, rel := range stored {
+		if latest, ok := releases[rel.GetName()]; !ok || latest.GetVersion() < rel.GetVersion() {
+			releases[rel.GetName()] = rel
+		}
+	}
+	entries, joined := []*listEntry{}, map[string]bool{}
+	for _, op := range option.Operators {
+		list := &v1alpha1.HelmAppList{TypeMeta: metav1.TypeMeta{APIVersion: op.APIVersion, Kind: op.CRDKind}}
+		if err := sdk.List(option.OptionNamespace, list); err != nil {
+			return fmt.Errorf("failed to list %s: %v", op.CRDKind, err)
+		}
+		h := &handler{op, helmext.NewInstallerWithBehavior(storageBackend, nil, op.Chart, installerBehavior{op, clusterObjects{clientset}, nil, nil, nil}), nil, nil}
+		for i := range list.Items {
+			r := &list.Items[i]
+			r.APIVersion, r.Kind = op.APIVersion, op.CRDKind
+			entry := &listEntry{
+				Namespace: r.GetNamespace(),
+				Kind:      op.CRDKind,
+				Name:      r.GetName(),
+				Release:   helmext.ReleaseName(r),
+				Phase:     string(r.Status.Phase),
+			}
+			if !r.Status.LastTransitionTime.IsZero() {
+				entry.LastTransition = r.Status.LastTransitionTime.Format(time.RFC3339)
+			}
+			if updated, err := h.updateChecksum(r.DeepCopy()); err != nil {
+				logger.Warnf("failed to compute checksum of %s: %v", resourceKey(r), err)
+			} else {
+				entry.ChecksumCurrent = !updated
+			}
+			if rel, ok := releases[entry.Release]; ok {
+				entry.Revision, entry.ChartVersion = rel.GetVersion(), rel.GetChart().GetMetadata().GetVersion()
+				joined[entry.Release] = true
+			} else {
+				entry.Orphan = orphanReleaseMissing
+			}
+			entries = append(entries, entry)
+		}
+	}
+	for name, rel := range releases {
+		if joined[name] || option.OptionNamespace != "" && rel.GetNamespace() != option.OptionNamespace {
+			continue
+		}
+		for _, op := range option.Operators {
+			if strings.HasPrefix(name, op.Name+"-") {
+				entries = append(entries, &listEntry{
+					Namespace:    rel.GetNamespace(),
+					Release:      name,
+					Revision:     rel.GetVersion(),
+					ChartVersion: rel.GetChart().GetMetadata().GetVersion(),
+					Orphan:       orphanResourceMissing,
+				})
+				break
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Namespace != entries[j].Namespace {
+			return entries[i].Namespace < entries[j].Namespace
+		}
+		return entries[i].Release < entries[j].Release
+	})
+	return printEntries(entries, out)
+}
+
+func printEntries(entries []*listEntry, out io.Writer) error {
+	switch option.OptionOutput {
+	case "json":
+		bytes, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(bytes))
+		return nil
+	case "yaml":
+		bytes, err := yaml.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out, string(bytes))
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "NAMESPACE\tNAME\tRELEASE\tREVISION\tCHART\tPHASE\tLAST TRANSITION\tCURRENT\tORPHAN\n")
+	for _, e := range entries {
+		name, revision := e.Name, strconv.Itoa(int(e.Revision))
+		if name == "" {
+			name = "<none>"
+		}
+		if e.Revision == 0 {
+			revision = "<none>"
+		}
+		current := strconv.FormatBool(e.ChecksumCurrent)
+		if e.Orphan == orphanResourceMissing {
+			current = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Namespace, name, e.Release, revision,
+			e.ChartVersion, e.Phase, e.LastTransition, current, e.Orphan)
+	}
+	return nil
+}
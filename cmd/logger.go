@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+var (
+	//reconcileIDs resource key -> current reconcile id
+	reconcileIDs sync.Map
+)
+
+func resourceKey(r *v1alpha1.HelmApp) string {
+	return fmt.Sprintf("%s/%s", r.GetNamespace(), r.GetName())
+}
+
+//beginReconcile assigns a reconcile id to resource, returns func to release it
+func beginReconcile(r *v1alpha1.HelmApp) func() {
+	id := make([]byte, 8)
+	rand.Read(id)
+	key := resourceKey(r)
+	reconcileIDs.Store(key, fmt.Sprintf("%x", id))
+	return func() {
+		reconcileIDs.Delete(key)
+	}
+}
+
+//resourceLogger logger with resource context
+func resourceLogger(r *v1alpha1.HelmApp, prefix string) *logrus.Entry {
+	fields := logrus.Fields{
+		"namespace": r.GetNamespace(),
+		"name":      r.GetName(),
+		"release":   helmext.ReleaseName(r),
+	}
+	if r.Status.Release != nil {
+		fields["revision"] = r.Status.Release.GetVersion()
+	}
+	if id, ok := reconcileIDs.Load(resourceKey(r)); ok {
+		fields["reconcile"] = id
+	}
+	return option.NewLogger(prefix).WithFields(fields)
+}
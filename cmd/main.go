@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
-	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/xiaopal/helm-app-operator/cmd/option"
 
@@ -11,19 +13,108 @@ import (
 
 	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
 	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
 	"github.com/xiaopal/helm-app-operator/cmd/helmext"
 )
 
 var (
-	logger *log.Logger
+	logger *logrus.Entry
 )
 
+//chartCacheEvict interval of evicting chart cache by ttl and max size
+const chartCacheEvict = time.Minute
+
 func main() {
+	option.Parse()
 	logger = option.NewLogger("main")
 
+	for _, op := range option.Operators {
+		if err := v1alpha1.AddKnownKind(op.APIVersion, op.CRDKind); err != nil {
+			logger.Fatalf("Cannot register kind %s: %v", op.CRD, err)
+		}
+		helmext.RegisterOperator(op.APIVersion, op.CRDKind, op.Name)
+	}
+
+	if len(option.OptionTemplateFile) > 0 {
+		if err := renderTemplate(option.OptionTemplateFile, os.Stdout); err != nil {
+			logger.Fatalf("Cannot render %s: %v", option.OptionTemplateFile, err)
+		}
+		os.Exit(0)
+	}
+
+	if len(option.OptionDiffFile) > 0 {
+		differs, err := diffResources(option.OptionDiffFile, os.Stdout)
+		if err != nil {
+			logger.Errorf("Cannot diff %s: %v", option.OptionDiffFile, err)
+			os.Exit(2)
+		}
+		if differs {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(option.OptionStatusResource) > 0 {
+		if err := showStatus(option.OptionStatusResource, os.Stdout); err != nil {
+			logger.Fatalf("Cannot show status of %s: %v", option.OptionStatusResource, err)
+		}
+		os.Exit(0)
+	}
+
+	if len(option.OptionHistoryResource) > 0 {
+		if err := showHistory(option.OptionHistoryResource, os.Stdout); err != nil {
+			logger.Fatalf("Cannot show history of %s: %v", option.OptionHistoryResource, err)
+		}
+		os.Exit(0)
+	}
+
+	if len(option.OptionRollbackResource) > 0 {
+		if err := rollbackResource(option.OptionRollbackResource, option.OptionRollbackRevision); err != nil {
+			logger.Fatalf("Cannot roll back %s: %v", option.OptionRollbackResource, err)
+		}
+		os.Exit(0)
+	}
+
+	if option.OptionRBAC {
+		if err := writeRBAC(os.Stdout); err != nil {
+			logger.Fatalf("Cannot generate RBAC: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if option.OptionManifests {
+		if err := writeManifests(os.Stdout); err != nil {
+			logger.Fatalf("Cannot generate manifests: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if option.OptionList {
+		if err := listResources(os.Stdout); err != nil {
+			logger.Fatalf("Cannot list resources: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	if option.OptionInit {
-		if err := initCRDResource(); err != nil {
-			logger.Fatalf("Cannot initialize CRD resource: %v", err)
+		for _, op := range option.Operators {
+			if err := initCRDResource(op); err != nil {
+				logger.Fatalf("Cannot initialize CRD resource %s: %v", op.CRD, err)
+			}
+		}
+		os.Exit(0)
+	}
+
+	if option.OptionWebhook {
+		clientset, err := internalclientset.NewForConfig(k8sclient.GetKubeConfig())
+		if err != nil {
+			logger.Fatalf("Cannot initialize Kubernetes connection: %v", err)
+		}
+		if err := printWebhookConfiguration(clientset); err != nil {
+			logger.Fatalf("Cannot print webhook configuration: %v", err)
 		}
 		os.Exit(0)
 	}
@@ -44,7 +135,7 @@ func main() {
 
 	storageBackend, err := option.GetStorageBackend()
 	if err != nil {
-		logger.Fatalf(err.Error())
+		logger.Fatal(err)
 	}
 
 	clientset, err := internalclientset.NewForConfig(k8sclient.GetKubeConfig())
@@ -53,12 +144,61 @@ func main() {
 	}
 	kubeClient, err := option.KubeClient()
 	if err != nil {
-		logger.Fatalf(err.Error())
-	}
-	logger.Printf("watching ApiVersion: %s, Kind: %s, Namespace: %s", option.OptionAPIVersion, option.OptionCRDKind, option.OptionNamespace)
-	sdk.Watch(option.OptionAPIVersion, option.OptionCRDKind, option.OptionNamespace, option.OptionResyncPeriod)
-	sdk.Handle(&handler{
-		helmext.NewInstallerWithBehavior(storageBackend, kubeClient, option.OptionChart, installerBehavior{clientset}),
-	})
-	sdk.Run(context.TODO())
+		logger.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		logger.Printf("shutting down on %v", <-signals)
+		cancelHooks()
+		cancel()
+	}()
+	chartCache, chartPoller, chartWatcher := option.NewChartCache(), newChartPoller(), newChartWatcher()
+	handlers := kindHandlers{}
+	for _, op := range option.Operators {
+		gvk := schema.FromAPIVersionAndKind(op.APIVersion, op.CRDKind)
+		behavior := installerBehavior{op, clusterObjects{clientset}, chartCache, chartPoller, chartWatcher}
+		handlers[gvk] = &handler{op,
+			helmext.NewInstallerWithBehavior(storageBackend, kubeClient, op.Chart, behavior),
+			storageBackend,
+			behavior,
+		}
+	}
+	if option.OptionWatchChartObjects {
+		chartWatcher.watch = clusterObjects{clientset}.watchObject
+	}
+	var h sdk.Handler = handlers
+	if len(option.OptionWebhookAddr) > 0 {
+		//dry-run installers loading charts through the shared cache
+		webhook := &webhookServer{map[schema.GroupVersionKind]helmext.Installer{}, clientset}
+		for _, op := range option.Operators {
+			gvk := schema.FromAPIVersionAndKind(op.APIVersion, op.CRDKind)
+			webhook.installers[gvk] = helmext.NewInstallerWithBehavior(storageBackend, kubeClient, op.Chart,
+				webhookBehavior{installerBehavior{op, clusterObjects{clientset}, chartCache, newChartPoller(), newChartWatcher()}})
+		}
+		go webhook.Run(ctx, option.OptionWebhookAddr)
+	}
+	if len(option.OptionHealthAddr) > 0 {
+		health, err := newHealthChecker(storageBackend, chartCache)
+		if err != nil {
+			logger.Fatalf("Cannot initialize health probes: %v", err)
+		}
+		h = health.Track(h)
+		go health.Run(ctx, option.OptionHealthAddr)
+	}
+	if chartCache.TTL > 0 || chartCache.MaxSize > 0 {
+		go chartCache.Run(ctx, chartCacheEvict)
+	}
+	if option.OptionChartPoll > 0 {
+		go chartPoller.Run(ctx, time.Duration(option.OptionChartPoll)*time.Second)
+	}
+	for _, op := range option.Operators {
+		logger.Printf("watching ApiVersion: %s, Kind: %s, Namespace: %s, Operator: %s, Chart: %s", op.APIVersion, op.CRDKind, option.OptionNamespace, op.Name, op.Chart)
+		sdk.Watch(op.APIVersion, op.CRDKind, option.OptionNamespace, option.OptionResyncPeriod)
+	}
+	sdk.Handle(h)
+	sdk.Run(ctx)
+	//hooks in flight are killed, as they are not in the process group signaled
+	runningHooks.Wait()
 }
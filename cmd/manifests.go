@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/ghodss/yaml"
+	"github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1beta1 "k8s.io/api/rbac/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+//allVerbs verbs of objects managed by operator
+var allVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+
+//manifestFile objects of a bundle file
+type manifestFile struct {
+	name    string
+	objects []interface{}
+}
+
+//writeManifests writes the deployment bundle of operators: CRDs, ServiceAccount, RBAC and Deployment,
+//as YAML to out, or as a kustomize base to --kustomize dir
+func writeManifests(out io.Writer) error {
+	files, err := bundleManifests()
+	if err != nil {
+		return err
+	}
+	if len(option.OptionManifestsKustomize) == 0 {
+		for _, file := range files {
+			for _, object := range file.objects {
+				data, err := manifestYAML(object)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "---\n%s\n", data)
+			}
+		}
+		return nil
+	}
+	dir := option.OptionManifestsKustomize
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	kustomization := map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  []string{},
+	}
+	if tillerNamespace := option.OptionTillerNamespace; len(tillerNamespace) == 0 || tillerNamespace == option.OptionNamespace {
+		//namespace transformer would move the Role of tiller storage in another namespace as well
+		kustomization["namespace"] = option.OptionNamespace
+	}
+	for _, file := range files {
+		content := []byte{}
+		for _, object := range file.objects {
+			data, err := manifestYAML(object)
+			if err != nil {
+				return err
+			}
+			content = append(append(append(content, "---\n"...), data...), '\n')
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file.name), content, 0644); err != nil {
+			return err
+		}
+		kustomization["resources"] = append(kustomization["resources"].([]string), file.name)
+	}
+	data, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), data, 0644); err != nil {
+		return err
+	}
+	logger.Printf("kustomize base written to %s", dir)
+	return nil
+}
+
+func bundleManifests() ([]manifestFile, error) {
+	objects, err := loadFileObjects(option.OptionValuesObjects, option.OptionNamespace)
+	if err != nil {
+		return nil, err
+	}
+	crds := manifestFile{name: "crd.yaml"}
+	for _, op := range option.Operators {
+		body, err := crdBody(crdManifest(op, objects))
+		if err != nil {
+			return nil, err
+		}
+		crds.objects = append(crds.objects, json.RawMessage(body))
+	}
+	name, namespace := option.OptionOperatorName, option.OptionNamespace
+	meta := metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": name}}
+	rbac := manifestFile{name: "rbac.yaml", objects: []interface{}{&corev1.ServiceAccount{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: meta,
+	}}}
+	rules, clusterRules, chartRole := operatorRules(), []rbacv1beta1.PolicyRule{}, option.OptionManifestsChartRole
+	if len(chartRole) == 0 {
+		if rules, clusterRules, err = chartRules(); err != nil {
+			return nil, err
+		}
+	}
+	rbac.objects = append(rbac.objects, rbacManifests(name, namespace, rules, clusterRules, chartRole)...)
+	return []manifestFile{crds, rbac, {name: "deployment.yaml", objects: []interface{}{deploymentManifest(meta)}}}, nil
+}
+
+//operatorRules rules of operator itself: watched resources, ConfigMaps and Secrets of values, charts, tiller storage and webhook certificate,
+//and jobs, pods logs and events of hooks with --hook-mode=job
+func operatorRules() []rbacv1beta1.PolicyRule {
+	rules := []rbacv1beta1.PolicyRule{}
+	for _, op := range option.Operators {
+		rules = append(rules, rbacv1beta1.PolicyRule{
+			APIGroups: []string{op.CRDGroup},
+			Resources: []string{op.CRDPlural, op.CRDPlural + "/status", op.CRDPlural + "/finalizers"},
+			Verbs:     allVerbs,
+		})
+	}
+	rules = append(rules, rbacv1beta1.PolicyRule{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps", "secrets"},
+		Verbs:     allVerbs,
+	})
+	if option.OptionHookMode == option.HookModeJob {
+		rules = append(rules,
+			rbacv1beta1.PolicyRule{APIGroups: []string{"batch"}, Resources: []string{"jobs"}, Verbs: []string{"get", "create", "delete"}},
+			rbacv1beta1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods", "pods/log"}, Verbs: []string{"get", "list"}},
+			rbacv1beta1.PolicyRule{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create"}},
+		)
+	}
+	return rules
+}
+
+//rbacManifests Role and RoleBinding of rules in namespace, or ClusterRole and ClusterRoleBinding with --all-namespaces,
+//a ClusterRole of clusterRules for cluster-scoped objects, and a binding of ClusterRole chartRole for chart objects if not empty.
+//Tiller storage outside of namespace gets its own Role
+func rbacManifests(name string, namespace string, rules []rbacv1beta1.PolicyRule, clusterRules []rbacv1beta1.PolicyRule, chartRole string) []interface{} {
+	subjects := []rbacv1beta1.Subject{{Kind: "ServiceAccount", Name: name, Namespace: namespace}}
+	meta := func(name string, namespace string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": option.OptionOperatorName}}
+	}
+	role := func(kind string, name string, namespace string, rules []rbacv1beta1.PolicyRule) interface{} {
+		if kind == "ClusterRole" {
+			return &rbacv1beta1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: kind},
+				ObjectMeta: meta(name, ""),
+				Rules:      rules,
+			}
+		}
+		return &rbacv1beta1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: kind},
+			ObjectMeta: meta(name, namespace),
+			Rules:      rules,
+		}
+	}
+	binding := func(name string, namespace string, roleKind string, roleName string) interface{} {
+		roleRef := rbacv1beta1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: roleKind, Name: roleName}
+		if len(namespace) == 0 {
+			return &rbacv1beta1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: "ClusterRoleBinding"},
+				ObjectMeta: meta(name, ""),
+				Subjects:   subjects,
+				RoleRef:    roleRef,
+			}
+		}
+		return &rbacv1beta1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: "RoleBinding"},
+			ObjectMeta: meta(name, namespace),
+			Subjects:   subjects,
+			RoleRef:    roleRef,
+		}
+	}
+	if option.OptionAllNamespace {
+		objects := []interface{}{
+			role("ClusterRole", name, "", append(append([]rbacv1beta1.PolicyRule{}, rules...), clusterRules...)),
+			binding(name, "", "ClusterRole", name),
+		}
+		if len(chartRole) > 0 {
+			objects = append(objects, binding(name+"-chart", "", "ClusterRole", chartRole))
+		}
+		return objects
+	}
+	objects := []interface{}{
+		role("Role", name, namespace, rules),
+		binding(name, namespace, "Role", name),
+	}
+	if len(chartRole) > 0 {
+		objects = append(objects, binding(name+"-chart", namespace, "ClusterRole", chartRole))
+	}
+	if len(clusterRules) > 0 {
+		objects = append(objects,
+			role("ClusterRole", name+"-cluster", "", clusterRules),
+			binding(name+"-cluster", "", "ClusterRole", name+"-cluster"))
+	}
+	if tillerNamespace := option.OptionTillerNamespace; len(tillerNamespace) > 0 && tillerNamespace != namespace {
+		objects = append(objects,
+			role("Role", name+"-tiller", tillerNamespace, []rbacv1beta1.PolicyRule{{
+				APIGroups: []string{""},
+				Resources: []string{"configmaps", "secrets"},
+				Verbs:     allVerbs,
+			}}),
+			binding(name+"-tiller", tillerNamespace, "Role", name+"-tiller"))
+	}
+	return objects
+}
+
+//deploymentManifest Deployment of operator, with --crd/--chart pairs, chart and storage flags as args,
+//and operator name and namespaces as env
+func deploymentManifest(meta metav1.ObjectMeta) *appsv1.Deployment {
+	args := []string{}
+	for _, op := range option.Operators {
+		args = append(args, "--crd="+op.CRD)
+		if len(op.Chart) > 0 {
+			args = append(args, "--chart="+op.Chart)
+		}
+	}
+	repos := []string{}
+	for name, repo := range option.OptionRepositories {
+		repos = append(repos, fmt.Sprintf("--repo=%s=%s", name, repo.URL))
+	}
+	sort.Strings(repos)
+	args = append(args, repos...)
+	if len(option.OptionChartPullSecret) > 0 {
+		args = append(args, "--chart-pull-secret="+option.OptionChartPullSecret)
+	}
+	for _, registry := range option.OptionPlainHTTPRegistries {
+		args = append(args, "--plain-http-registry="+registry)
+	}
+	args = append(args, "--tiller-storage="+option.OptionStore, "--tiller-history-max="+strconv.Itoa(option.OptionMaxHistory))
+	if option.OptionAllNamespace {
+		args = append(args, "--all-namespaces")
+	}
+	if !option.OptionWatchChartObjects {
+		args = append(args, "--watch-chart-objects=false")
+	}
+	if option.OptionHookMode == option.HookModeJob {
+		args = append(args, "--hook-mode="+option.OptionHookMode, "--hook-image="+option.OptionHookImage, "--hook-service-account="+option.OptionHookServiceAccount)
+	}
+	namespaceEnv := func(name string) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}}
+	}
+	env := []corev1.EnvVar{{Name: k8sutil.OperatorNameEnvVar, Value: meta.Name}, namespaceEnv("POD_NAMESPACE")}
+	if !option.OptionAllNamespace {
+		env = append(env, namespaceEnv(k8sutil.WatchNamespaceEnvVar))
+	}
+	if len(option.OptionTillerNamespace) > 0 {
+		env = append(env, corev1.EnvVar{Name: "TILLER_NAMESPACE", Value: option.OptionTillerNamespace})
+	}
+	if len(option.OptionFetchExec) > 0 {
+		env = append(env, corev1.EnvVar{Name: "FETCH_CHART_EXEC", Value: option.OptionFetchExec})
+	}
+	probe := func(path string, period int32) *corev1.Probe {
+		return &corev1.Probe{
+			Handler:       corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Path: path, Port: intstr.FromString("health")}},
+			PeriodSeconds: period,
+		}
+	}
+	liveness, replicas := probe("/healthz", 30), int32(1)
+	liveness.InitialDelaySeconds = 10
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: meta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: meta.Labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: meta.Labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: meta.Name,
+					Containers: []corev1.Container{{
+						Name:           "operator",
+						Image:          option.OptionManifestsImage,
+						Args:           args,
+						Env:            env,
+						Ports:          []corev1.ContainerPort{{Name: "health", ContainerPort: 8081}},
+						LivenessProbe:  liveness,
+						ReadinessProbe: probe("/readyz", 10),
+					}},
+				},
+			},
+		},
+	}
+}
+
+//manifestYAML YAML of object, without empty status and creationTimestamp of typed objects
+func manifestYAML(object interface{}) ([]byte, error) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	manifest := map[string]interface{}{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	delete(manifest, "status")
+	removeCreationTimestamp(manifest)
+	data, err = yaml.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return data[:len(data)-1], nil
+}
+
+func removeCreationTimestamp(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if meta, ok := v["metadata"].(map[string]interface{}); ok && meta["creationTimestamp"] == nil {
+			delete(meta, "creationTimestamp")
+		}
+		for _, child := range v {
+			removeCreationTimestamp(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			removeCreationTimestamp(child)
+		}
+	}
+}
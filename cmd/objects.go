@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	api "k8s.io/kubernetes/pkg/apis/core"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+)
+
+//objectSource ConfigMaps and Secrets read by installer behavior: values, chart archives and pull secrets
+type objectSource interface {
+	ConfigMap(namespace string, name string) (*api.ConfigMap, error)
+	Secret(namespace string, name string) (*api.Secret, error)
+}
+
+//clusterObjects objects of cluster
+type clusterObjects struct {
+	clientset internalclientset.Interface
+}
+
+func (o clusterObjects) ConfigMap(namespace string, name string) (*api.ConfigMap, error) {
+	return o.clientset.Core().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (o clusterObjects) Secret(namespace string, name string) (*api.Secret, error) {
+	return o.clientset.Core().Secrets(namespace).Get(name, metav1.GetOptions{})
+}
+
+//watchObject watches the single ConfigMap or Secret of ref, as objectWatch
+func (o clusterObjects) watchObject(ref *chartObjectRef, changed func(data map[string][]byte), stop <-chan struct{}) {
+	selector := fields.OneTermEqualSelector("metadata.name", ref.Name).String()
+	lw, object := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return o.clientset.Core().ConfigMaps(ref.Namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return o.clientset.Core().ConfigMaps(ref.Namespace).Watch(options)
+		},
+	}, runtime.Object(&api.ConfigMap{})
+	if ref.Kind == "Secret" {
+		lw.ListFunc = func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return o.clientset.Core().Secrets(ref.Namespace).List(options)
+		}
+		lw.WatchFunc = func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return o.clientset.Core().Secrets(ref.Namespace).Watch(options)
+		}
+		object = &api.Secret{}
+	}
+	objectData := func(obj interface{}) {
+		switch o := obj.(type) {
+		case *api.ConfigMap:
+			changed(o.BinaryData)
+		case *api.Secret:
+			changed(o.Data)
+		}
+	}
+	_, controller := cache.NewInformer(lw, object, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    objectData,
+		UpdateFunc: func(old, obj interface{}) { objectData(obj) },
+	})
+	go controller.Run(stop)
+}
+
+//fileObjects objects of local manifests, for rendering without a cluster connection
+type fileObjects struct {
+	configMaps map[string]*api.ConfigMap
+	secrets    map[string]*api.Secret
+}
+
+func (o *fileObjects) ConfigMap(namespace string, name string) (*api.ConfigMap, error) {
+	if cfgmap, ok := o.configMaps[namespace+"/"+name]; ok {
+		return cfgmap, nil
+	}
+	return nil, apierrors.NewNotFound(api.Resource("configmaps"), name)
+}
+
+func (o *fileObjects) Secret(namespace string, name string) (*api.Secret, error) {
+	if secret, ok := o.secrets[namespace+"/"+name]; ok {
+		return secret, nil
+	}
+	return nil, apierrors.NewNotFound(api.Resource("secrets"), name)
+}
+
+//loadFileObjects ConfigMaps and Secrets of manifest files, objects without namespace belong to namespace
+func loadFileObjects(files []string, namespace string) (*fileObjects, error) {
+	objects := &fileObjects{map[string]*api.ConfigMap{}, map[string]*api.Secret{}}
+	for _, file := range files {
+		manifests, err := readManifests(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, manifest := range manifests {
+			meta := &metav1.TypeMeta{}
+			if err := json.Unmarshal(manifest, meta); err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			switch meta.Kind {
+			case "ConfigMap":
+				o := &corev1.ConfigMap{}
+				if err := json.Unmarshal(manifest, o); err != nil {
+					return nil, fmt.Errorf("%s: %v", file, err)
+				}
+				if o.Namespace == "" {
+					o.Namespace = namespace
+				}
+				objects.configMaps[o.Namespace+"/"+o.Name] = &api.ConfigMap{ObjectMeta: o.ObjectMeta, Data: o.Data, BinaryData: o.BinaryData}
+			case "Secret":
+				o := &corev1.Secret{}
+				if err := json.Unmarshal(manifest, o); err != nil {
+					return nil, fmt.Errorf("%s: %v", file, err)
+				}
+				if o.Namespace == "" {
+					o.Namespace = namespace
+				}
+				data := map[string][]byte{}
+				for k, v := range o.Data {
+					data[k] = v
+				}
+				for k, v := range o.StringData {
+					data[k] = []byte(v)
+				}
+				objects.secrets[o.Namespace+"/"+o.Name] = &api.Secret{ObjectMeta: o.ObjectMeta, Data: data, Type: api.SecretType(o.Type)}
+			default:
+				return nil, fmt.Errorf("%s: expect ConfigMap or Secret, got %q", file, meta.Kind)
+			}
+		}
+	}
+	return objects, nil
+}
+
+//readManifests JSON of each non-empty YAML (or JSON) document of file, '-' for stdin
+func readManifests(file string) ([]json.RawMessage, error) {
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	manifests, decoder := []json.RawMessage{}, yaml.NewYAMLOrJSONDecoder(in, 4096)
+	for {
+		manifest := json.RawMessage{}
+		if err := decoder.Decode(&manifest); err == io.EOF {
+			return manifests, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		if len(manifest) > 0 && string(manifest) != "null" {
+			manifests = append(manifests, manifest)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package option
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+//Operator settings of a single watched kind
+type Operator struct {
+	//Name operator name, prefix of option annotations and finalizer
+	Name string `json:"name,omitempty"`
+	//CRD of form '<Kind>,<plural>.<group>/<api-version>[,<singular>]'
+	CRD string `json:"crd"`
+	//Chart chart dir
+	Chart string `json:"chart,omitempty"`
+	//ValueFiles values files merged after --values
+	ValueFiles []string `json:"values,omitempty"`
+	//ValuesSchema JSON schema file of values, overrides --values-schema and values.schema.json of chart
+	ValuesSchema string `json:"valuesSchema,omitempty"`
+
+	//CRDName crd name
+	CRDName string `json:"-"`
+	//CRDGroup crd group
+	CRDGroup string `json:"-"`
+	//CRDVersion crd version
+	CRDVersion string `json:"-"`
+	//CRDKind crd kind
+	CRDKind string `json:"-"`
+	//CRDPlural crd plural
+	CRDPlural string `json:"-"`
+	//CRDSingular crd singular
+	CRDSingular string `json:"-"`
+	//APIVersion crd ApiVersion: <group>/<version>
+	APIVersion string `json:"-"`
+}
+
+func (o *Operator) parseCRD() error {
+	crd := strings.Split(o.CRD, ",")
+	if len(crd) < 2 {
+		return fmt.Errorf("illegal crd %q", o.CRD)
+	}
+	o.CRDKind, o.CRDSingular = crd[0], strings.ToLower(crd[0])
+	if len(crd) > 2 {
+		o.CRDSingular = crd[2]
+	}
+	crd = strings.Split(crd[1], "/")
+	if len(crd) < 2 {
+		return fmt.Errorf("illegal crd %q", o.CRD)
+	}
+	o.CRDName, o.CRDVersion = crd[0], crd[1]
+	crd = strings.Split(o.CRDName, ".")
+	if len(crd) < 2 {
+		return fmt.Errorf("illegal crd %q", o.CRD)
+	}
+	o.CRDPlural, o.CRDGroup = crd[0], strings.Join(crd[1:], ".")
+	o.APIVersion = fmt.Sprintf("%s/%s", o.CRDGroup, o.CRDVersion)
+	return nil
+}
+
+//DecorateValues 组装 values, operator values files merged after --values, then --set values
+func (o *Operator) DecorateValues(specValues map[string]interface{}, valueYamls [][]byte) (map[string]interface{}, error) {
+	return decorateValues(append(append([]string{}, OptionValueFiles...), o.ValueFiles...), specValues, valueYamls)
+}
+
+//ValuesSchemaFile schema file of values, empty to use values.schema.json of chart
+func (o *Operator) ValuesSchemaFile() string {
+	if len(o.ValuesSchema) > 0 {
+		return o.ValuesSchema
+	}
+	return OptionValuesSchema
+}
+
+//parseOperators --crd/--chart pairs followed by --operators file entries.
+//The first kind is named --name, so adding kinds keeps its option annotations and finalizer
+func parseOperators() ([]*Operator, error) {
+	operators := []*Operator{}
+	for i, crd := range OptionCRDs {
+		o := &Operator{CRD: crd}
+		if i < len(OptionCharts) {
+			o.Chart = OptionCharts[i]
+		}
+		operators = append(operators, o)
+	}
+	if len(OptionOperatorsFile) > 0 {
+		bytes, err := ioutil.ReadFile(OptionOperatorsFile)
+		if err != nil {
+			return nil, err
+		}
+		fileOperators := []*Operator{}
+		if err := yaml.Unmarshal(bytes, &fileOperators); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", OptionOperatorsFile, err)
+		}
+		operators = append(operators, fileOperators...)
+	}
+	if len(operators) == 0 {
+		return nil, fmt.Errorf("--crd or --operators required")
+	}
+	names, kinds := map[string]bool{}, map[string]bool{}
+	for i, o := range operators {
+		if err := o.parseCRD(); err != nil {
+			return nil, err
+		}
+		if len(o.Name) == 0 && i == 0 {
+			o.Name = OptionOperatorName
+		} else if len(o.Name) == 0 {
+			o.Name = fmt.Sprintf("%s-%s", OptionOperatorName, o.CRDSingular)
+		}
+		gvk := fmt.Sprintf("%s/%s", o.APIVersion, o.CRDKind)
+		if kinds[gvk] {
+			return nil, fmt.Errorf("duplicated crd %s", gvk)
+		}
+		if names[o.Name] {
+			return nil, fmt.Errorf("duplicated operator name %s", o.Name)
+		}
+		kinds[gvk], names[o.Name] = true, true
+	}
+	return operators, nil
+}
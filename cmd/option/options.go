@@ -4,14 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
 	"k8s.io/helm/pkg/storage"
 	"k8s.io/helm/pkg/storage/driver"
 
@@ -32,28 +36,25 @@ const (
 	storageSecret    = "secret"
 )
 
+const (
+	//HookModeExec hooks executed in operator
+	HookModeExec = "exec"
+	//HookModeJob hooks run as jobs in namespace of resource
+	HookModeJob = "job"
+)
+
 var (
-	logger *log.Logger
+	logger *logrus.Entry
 	//OptionOperatorName --name option
 	OptionOperatorName string
 	//OptionKubeConfig --kubeconfig option
 	OptionKubeConfig string
-	//OptionCRD --crd option
-	OptionCRD string
-	//OptionCRDName crd name
-	OptionCRDName string
-	//OptionCRDGroup crd group
-	OptionCRDGroup string
-	//OptionCRDVersion crd version
-	OptionCRDVersion string
-	//OptionCRDKind crd kind
-	OptionCRDKind string
-	//OptionCRDPlural crd plural
-	OptionCRDPlural string
-	//OptionCRDSingular crd singular
-	OptionCRDSingular string
-	//OptionAPIVersion crd ApiVersion: <group>/<version>
-	OptionAPIVersion string
+	//OptionCRDs --crd options
+	OptionCRDs []string
+	//OptionOperatorsFile --operators option
+	OptionOperatorsFile string
+	//Operators watched kinds, first one used by init/install/uninstall
+	Operators []*Operator
 	//OptionInit --init option
 	OptionInit bool
 	//OptionInstallResource install <resource_name> option
@@ -62,10 +63,14 @@ var (
 	OptionInstallOnce bool
 	//OptionUninstallResource --uninstall=<resource_name> option
 	OptionUninstallResource string
+	//OptionWait install/uninstall --wait option
+	OptionWait bool
+	//OptionWaitTimeout install/uninstall --timeout option, in seconds
+	OptionWaitTimeout int
 	//OptionInstallOptions install --option options
 	OptionInstallOptions []string
-	//OptionChart --chart option
-	OptionChart string
+	//OptionCharts --chart options, paired with --crd
+	OptionCharts []string
 	//OptionForce --force option
 	OptionForce bool
 	//OptionNamespace --namespace option
@@ -76,6 +81,16 @@ var (
 	OptionTillerNamespace string
 	//OptionValueFiles --values/-f option
 	OptionValueFiles []string
+	//OptionSetValues --set option
+	OptionSetValues []string
+	//OptionSetStringValues --set-string option
+	OptionSetStringValues []string
+	//OptionSetFileValues --set-file option
+	OptionSetFileValues []string
+	//OptionValuesSchema --values-schema option
+	OptionValuesSchema string
+	//OptionStrictValues --strict-values option
+	OptionStrictValues bool
 	//OptionStore --tiller-storage option
 	OptionStore string
 	//OptionMaxHistory --till-history-max option
@@ -84,46 +99,157 @@ var (
 	OptionResyncPeriod int
 	//OptionHooks --hooks option
 	OptionHooks bool
+	//OptionHookTimeout --hook-timeout option, in seconds
+	OptionHookTimeout int
+	//OptionHookMode --hook-mode option, exec hooks in operator, or run them as jobs
+	OptionHookMode string
+	//OptionHookImage --hook-image option, image of hook jobs
+	OptionHookImage string
+	//OptionHookServiceAccount --hook-service-account option, service account of hook jobs
+	OptionHookServiceAccount string
 	//OptionFetchExec --fetch-exec option
 	OptionFetchExec string
+	//OptionRepositories --repo options
+	OptionRepositories map[string]*charts.Repository
+	//OptionChartCache --chart-cache option
+	OptionChartCache string
+	//OptionChartPullSecret --chart-pull-secret option
+	OptionChartPullSecret string
+	//OptionPlainHTTPRegistries --plain-http-registry option
+	OptionPlainHTTPRegistries []string
+	//OptionWatchChartObjects --watch-chart-objects option
+	OptionWatchChartObjects bool
+	//OptionChartPoll --chart-poll option
+	OptionChartPoll int
+	//OptionChartCacheTTL --chart-cache-ttl option
+	OptionChartCacheTTL int
+	//OptionChartCacheSize --chart-cache-size option
+	OptionChartCacheSize int
+	//OptionChartRefresh --chart-refresh option
+	OptionChartRefresh int
+	//OptionKeyring --keyring option
+	OptionKeyring string
+	//OptionVerify --verify option
+	OptionVerify bool
+	//OptionLogFormat --log-format option
+	OptionLogFormat string
+	//OptionLogLevel --log-level option
+	OptionLogLevel string
+	//OptionHealthAddr --health-addr option
+	OptionHealthAddr string
+	//OptionHealthStallTimeout --health-stall-timeout option
+	OptionHealthStallTimeout int
+	//OptionWebhook webhook command
+	OptionWebhook bool
+	//OptionWebhookAddr --webhook-addr option
+	OptionWebhookAddr string
+	//OptionWebhookService --webhook-service option
+	OptionWebhookService string
+	//OptionWebhookNamespace --webhook-namespace option
+	OptionWebhookNamespace string
+	//OptionWebhookSecret --webhook-secret option
+	OptionWebhookSecret string
+	//OptionWebhookCertDir --webhook-cert-dir option
+	OptionWebhookCertDir string
+	//OptionWebhookURL --webhook-url option
+	OptionWebhookURL string
+	//OptionWebhookFailurePolicy --webhook-failure-policy option
+	OptionWebhookFailurePolicy string
+	//OptionCRDValidation init --crd-validation option
+	OptionCRDValidation bool
+	//OptionTemplateFile template <file> option
+	OptionTemplateFile string
+	//OptionValuesObjects template --values-object options
+	OptionValuesObjects []string
+	//OptionKubeVersion template --kube-version option
+	OptionKubeVersion string
+	//OptionAPIVersions template --api-versions options
+	OptionAPIVersions []string
+	//OptionDiffFile diff --filename option
+	OptionDiffFile string
+	//OptionDiffContext diff --context option
+	OptionDiffContext int
+	//OptionStatusResource status <resource_name> option
+	OptionStatusResource string
+	//OptionHistoryResource history <resource_name> option
+	OptionHistoryResource string
+	//OptionRollbackResource rollback <resource_name> <revision> option
+	OptionRollbackResource string
+	//OptionRollbackRevision rollback <resource_name> <revision> option
+	OptionRollbackRevision int
+	//OptionList list command
+	OptionList bool
+	//OptionOutput list --output option
+	OptionOutput string
+	//OptionManifests manifests command
+	OptionManifests bool
+	//OptionManifestsImage manifests --image option
+	OptionManifestsImage string
+	//OptionManifestsKustomize manifests --kustomize option, dir of kustomize base
+	OptionManifestsKustomize string
+	//OptionRBAC rbac command
+	OptionRBAC bool
+	//OptionRBACSamples rbac --sample option, files of sample resources
+	OptionRBACSamples []string
+	//OptionRBACEscalate rbac --escalate option, grants bind and escalate of RBAC kinds
+	OptionRBACEscalate bool
+	//OptionClusterKinds rbac/manifests --cluster-kinds option, kinds of cluster-scoped objects of charts not known as such
+	OptionClusterKinds []string
+	//OptionManifestsChartRole manifests --chart-role option, ClusterRole bound for objects of charts instead of rules of their kinds
+	OptionManifestsChartRole string
 
-	optionContinue bool
+	optionRepositories []string
+	optionContinue     bool
+	//parsedSetValues values of --set, --set-string and --set-file, parsed once
+	parsedSetValues map[string]interface{}
 )
 
 func parseOptions() error {
 	cmd := &cobra.Command{
 		Use: os.Args[0],
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if len(OptionCRD) == 0 {
-				return fmt.Errorf("--crd required")
+			if len(OptionOperatorName) == 0 {
+				OptionOperatorName = "helm-app-operator"
+			}
+			operators, err := parseOperators()
+			if err != nil {
+				return err
+			}
+			Operators = operators
+			if len(OptionWebhookService) == 0 {
+				OptionWebhookService = OptionOperatorName
 			}
-			crd := strings.Split(OptionCRD, ",")
-			if len(crd) < 2 {
-				return fmt.Errorf(" illegal --crd Option")
+			if len(OptionWebhookSecret) == 0 {
+				OptionWebhookSecret = OptionWebhookService + "-webhook"
 			}
-			OptionCRDKind, OptionCRDSingular = crd[0], strings.ToLower(crd[0])
-			if len(crd) > 2 {
-				OptionCRDSingular = crd[2]
+			OptionRepositories = map[string]*charts.Repository{}
+			for _, repo := range optionRepositories {
+				r, err := charts.ParseRepository(repo)
+				if err != nil {
+					return err
+				}
+				OptionRepositories[r.Name] = r
 			}
-			crd = strings.Split(crd[1], "/")
-			if len(crd) < 2 {
-				return fmt.Errorf(" illegal --crd Option")
+			switch OptionHookMode {
+			case "", HookModeExec, HookModeJob:
+			default:
+				return fmt.Errorf("unknown hook mode %s", OptionHookMode)
 			}
-			OptionCRDName, OptionCRDVersion = crd[0], crd[1]
-			crd = strings.Split(OptionCRDName, ".")
-			if len(crd) < 2 {
-				return fmt.Errorf(" illegal --crd Option")
+			values, err := parseSetValues()
+			if err != nil {
+				return err
 			}
-			OptionCRDPlural, OptionCRDGroup = crd[0], strings.Join(crd[1:], ".")
-			OptionAPIVersion = fmt.Sprintf("%s/%s", OptionCRDGroup, OptionCRDVersion)
+			parsedSetValues = values
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if OptionAllNamespace {
 				OptionNamespace = metav1.NamespaceAll
 			}
-			if len(OptionChart) == 0 {
-				return fmt.Errorf("--chart required")
+			for _, o := range Operators {
+				if len(o.Chart) == 0 {
+					return fmt.Errorf("--chart required for %s", o.CRD)
+				}
 			}
 			optionContinue = true
 			return nil
@@ -165,70 +291,346 @@ func parseOptions() error {
 			return nil
 		},
 	}
-	cmd.AddCommand(cmdInit, cmdInstall, cmdUninstall)
-	flagsPersistent, flagsOperator, _ /*flagsInit*/, flagsInstall, flagsUninstall :=
+	cmdWebhook := &cobra.Command{
+		Use: "webhook",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if OptionWebhookFailurePolicy != "Ignore" && OptionWebhookFailurePolicy != "Fail" {
+				return fmt.Errorf("illegal --webhook-failure-policy %q, expect Ignore or Fail", OptionWebhookFailurePolicy)
+			}
+			OptionWebhook = true
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdTemplate := &cobra.Command{
+		Use: "template [flags] RESOURCE_FILE",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("command 'template' requires a resource file")
+			}
+			OptionTemplateFile = args[0]
+			if len(OptionNamespace) == 0 {
+				OptionNamespace = metav1.NamespaceDefault
+			}
+			for _, o := range Operators {
+				if len(o.Chart) == 0 {
+					return fmt.Errorf("--chart required for %s", o.CRD)
+				}
+			}
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdDiff := &cobra.Command{
+		Use: "diff [flags] -f RESOURCE_FILE",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(OptionDiffFile) == 0 {
+				return errors.New("command 'diff' requires --filename")
+			}
+			for _, o := range Operators {
+				if len(o.Chart) == 0 {
+					return fmt.Errorf("--chart required for %s", o.CRD)
+				}
+			}
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdStatus := &cobra.Command{
+		Use: "status [flags] RESOURCE_NAME",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("command 'status' requires a resource name")
+			}
+			OptionStatusResource = args[0]
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdHistory := &cobra.Command{
+		Use: "history [flags] RESOURCE_NAME",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("command 'history' requires a resource name")
+			}
+			OptionHistoryResource = args[0]
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdRollback := &cobra.Command{
+		Use: "rollback [flags] RESOURCE_NAME REVISION",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return errors.New("command 'rollback' requires a resource name and a revision")
+			}
+			revision, err := strconv.Atoi(args[1])
+			if err != nil || revision <= 0 {
+				return fmt.Errorf("illegal revision %q", args[1])
+			}
+			OptionRollbackResource, OptionRollbackRevision = args[0], revision
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdList := &cobra.Command{
+		Use: "list",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch OptionOutput {
+			case "table", "json", "yaml":
+			default:
+				return fmt.Errorf("unknown output format %s", OptionOutput)
+			}
+			if OptionAllNamespace {
+				OptionNamespace = metav1.NamespaceAll
+			}
+			OptionList = true
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdManifests := &cobra.Command{
+		Use: "manifests",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(OptionOperatorsFile) > 0 {
+				return errors.New("command 'manifests' requires --crd/--chart pairs instead of --operators")
+			}
+			OptionManifests = true
+			optionContinue = true
+			return nil
+		},
+	}
+	cmdRBAC := &cobra.Command{
+		Use: "rbac",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			OptionRBAC = true
+			optionContinue = true
+			return nil
+		},
+	}
+	cmd.AddCommand(cmdInit, cmdInstall, cmdUninstall, cmdWebhook, cmdTemplate, cmdDiff, cmdStatus, cmdHistory, cmdRollback, cmdList, cmdManifests, cmdRBAC)
+	flagsPersistent, flagsOperator, flagsInit, flagsInstall, flagsUninstall :=
 		cmd.PersistentFlags(), cmd.Flags(), cmdInit.Flags(), cmdInstall.Flags(), cmdUninstall.Flags()
 	flagsPersistent.StringVar(&OptionKubeConfig, "kubeconfig", kubeconfigFromEnv(), "kubeconfig path, default to in-cluster config")
-	flagsPersistent.StringVar(&OptionCRD, "crd", os.Getenv("CRD_RESOURCE"), "CRD resource of form '<Kind>,<plural>.<group>/<api-version>[,<singular>]', eg. CustomApp,custom-apps.xiaopal.github.com/v1beta1,custom-app")
+	flagsPersistent.StringVar(&OptionLogFormat, "log-format", envOrDefault("LOG_FORMAT", "text"), "log format. One of 'text' or 'json'")
+	flagsPersistent.StringVar(&OptionLogLevel, "log-level", envOrDefault("LOG_LEVEL", "info"), "log level. One of 'debug', 'info', 'warn' or 'error'")
+	flagsPersistent.StringArrayVar(&OptionCRDs, "crd", envList("CRD_RESOURCE"), "CRD resource of form '<Kind>,<plural>.<group>/<api-version>[,<singular>]', eg. CustomApp,custom-apps.xiaopal.github.com/v1beta1,custom-app (can specify multiple)")
+	flagsPersistent.StringVar(&OptionWebhookService, "webhook-service", os.Getenv("WEBHOOK_SERVICE"), "service of admission webhook, defaults to operator name")
+	flagsPersistent.StringVar(&OptionWebhookNamespace, "webhook-namespace", podNamespaceFromEnv(), "namespace of admission webhook service and certificate secret. defaults to current namespace.")
+	flagsPersistent.StringVar(&OptionWebhookSecret, "webhook-secret", os.Getenv("WEBHOOK_SECRET"), "secret of admission webhook certificate, self-generated if not exists, defaults to <webhook-service>-webhook")
+	flagsPersistent.StringVar(&OptionWebhookCertDir, "webhook-cert-dir", os.Getenv("WEBHOOK_CERT_DIR"), "dir of mounted admission webhook certificate (tls.crt, tls.key, ca.crt), instead of --webhook-secret")
+	flagsPersistent.StringVar(&OptionOperatorsFile, "operators", os.Getenv("OPERATORS_FILE"), "YAML file of watched kinds, list of {name, crd, chart, values}")
 
 	flagsOperator.StringVarP(&OptionOperatorName, "name", "n", os.Getenv(k8sutil.OperatorNameEnvVar), "operator name, default to helm-app-operator")
-	flagsOperator.StringVarP(&OptionChart, "chart", "c", os.Getenv("HELM_CHART"), "chart dir")
+	addChartFlags(flagsOperator)
 	flagsOperator.BoolVar(&OptionAllNamespace, "all-namespaces", false, "watch all namespace")
 	flagsOperator.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "watch namespace. defaults to current namespace.")
 	flagsOperator.BoolVar(&OptionForce, "force", false, "upgrade with force option")
 	flagsOperator.StringSliceVarP(&OptionValueFiles, "values", "f", nil, "specify values in a YAML file(can specify multiple)")
+	addSetFlags(flagsOperator)
+	flagsOperator.BoolVar(&OptionStrictValues, "strict-values", false, "reject values not declared in values schema, overridden by strict-values option")
 	flagsOperator.BoolVar(&OptionHooks, "hooks", true, "enable hooks")
-	flagsOperator.StringVar(&OptionTillerNamespace, "tiller-namespace", tillerNamespaceFromEnv(), "tiller namespace. defaults to current namespace.")
-	flagsOperator.StringVar(&OptionStore, "tiller-storage", storageConfigMap, "storage driver to use. One of 'configmap', 'memory', or 'secret'")
+	flagsOperator.IntVar(&OptionHookTimeout, "hook-timeout", 600, "seconds a hook or --fetch-exec command may run before its process group is killed, overridden by <hook>-timeout option, 0 for no limit")
+	addHookFlags(flagsOperator)
+	addTillerFlags(flagsOperator)
 	flagsOperator.IntVar(&OptionMaxHistory, "tiller-history-max", historyMaxFromEnv(), "maximum number of releases kept in release history, with 0 meaning no limit")
 	flagsOperator.IntVar(&OptionResyncPeriod, "resync", 0, "resync period, default 0")
 
-	flagsOperator.StringVar(&OptionFetchExec, "fetch-exec", os.Getenv("FETCH_CHART_EXEC"), "fetch chart command")
+	flagsOperator.StringVar(&OptionKeyring, "keyring", os.Getenv("HELM_KEYRING"), "keyring of public keys to verify chart provenance")
+	flagsOperator.BoolVar(&OptionVerify, "verify", false, "verify chart provenance against --keyring, overridden by verify option")
+	flagsOperator.BoolVar(&OptionWatchChartObjects, "watch-chart-objects", true, "watch the ConfigMaps and Secrets referenced by configmap:// and secret:// charts, triggering upgrade when changed")
+	flagsOperator.IntVar(&OptionChartPoll, "chart-poll", 300, "seconds between re-resolving branches of git charts, triggering upgrade when moved, 0 to disable")
+	flagsOperator.IntVar(&OptionChartCacheTTL, "chart-cache-ttl", 86400, "seconds a cached chart is kept unused, 0 to keep forever")
+	flagsOperator.IntVar(&OptionChartCacheSize, "chart-cache-size", 1024, "size limit of chart cache in MB, 0 for no limit")
+	flagsOperator.IntVar(&OptionChartRefresh, "chart-refresh", 60, "seconds a chart with 'fetch: always' option is reused before fetched again")
+	flagsOperator.StringVar(&OptionWebhookAddr, "webhook-addr", os.Getenv("WEBHOOK_ADDR"), "bind address of HTTPS admission webhook validating resources, eg. :8443, empty to disable")
+	flagsOperator.StringVar(&OptionHealthAddr, "health-addr", envOrDefault("HEALTH_ADDR", ":8081"), "bind address of /healthz and /readyz endpoints, empty to disable")
+	flagsOperator.IntVar(&OptionHealthStallTimeout, "health-stall-timeout", 0, "seconds a single reconcile may run before /healthz reports failure, 0 to disable. set above the hook and chart timeouts a reconcile may wait for")
+
+	addChartFlags(flagsInit)
+	flagsInit.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "namespace of configmap:// and secret:// charts. defaults to current namespace.")
+	flagsInit.BoolVar(&OptionCRDValidation, "crd-validation", true, "generate openAPIV3Schema of spec from values schema, or types of chart values")
 
 	flagsInstall.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "install to namespace. defaults to current namespace.")
 	flagsInstall.BoolVar(&OptionInstallOnce, "once", false, "install crd resource if not exists")
 	flagsInstall.StringArrayVarP(&OptionInstallOptions, "option", "o", nil, "option annotation, eg. -o pre-install='echo $EVENT_TYPE'")
 	flagsInstall.StringSliceVarP(&OptionValueFiles, "values", "f", nil, "specify values in a YAML file(can specify multiple)")
+	addSetFlags(flagsInstall)
 
 	flagsUninstall.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "uninstall from namespace. defaults to current namespace.")
+	for _, flags := range []*pflag.FlagSet{flagsInstall, flagsUninstall} {
+		flags.BoolVar(&OptionWait, "wait", false, "wait until the operator applied (or removed) the resource, failing if it failed")
+		flags.IntVar(&OptionWaitTimeout, "timeout", 300, "seconds to --wait, 0 to wait forever")
+	}
+
+	flagsTemplate := cmdTemplate.Flags()
+	addChartFlags(flagsTemplate)
+	flagsTemplate.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "namespace of resources without one. defaults to current namespace.")
+	flagsTemplate.StringSliceVarP(&OptionValueFiles, "values", "f", nil, "specify values in a YAML file(can specify multiple)")
+	addSetFlags(flagsTemplate)
+	flagsTemplate.StringArrayVar(&OptionValuesObjects, "values-object", nil, "YAML file of ConfigMaps or Secrets standing for cluster objects, eg. values of resources or configmap:// charts (can specify multiple)")
+	flagsTemplate.BoolVar(&OptionStrictValues, "strict-values", false, "reject values not declared in values schema, overridden by strict-values option")
+	flagsTemplate.StringVar(&OptionKubeVersion, "kube-version", "", "kubernetes version of .Capabilities.KubeVersion, defaults to v1.9.0")
+	flagsTemplate.StringArrayVar(&OptionAPIVersions, "api-versions", nil, "api versions of .Capabilities.APIVersions in addition to v1, eg. apps/v1 (can specify multiple)")
+
+	flagsDiff := cmdDiff.Flags()
+	addChartFlags(flagsDiff)
+	addTillerFlags(flagsDiff)
+	flagsDiff.StringVarP(&OptionDiffFile, "filename", "f", "", "YAML file of changed resources, '-' for stdin")
+	flagsDiff.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "namespace of resources without one. defaults to current namespace.")
+	flagsDiff.StringSliceVar(&OptionValueFiles, "values", nil, "specify values in a YAML file(can specify multiple)")
+	addSetFlags(flagsDiff)
+	flagsDiff.BoolVar(&OptionStrictValues, "strict-values", false, "reject values not declared in values schema, overridden by strict-values option")
+	flagsDiff.IntVar(&OptionDiffContext, "context", 3, "lines of context in diff")
+
+	for _, c := range []*cobra.Command{cmdStatus, cmdHistory, cmdRollback} {
+		addTillerFlags(c.Flags())
+		c.Flags().StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "namespace of resource. defaults to current namespace.")
+	}
+
+	flagsList := cmdList.Flags()
+	addTillerFlags(flagsList)
+	flagsList.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "list namespace. defaults to current namespace.")
+	flagsList.BoolVar(&OptionAllNamespace, "all-namespaces", false, "list all namespaces")
+	flagsList.StringVarP(&OptionOutput, "output", "o", "table", "output format. One of 'table', 'json' or 'yaml'")
+	flagsList.StringSliceVarP(&OptionValueFiles, "values", "f", nil, "values files of the operator, to tell whether checksums are current (can specify multiple)")
+	addSetFlags(flagsList)
+
+	flagsManifests := cmdManifests.Flags()
+	addChartFlags(flagsManifests)
+	flagsManifests.StringVarP(&OptionOperatorName, "name", "n", os.Getenv(k8sutil.OperatorNameEnvVar), "operator name, default to helm-app-operator")
+	flagsManifests.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "namespace of operator, and watched namespace without --all-namespaces. defaults to current namespace.")
+	flagsManifests.BoolVar(&OptionAllNamespace, "all-namespaces", false, "watch all namespaces, with cluster-wide RBAC")
+	flagsManifests.StringVar(&OptionTillerNamespace, "tiller-namespace", "", "tiller namespace. defaults to --namespace.")
+	flagsManifests.StringVar(&OptionStore, "tiller-storage", storageSecret, "storage driver to use. One of 'configmap', 'memory', or 'secret'")
+	flagsManifests.IntVar(&OptionMaxHistory, "tiller-history-max", historyMaxFromEnv(), "maximum number of releases kept in release history, with 0 meaning no limit")
+	flagsManifests.StringVar(&OptionManifestsImage, "image", "xiaopal/helm-app-operator", "image of operator")
+	addHookFlags(flagsManifests)
+	flagsManifests.BoolVar(&OptionCRDValidation, "crd-validation", true, "generate openAPIV3Schema of spec from values schema, or types of chart values")
+	flagsManifests.StringArrayVar(&OptionValuesObjects, "values-object", nil, "YAML file of ConfigMaps or Secrets holding configmap:// and secret:// charts, to generate CRD schema (can specify multiple)")
+	flagsManifests.StringVar(&OptionManifestsKustomize, "kustomize", "", "write a kustomize base to dir instead of printing YAML")
+	flagsManifests.StringVar(&OptionManifestsChartRole, "chart-role", "", "ClusterRole bound for objects of charts, eg. admin, instead of rules of kinds rendered from charts as by 'rbac'")
+	flagsManifests.BoolVar(&OptionRBACEscalate, "escalate", false, "grant bind and escalate of RBAC kinds, for roles of charts varying by values, instead of holding the rules of rendered roles")
+	flagsManifests.StringArrayVar(&OptionRBACSamples, "sample", nil, "YAML file of sample resources rendered in addition to default values, '-' for stdin (can specify multiple)")
+	flagsManifests.StringSliceVar(&OptionClusterKinds, "cluster-kinds", nil, "kinds of cluster-scoped objects of charts, '<Kind>' or '<Kind>.<group>', eg. ClusterIssuer (can specify multiple)")
+
+	flagsRBAC := cmdRBAC.Flags()
+	addChartFlags(flagsRBAC)
+	flagsRBAC.StringVarP(&OptionOperatorName, "name", "n", os.Getenv(k8sutil.OperatorNameEnvVar), "operator name, default to helm-app-operator")
+	flagsRBAC.StringVar(&OptionNamespace, "namespace", watchNamespaceFromEnv(), "namespace of operator, and watched namespace without --all-namespaces. defaults to current namespace.")
+	flagsRBAC.BoolVar(&OptionAllNamespace, "all-namespaces", false, "watch all namespaces, with a ClusterRole")
+	flagsRBAC.StringVar(&OptionTillerNamespace, "tiller-namespace", "", "tiller namespace. defaults to --namespace.")
+	flagsRBAC.StringSliceVarP(&OptionValueFiles, "values", "f", nil, "specify values in a YAML file(can specify multiple)")
+	addSetFlags(flagsRBAC)
+	addHookFlags(flagsRBAC)
+	flagsRBAC.BoolVar(&OptionRBACEscalate, "escalate", false, "grant bind and escalate of RBAC kinds, for roles of charts varying by values, instead of holding the rules of rendered roles")
+	flagsRBAC.StringArrayVar(&OptionRBACSamples, "sample", nil, "YAML file of sample resources rendered in addition to default values, '-' for stdin (can specify multiple)")
+	flagsRBAC.StringArrayVar(&OptionValuesObjects, "values-object", nil, "YAML file of ConfigMaps or Secrets standing for cluster objects, eg. values of resources or configmap:// charts (can specify multiple)")
+	flagsRBAC.StringVar(&OptionKubeVersion, "kube-version", "", "kubernetes version of .Capabilities.KubeVersion, defaults to v1.9.0")
+	flagsRBAC.StringArrayVar(&OptionAPIVersions, "api-versions", nil, "api versions of .Capabilities.APIVersions in addition to v1, eg. apps/v1 (can specify multiple)")
+	flagsRBAC.StringSliceVar(&OptionClusterKinds, "cluster-kinds", nil, "kinds of cluster-scoped objects of charts, '<Kind>' or '<Kind>.<group>', eg. ClusterIssuer (can specify multiple)")
+
+	cmdWebhook.Flags().StringVar(&OptionWebhookURL, "webhook-url", os.Getenv("WEBHOOK_URL"), "URL of admission webhook served outside of cluster, instead of --webhook-service")
+	cmdWebhook.Flags().StringVar(&OptionWebhookFailurePolicy, "webhook-failure-policy", "Ignore", "failure policy of admission webhook, Ignore admits resources while the operator is unreachable, Fail rejects them")
 	return cmd.Execute()
 }
 
+//addSetFlags --set flags, merged after --values files
+func addSetFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&OptionSetValues, "set", nil, "set values on the command line, eg. --set a.b=1,c[0]=x (can specify multiple)")
+	flags.StringArrayVar(&OptionSetStringValues, "set-string", nil, "set STRING values on the command line, eg. --set-string version=1.10 (can specify multiple)")
+	flags.StringArrayVar(&OptionSetFileValues, "set-file", nil, "set values from files on the command line, eg. --set-file script=run.sh (can specify multiple)")
+}
+
+//addHookFlags flags of hook mode, shared by operator and commands generating its deployment and RBAC
+func addHookFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&OptionHookMode, "hook-mode", envOrDefault("HOOK_MODE", HookModeExec), "how hooks run. One of 'exec' (in operator) or 'job' (as jobs in namespace of resource)")
+	flags.StringVar(&OptionHookImage, "hook-image", envOrDefault("HOOK_IMAGE", "xiaopal/helm-app-operator"), "image of hook jobs, overridden by hook-image option")
+	flags.StringVar(&OptionHookServiceAccount, "hook-service-account", envOrDefault("HOOK_SERVICE_ACCOUNT", "default"), "service account of hook jobs, overridden by hook-service-account option")
+}
+
+//addChartFlags flags locating and loading charts, shared by commands rendering charts
+func addChartFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVarP(&OptionCharts, "chart", "c", envList("HELM_CHART"), "chart dir, paired with --crd in order (can specify multiple)")
+	flags.StringVar(&OptionValuesSchema, "values-schema", os.Getenv("VALUES_SCHEMA"), "JSON schema file to validate values against, defaults to values.schema.json of chart")
+	flags.StringVar(&OptionFetchExec, "fetch-exec", os.Getenv("FETCH_CHART_EXEC"), "fetch chart command")
+	flags.StringArrayVar(&optionRepositories, "repo", envList("HELM_REPO"), "chart repository of form '<name>=<url>', for charts of form '<name>/<chart>' (can specify multiple)")
+	flags.StringVar(&OptionChartCache, "chart-cache", envOrDefault("CHART_CACHE", filepath.Join(os.TempDir(), "helm-app-operator")), "chart cache dir")
+	flags.StringVar(&OptionChartPullSecret, "chart-pull-secret", os.Getenv("CHART_PULL_SECRET"), "default secret (in resource namespace) of credentials for oci:// and git+ charts")
+	flags.StringArrayVar(&OptionPlainHTTPRegistries, "plain-http-registry", envList("PLAIN_HTTP_REGISTRY"), "registry host of oci:// charts served over plain http (can specify multiple)")
+}
+
+//addTillerFlags flags of release storage, shared by commands reading releases
+func addTillerFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&OptionTillerNamespace, "tiller-namespace", tillerNamespaceFromEnv(), "tiller namespace. defaults to current namespace.")
+	flags.StringVar(&OptionStore, "tiller-storage", storageConfigMap, "storage driver to use. One of 'configmap', 'memory', or 'secret'")
+}
+
 //NewLogger 配置 logger
-func NewLogger(prefix string) *log.Logger {
+func NewLogger(prefix string) *logrus.Entry {
 	if len(prefix) > 0 {
-		prefix = fmt.Sprintf("[%s] ", prefix)
+		return logrus.WithField("logger", prefix)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+func setupLogger() error {
+	level, err := logrus.ParseLevel(OptionLogLevel)
+	if err != nil {
+		return err
 	}
-	return log.New(os.Stderr, prefix, log.Flags())
+	logrus.SetLevel(level)
+	switch OptionLogFormat {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("unknown log format %s", OptionLogFormat)
+	}
+	return nil
 }
 
 func init() {
 	logger = NewLogger("option")
-	logger.Printf("Go Version: %s", runtime.Version())
-	logger.Printf("Go OS/Arch: %s/%s", runtime.GOOS, runtime.GOARCH)
-	logger.Printf("operator-sdk Version: %v", sdkVersion.Version)
-	logger.Printf("Helm/Tiller Version: %v", helmVersion.GetVersion())
+}
 
+//Parse parses command line options and sets up logger and operator-sdk environment of them,
+//exits if the command line asked for nothing more, eg. help
+func Parse() {
 	if err := parseOptions(); err != nil {
 		logger.Fatalf("faild to parse options: %v", err)
 	} else if !optionContinue {
 		os.Exit(0)
 	}
-
-	//设置环境变量兼容 helm-app-operator-kit 类型注册
-	os.Setenv("KIND", OptionCRDKind)
-	os.Setenv("API_VERSION", OptionAPIVersion)
+	if err := setupLogger(); err != nil {
+		logger.Fatalf("faild to setup logger: %v", err)
+	}
+	logger.Printf("Go Version: %s", runtime.Version())
+	logger.Printf("Go OS/Arch: %s/%s", runtime.GOOS, runtime.GOARCH)
+	logger.Printf("operator-sdk Version: %v", sdkVersion.Version)
+	logger.Printf("Helm/Tiller Version: %v", helmVersion.GetVersion())
 
 	os.Setenv(k8sutil.WatchNamespaceEnvVar, OptionNamespace)
 	if len(OptionKubeConfig) > 0 {
 		os.Setenv(k8sutil.KubeConfigEnvVar, OptionKubeConfig)
 		os.Setenv("KUBECONFIG", OptionKubeConfig)
 	}
-	if len(OptionOperatorName) == 0 {
-		OptionOperatorName = "helm-app-operator"
-	}
 	os.Setenv(k8sutil.OperatorNameEnvVar, OptionOperatorName)
-	os.Setenv("HELM_CHART", OptionChart)
+}
+
+func envOrDefault(name string, defaultVal string) string {
+	if val, found := os.LookupEnv(name); found {
+		return val
+	}
+	return defaultVal
+}
+
+func envList(name string) []string {
+	if val := os.Getenv(name); len(val) > 0 {
+		return []string{val}
+	}
+	return nil
 }
 
 func kubeconfigFromEnv() string {
@@ -245,7 +647,7 @@ func historyMaxFromEnv() int {
 	}
 	ret, err := strconv.Atoi(val)
 	if err != nil {
-		logger.Printf("Invalid max history %q. Defaulting to 1.", val)
+		logger.Warnf("Invalid max history %q. Defaulting to 1.", val)
 		return 1
 	}
 	return ret
@@ -266,6 +668,18 @@ func watchNamespaceFromEnv() string {
 	return "default"
 }
 
+func podNamespaceFromEnv() string {
+	if ns, found := os.LookupEnv("POD_NAMESPACE"); found {
+		return ns
+	}
+	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
+			return ns
+		}
+	}
+	return "default"
+}
+
 func tillerNamespaceFromEnv() string {
 	if ns, found := os.LookupEnv("TILLER_NAMESPACE"); found {
 		return ns
@@ -299,7 +713,7 @@ func GetStorageBackend() (*storage.Storage, error) {
 		secrets := driver.NewSecrets(clientset.Core().Secrets(OptionTillerNamespace))
 		storageBackend = storage.Init(secrets)
 	default:
-		logger.Printf("unknown storage option %s, fallback to memory", OptionStore)
+		logger.Warnf("unknown storage option %s, fallback to memory", OptionStore)
 		storageBackend = storage.Init(driver.NewMemory())
 	}
 
@@ -310,10 +724,9 @@ func GetStorageBackend() (*storage.Storage, error) {
 	return storageBackend, nil
 }
 
-//DecorateValues 组装 values
-func DecorateValues(specValues map[string]interface{}, valueYamls [][]byte) (map[string]interface{}, error) {
+func decorateValues(valueFiles []string, specValues map[string]interface{}, valueYamls [][]byte) (map[string]interface{}, error) {
 	base := map[string]interface{}{}
-	for _, filePath := range OptionValueFiles {
+	for _, filePath := range valueFiles {
 		bytes, err := ioutil.ReadFile(filePath)
 		if err != nil {
 			return nil, err
@@ -323,9 +736,11 @@ func DecorateValues(specValues map[string]interface{}, valueYamls [][]byte) (map
 			return nil, fmt.Errorf("failed to parse %s: %s", filePath, err)
 		}
 		// Merge with the previous map
-		base = mergeValues(base, currentMap)
+		base = MergeValues(base, currentMap)
 	}
-	base = mergeValues(base, specValues)
+	base = MergeValues(base, copyValues(parsedSetValues))
+	//spec is copied, MergeValues keeps maps of src in dest and merges later values into them
+	base = MergeValues(base, copyValues(specValues))
 	for _, valueYaml := range valueYamls {
 		currentMap := map[string]interface{}{}
 
@@ -333,13 +748,39 @@ func DecorateValues(specValues map[string]interface{}, valueYamls [][]byte) (map
 			return nil, fmt.Errorf("failed to parse yaml: %s", err)
 		}
 		// Merge with the previous map
-		base = mergeValues(base, currentMap)
+		base = MergeValues(base, currentMap)
 	}
 	return base, nil
 }
 
-// Merges source and destination map, preferring values from the source map
-func mergeValues(dest map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+//copyValues deep copy of values, maps and lists included
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		copied[k] = copyValue(v)
+	}
+	return copied
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyValues(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+//MergeValues merges source and destination map, preferring values from the source map
+func MergeValues(dest map[string]interface{}, src map[string]interface{}) map[string]interface{} {
 	for k, v := range src {
 		// If the key doesn't exist already, then just set the key to that value
 		if _, exists := dest[k]; !exists {
@@ -360,11 +801,19 @@ func mergeValues(dest map[string]interface{}, src map[string]interface{}) map[st
 			continue
 		}
 		// If we got to this point, it is a map in both, so merge them
-		dest[k] = mergeValues(destMap, nextMap)
+		dest[k] = MergeValues(destMap, nextMap)
 	}
 	return dest
 }
 
+//NewChartCache 获取 chart 缓存
+func NewChartCache() *charts.Cache {
+	cache := charts.NewCache(OptionChartCache,
+		time.Duration(OptionChartCacheTTL)*time.Second, int64(OptionChartCacheSize)*1024*1024)
+	cache.Log = NewLogger("cache").Printf
+	return cache
+}
+
 //KubeClient 获取 kube.Client
 func KubeClient() (*kube.Client, error) {
 	var clientConfig clientcmd.ClientConfig
@@ -0,0 +1,57 @@
+package option
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecorateValuesKeepsSpec(t *testing.T) {
+	spec := map[string]interface{}{
+		"db":    map[string]interface{}{"host": "x"},
+		"hosts": []interface{}{map[string]interface{}{"name": "a"}},
+	}
+	values, err := decorateValues(nil, spec, [][]byte{[]byte("db: {password: secret}\nhosts: [{name: b}]")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"db":    map[string]interface{}{"host": "x"},
+		"hosts": []interface{}{map[string]interface{}{"name": "a"}},
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Errorf("spec changed to %v", spec)
+	}
+	if db := values["db"].(map[string]interface{}); db["host"] != "x" || db["password"] != "secret" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestCopyValues(t *testing.T) {
+	values := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{map[string]interface{}{"c": 1}}}}
+	copied := copyValues(values)
+	copied["a"].(map[string]interface{})["b"].([]interface{})[0].(map[string]interface{})["c"] = 2
+	if c := values["a"].(map[string]interface{})["b"].([]interface{})[0].(map[string]interface{})["c"]; c != 1 {
+		t.Errorf("copy shares values, c = %v", c)
+	}
+}
+
+func TestParseOperatorsKeepsFirstName(t *testing.T) {
+	defer func(name string, crds []string) { OptionOperatorName, OptionCRDs = name, crds }(OptionOperatorName, OptionCRDs)
+	OptionOperatorName = "redis-operator"
+	for _, crds := range [][]string{
+		{"RedisApp,redisapps.example.com/v1"},
+		{"RedisApp,redisapps.example.com/v1", "MysqlApp,mysqlapps.example.com/v1"},
+	} {
+		OptionCRDs = crds
+		operators, err := parseOperators()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if operators[0].Name != "redis-operator" {
+			t.Errorf("%d kinds: first kind named %s", len(crds), operators[0].Name)
+		}
+		if len(operators) > 1 && operators[1].Name != "redis-operator-mysqlapp" {
+			t.Errorf("%d kinds: second kind named %s", len(crds), operators[1].Name)
+		}
+	}
+}
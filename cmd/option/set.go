@@ -0,0 +1,252 @@
+package option
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var errNotList = errors.New("not a list")
+
+//parseSetValues values of --set, --set-string and --set-file expressions, merged in that order
+func parseSetValues() (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, set := range []struct {
+		expressions []string
+		convert     func(rs []rune) (interface{}, error)
+	}{
+		{OptionSetValues, func(rs []rune) (interface{}, error) { return typedValue(string(rs)), nil }},
+		{OptionSetStringValues, func(rs []rune) (interface{}, error) { return string(rs), nil }},
+		{OptionSetFileValues, func(rs []rune) (interface{}, error) {
+			bytes, err := ioutil.ReadFile(string(rs))
+			return string(bytes), err
+		}},
+	} {
+		for _, expression := range set.expressions {
+			if err := parseSet(expression, values, set.convert); err != nil {
+				return nil, fmt.Errorf("failed to parse %q: %v", expression, err)
+			}
+		}
+	}
+	return values, nil
+}
+
+//parseSet merges helm compatible set expression into values, eg. 'a.b[0].c=1,d={x,y}',
+//'\' escapes '.', ',', '=' and '[' of keys and values, convert converts each value
+func parseSet(expression string, values map[string]interface{}, convert func(rs []rune) (interface{}, error)) error {
+	p := &setParser{bytes.NewBufferString(expression), convert}
+	for {
+		if err := p.key(values); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//typedValue value of --set: booleans, null and integers are converted, others kept as strings
+func typedValue(value string) interface{} {
+	switch strings.ToLower(value) {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	case "0":
+		return int64(0)
+	}
+	//values with leading zeros are kept as strings, eg. '0755'
+	if len(value) > 0 && value[0] != '0' {
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	}
+	return value
+}
+
+type setParser struct {
+	in      *bytes.Buffer
+	convert func(rs []rune) (interface{}, error)
+}
+
+//key parses key path of values and its value, until ',' or end of expression
+func (p *setParser) key(values map[string]interface{}) error {
+	k, last, err := runesUntil(p.in, "=[,.")
+	key := string(k)
+	switch {
+	case err != nil:
+		if len(k) == 0 {
+			return err
+		}
+		return fmt.Errorf("key %q has no value", key)
+	case len(k) == 0:
+		return fmt.Errorf("empty key before %q", last)
+	case last == '[':
+		i, err := p.index()
+		if err != nil {
+			return fmt.Errorf("illegal index of %q: %v", key, err)
+		}
+		list, _ := values[key].([]interface{})
+		list, err = p.listItem(list, i)
+		values[key] = list
+		return err
+	case last == '=':
+		value, err := p.value()
+		values[key] = value
+		return err
+	case last == ',':
+		values[key] = ""
+		return fmt.Errorf("key %q has no value (cannot end with ,)", key)
+	}
+	//last == '.'
+	inner, ok := values[key].(map[string]interface{})
+	if !ok {
+		inner = map[string]interface{}{}
+	}
+	err = p.key(inner)
+	if len(inner) == 0 {
+		return fmt.Errorf("key map %q has no value", key)
+	}
+	values[key] = inner
+	return err
+}
+
+//index parses list index, after '['
+func (p *setParser) index() (int, error) {
+	v, _, err := runesUntil(p.in, "]")
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("negative index %d", i)
+	}
+	return i, nil
+}
+
+//listItem parses path and value of item i of list, after ']'
+func (p *setParser) listItem(list []interface{}, i int) ([]interface{}, error) {
+	k, last, err := runesUntil(p.in, "[.=")
+	switch {
+	case len(k) > 0:
+		return list, fmt.Errorf("unexpected data at end of array index: %q", string(k))
+	case err != nil:
+		return list, err
+	case last == '=':
+		value, err := p.value()
+		return setIndex(list, i, value), err
+	case last == '[':
+		j, err := p.index()
+		if err != nil {
+			return list, fmt.Errorf("illegal index: %v", err)
+		}
+		var inner []interface{}
+		if i < len(list) {
+			inner, _ = list[i].([]interface{})
+		}
+		inner, err = p.listItem(inner, j)
+		return setIndex(list, i, inner), err
+	}
+	//last == '.'
+	var inner map[string]interface{}
+	if i < len(list) {
+		inner, _ = list[i].(map[string]interface{})
+	}
+	if inner == nil {
+		inner = map[string]interface{}{}
+	}
+	err = p.key(inner)
+	return setIndex(list, i, inner), err
+}
+
+//value parses value after '=', a list of form '{a,b}' or a single value
+func (p *setParser) value() (interface{}, error) {
+	list, err := p.list()
+	switch err {
+	case nil:
+		return list, nil
+	case io.EOF:
+		return "", err
+	case errNotList:
+		rs, _, err := runesUntil(p.in, ",")
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		value, convErr := p.convert(rs)
+		if convErr != nil {
+			return nil, convErr
+		}
+		return value, err
+	}
+	return nil, err
+}
+
+func (p *setParser) list() ([]interface{}, error) {
+	r, _, err := p.in.ReadRune()
+	if err != nil {
+		return nil, err
+	}
+	if r != '{' {
+		p.in.UnreadRune()
+		return nil, errNotList
+	}
+	list := []interface{}{}
+	for {
+		rs, last, err := runesUntil(p.in, ",}")
+		if err == io.EOF {
+			return list, errors.New("list must terminate with '}'")
+		} else if err != nil {
+			return list, err
+		}
+		value, err := p.convert(rs)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, value)
+		if last == '}' {
+			//consume ',' following the list
+			if r, _, err := p.in.ReadRune(); err == nil && r != ',' {
+				p.in.UnreadRune()
+			}
+			return list, nil
+		}
+	}
+}
+
+//runesUntil reads runes until one of stop, which is returned as last, '\' escapes the next rune
+func runesUntil(in io.RuneReader, stop string) ([]rune, rune, error) {
+	v := []rune{}
+	for {
+		r, _, err := in.ReadRune()
+		switch {
+		case err != nil:
+			return v, r, err
+		case strings.ContainsRune(stop, r):
+			return v, r, nil
+		case r == '\\':
+			next, _, err := in.ReadRune()
+			if err != nil {
+				return v, next, err
+			}
+			v = append(v, next)
+		default:
+			v = append(v, r)
+		}
+	}
+}
+
+func setIndex(list []interface{}, i int, value interface{}) []interface{} {
+	for len(list) <= i {
+		list = append(list, nil)
+	}
+	list[i] = value
+	return list
+}
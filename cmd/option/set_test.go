@@ -0,0 +1,47 @@
+package option
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSetValues(t *testing.T) {
+	defer func(set []string) { OptionSetValues = set }(OptionSetValues)
+	OptionSetValues = []string{`a.b=1,c[1]=x,d={y,z}`, `e\.f=true`}
+	values, err := parseSetValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a":   map[string]interface{}{"b": int64(1)},
+		"c":   []interface{}{nil, "x"},
+		"d":   []interface{}{"y", "z"},
+		"e.f": true,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+	for _, illegal := range []string{"=b", "a=1,=b", ".a=1", "[0]=x", "a.=1", "a", "a=1,,b=2"} {
+		OptionSetValues = []string{illegal}
+		if _, err := parseSetValues(); err == nil {
+			t.Errorf("%q accepted", illegal)
+		}
+	}
+}
+
+func TestDecorateValuesKeepsSetValues(t *testing.T) {
+	defer func(values map[string]interface{}) { parsedSetValues = values }(parsedSetValues)
+	parsedSetValues = map[string]interface{}{"db": map[string]interface{}{"host": "x"}}
+	for i := 0; i < 2; i++ {
+		values, err := decorateValues(nil, nil, [][]byte{[]byte("db: {password: secret}")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db := values["db"].(map[string]interface{}); db["host"] != "x" || db["password"] != "secret" {
+			t.Errorf("unexpected values %v", values)
+		}
+	}
+	if expected := map[string]interface{}{"db": map[string]interface{}{"host": "x"}}; !reflect.DeepEqual(parsedSetValues, expected) {
+		t.Errorf("set values changed to %v", parsedSetValues)
+	}
+}
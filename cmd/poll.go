@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+//chartPoller re-resolves moving chart refs (eg. git branches) of resources periodically,
+//and triggers an upgrade of resources whose chart moved
+type chartPoller struct {
+	lock    sync.Mutex
+	tracked map[string]*polledChart
+}
+
+type polledChart struct {
+	resource *v1alpha1.HelmApp
+	revision string
+	resolve  func() (string, bool, error)
+}
+
+func newChartPoller() *chartPoller {
+	return &chartPoller{tracked: map[string]*polledChart{}}
+}
+
+func pollKey(r *v1alpha1.HelmApp) string {
+	return r.GetObjectKind().GroupVersionKind().String() + "/" + resourceKey(r)
+}
+
+//chartTracker tracks moving chart of resource on every event
+type chartTracker interface {
+	TrackChart(r *v1alpha1.HelmApp)
+}
+
+//Track polls chart of r resolved to revision, resolve returns the current revision and false once the ref turns out not to move
+func (p *chartPoller) Track(r *v1alpha1.HelmApp, revision string, resolve func() (string, bool, error)) {
+	resource := &v1alpha1.HelmApp{TypeMeta: r.TypeMeta}
+	resource.SetNamespace(r.GetNamespace())
+	resource.SetName(r.GetName())
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.tracked[pollKey(r)] = &polledChart{resource, revision, resolve}
+}
+
+//Tracked whether chart of r is polled
+func (p *chartPoller) Tracked(r *v1alpha1.HelmApp) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.tracked[pollKey(r)]
+	return ok
+}
+
+//Untrack stops polling chart of r
+func (p *chartPoller) Untrack(r *v1alpha1.HelmApp) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.tracked, pollKey(r))
+}
+
+//Run polls every interval until ctx done
+func (p *chartPoller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.poll()
+		}
+	}
+}
+
+func (p *chartPoller) poll() {
+	p.lock.Lock()
+	tracked := map[string]*polledChart{}
+	for key, polled := range p.tracked {
+		tracked[key] = polled
+	}
+	p.lock.Unlock()
+	for key, polled := range tracked {
+		logger := resourceLogger(polled.resource, "poll")
+		revision, moving, err := polled.resolve()
+		if err != nil {
+			logger.Warnf("failed to resolve chart: %v", err)
+			continue
+		}
+		if !moving {
+			p.untrack(key, polled)
+		}
+		p.lock.Lock()
+		unchanged := revision == polled.revision
+		p.lock.Unlock()
+		if unchanged {
+			continue
+		}
+		logger.Printf("chart moved from %s to %s", polled.revision, revision)
+		if err := touchChartRevision(polled.resource, revision); err != nil {
+			if apierrors.IsNotFound(err) {
+				p.untrack(key, polled)
+				continue
+			}
+			logger.Errorf("failed to trigger upgrade: %v", err)
+			continue
+		}
+		p.lock.Lock()
+		polled.revision = revision
+		p.lock.Unlock()
+	}
+}
+
+//untrack stops polling key, unless tracked again meanwhile
+func (p *chartPoller) untrack(key string, polled *polledChart) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.tracked[key] == polled {
+		delete(p.tracked, key)
+	}
+}
+
+//touchChartRevision sets chart-revision option of resource, which changes its checksum and triggers an upgrade
+func touchChartRevision(resource *v1alpha1.HelmApp, revision string) error {
+	r := &v1alpha1.HelmApp{TypeMeta: resource.TypeMeta}
+	r.SetNamespace(resource.GetNamespace())
+	r.SetName(resource.GetName())
+	if err := sdk.Get(r); err != nil {
+		return err
+	}
+	annotations, name := r.GetAnnotations(), helmext.OptionAnnotation(r, helmext.OptionChartRevision)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if annotations[name] == revision {
+		return nil
+	}
+	annotations[name] = revision
+	r.SetAnnotations(annotations)
+	return sdk.Update(r)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPollUntracksFixedRefs(t *testing.T) {
+	poller := newChartPoller()
+	branch, tag := testResource(nil), testResource(nil)
+	tag.SetName("tag")
+	poller.Track(branch, "a", func() (string, bool, error) {
+		return "a", true, nil
+	})
+	poller.Track(tag, "b", func() (string, bool, error) {
+		return "b", false, nil
+	})
+	poller.poll()
+	if !poller.Tracked(branch) {
+		t.Errorf("branch untracked")
+	}
+	if poller.Tracked(tag) {
+		t.Errorf("tag still tracked")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/ghodss/yaml"
+	rbacv1beta1 "k8s.io/api/rbac/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/helm/pkg/releaseutil"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+//clusterScopedKinds kinds of cluster-scoped objects, other kinds are taken as namespaced
+var clusterScopedKinds = map[string]bool{
+	"Namespace":                      true,
+	"Node":                           true,
+	"PersistentVolume":               true,
+	"ComponentStatus":                true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"CustomResourceDefinition":       true,
+	"APIService":                     true,
+	"StorageClass":                   true,
+	"VolumeAttachment":               true,
+	"PriorityClass":                  true,
+	"PodSecurityPolicy":              true,
+	"CertificateSigningRequest":      true,
+	"MutatingWebhookConfiguration":   true,
+	"ValidatingWebhookConfiguration": true,
+	"InitializerConfiguration":       true,
+	"IngressClass":                   true,
+	"RuntimeClass":                   true,
+	"CSIDriver":                      true,
+	"CSINode":                        true,
+	"FlowSchema":                     true,
+	"PriorityLevelConfiguration":     true,
+}
+
+//clusterScoped whether objects of kind are cluster-scoped: built-in kinds, kinds of --cluster-kinds ('<Kind>' or '<Kind>.<group>'),
+//and kinds of cluster-scoped CustomResourceDefinitions rendered from charts
+func clusterScoped(gvk schema.GroupVersionKind, crdKinds map[schema.GroupKind]bool) bool {
+	if clusterScopedKinds[gvk.Kind] || crdKinds[gvk.GroupKind()] {
+		return true
+	}
+	for _, kind := range option.OptionClusterKinds {
+		if kind == gvk.Kind || kind == gvk.Kind+"."+gvk.Group {
+			return true
+		}
+	}
+	return false
+}
+
+//writeRBAC writes least-privilege Role (or ClusterRole with --all-namespaces) and bindings of operator, covering
+//its own needs and every kind rendered from charts, hooks included
+func writeRBAC(out io.Writer) error {
+	rules, clusterRules, err := chartRules()
+	if err != nil {
+		return err
+	}
+	for _, object := range rbacManifests(option.OptionOperatorName, option.OptionNamespace, rules, clusterRules, "") {
+		data, err := manifestYAML(object)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "---\n%s\n", data)
+	}
+	return nil
+}
+
+//chartRules rules of operator itself and of kinds rendered from charts, namespaced and cluster-scoped.
+//Roles of charts are granted by holding their rules, bind and escalate only with --escalate
+func chartRules() ([]rbacv1beta1.PolicyRule, []rbacv1beta1.PolicyRule, error) {
+	kinds, roles, err := chartKinds()
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, clusterRules := operatorRules(), []rbacv1beta1.PolicyRule{}
+	for _, rule := range append(kindRules(kinds, roles.crdKinds), roles.rules()...) {
+		if rule.cluster {
+			clusterRules = append(clusterRules, rule.PolicyRule)
+		} else {
+			rules = append(rules, rule.PolicyRule)
+		}
+	}
+	if option.OptionRBACEscalate {
+		logger.Warnf("granted bind and escalate of %s, operator can grant any permission through roles of charts", rbacv1beta1.GroupName)
+	} else {
+		for _, name := range roles.aggregated {
+			logger.Warnf("rules of aggregated ClusterRole %s are not known, creating it needs --escalate", name)
+		}
+	}
+	return rules, clusterRules, nil
+}
+
+//chartKinds kinds and roles of objects rendered from chart of each operator with default values (--values and --set),
+//and from resources of --sample files
+func chartKinds() (map[schema.GroupVersionKind]bool, *chartRoles, error) {
+	objects, err := loadFileObjects(option.OptionValuesObjects, option.OptionNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	installers, resources := map[schema.GroupVersionKind]helmext.Installer{}, []*v1alpha1.HelmApp{}
+	for _, op := range option.Operators {
+		installer, err := helmext.NewOfflineInstaller(op.Chart, option.OptionKubeVersion, option.OptionAPIVersions,
+			installerBehavior{op, objects, option.NewChartCache(), newChartPoller(), newChartWatcher()})
+		if err != nil {
+			return nil, nil, err
+		}
+		installers[schema.FromAPIVersionAndKind(op.APIVersion, op.CRDKind)] = installer
+		r := &v1alpha1.HelmApp{TypeMeta: metav1.TypeMeta{APIVersion: op.APIVersion, Kind: op.CRDKind}, Spec: v1alpha1.HelmAppSpec{}}
+		r.SetNamespace(option.OptionNamespace)
+		r.SetName(op.CRDSingular)
+		resources = append(resources, r)
+	}
+	for _, file := range option.OptionRBACSamples {
+		manifests, err := readManifests(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, manifest := range manifests {
+			r, _, err := parseResource(manifest, installers)
+			if err != nil {
+				return nil, nil, err
+			}
+			resources = append(resources, r)
+		}
+	}
+	kinds, roles := map[schema.GroupVersionKind]bool{}, newChartRoles()
+	for _, r := range resources {
+		release, err := installers[r.GroupVersionKind()].DryRunRelease(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", resourceKey(r), err)
+		}
+		manifests := []string{release.GetManifest()}
+		for _, hook := range release.GetHooks() {
+			manifests = append(manifests, hook.GetManifest())
+		}
+		for _, manifest := range manifests {
+			if err := collectKinds(manifest, kinds, roles); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", resourceKey(r), err)
+			}
+		}
+	}
+	return kinds, roles, nil
+}
+
+//collectKinds kinds of objects in manifests, items of lists included, and roles of RBAC objects
+func collectKinds(manifests string, kinds map[schema.GroupVersionKind]bool, roles *chartRoles) error {
+	for _, manifest := range releaseutil.SplitManifests(manifests) {
+		if err := collectObject([]byte(manifest), kinds, roles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectObject(data []byte, kinds map[schema.GroupVersionKind]bool, roles *chartRoles) error {
+	object := struct {
+		metav1.TypeMeta `json:",inline"`
+		Items           []json.RawMessage `json:"items"`
+	}{}
+	if err := yaml.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if object.Kind == "" {
+		return nil
+	}
+	if strings.HasSuffix(object.Kind, "List") && object.Items != nil {
+		for _, item := range object.Items {
+			if err := collectObject(item, kinds, roles); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	kinds[object.GroupVersionKind()] = true
+	switch object.GroupVersionKind().GroupKind() {
+	case schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}:
+		return roles.collectCRD(data)
+	}
+	if object.GroupVersionKind().Group == rbacv1beta1.GroupName {
+		return roles.collect(object.Kind, data)
+	}
+	return nil
+}
+
+type roleRef struct {
+	kind    string
+	name    string
+	cluster bool
+}
+
+//chartRoles Roles and ClusterRoles rendered from charts, whose rules operator holds to create them and bind them,
+//and roles not rendered but referred by bindings, which operator binds by name. Kinds of cluster-scoped
+//CustomResourceDefinitions rendered are recorded as well, for the scope of their objects
+type chartRoles struct {
+	roleRules    []rbacv1beta1.PolicyRule
+	clusterRules []rbacv1beta1.PolicyRule
+	rendered     map[string]bool
+	refs         map[roleRef]bool
+	aggregated   []string
+	crdKinds     map[schema.GroupKind]bool
+}
+
+func newChartRoles() *chartRoles {
+	return &chartRoles{rendered: map[string]bool{}, refs: map[roleRef]bool{}, crdKinds: map[schema.GroupKind]bool{}}
+}
+
+func (r *chartRoles) collectCRD(data []byte) error {
+	crd := struct {
+		Spec struct {
+			Group string `json:"group"`
+			Scope string `json:"scope"`
+			Names struct {
+				Kind string `json:"kind"`
+			} `json:"names"`
+		} `json:"spec"`
+	}{}
+	if err := yaml.Unmarshal(data, &crd); err != nil {
+		return fmt.Errorf("failed to parse CustomResourceDefinition: %v", err)
+	}
+	if crd.Spec.Scope == "Cluster" {
+		r.crdKinds[schema.GroupKind{Group: crd.Spec.Group, Kind: crd.Spec.Names.Kind}] = true
+	}
+	return nil
+}
+
+func (r *chartRoles) collect(kind string, data []byte) error {
+	switch kind {
+	case "Role", "ClusterRole":
+		role := rbacv1beta1.ClusterRole{}
+		if err := yaml.Unmarshal(data, &role); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", kind, err)
+		}
+		r.rendered[kind+"/"+role.GetName()] = true
+		if kind == "Role" {
+			r.roleRules = append(r.roleRules, role.Rules...)
+			return nil
+		}
+		r.clusterRules = append(r.clusterRules, role.Rules...)
+		if role.AggregationRule != nil {
+			r.aggregated = append(r.aggregated, role.GetName())
+		}
+	case "RoleBinding", "ClusterRoleBinding":
+		binding := rbacv1beta1.RoleBinding{}
+		if err := yaml.Unmarshal(data, &binding); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", kind, err)
+		}
+		r.refs[roleRef{binding.RoleRef.Kind, binding.RoleRef.Name, kind == "ClusterRoleBinding"}] = true
+	}
+	return nil
+}
+
+//rules of rendered roles, and bind of roles referred but not rendered
+func (r *chartRoles) rules() []kindRule {
+	rules := []kindRule{}
+	for _, rule := range r.roleRules {
+		rules = append(rules, kindRule{rule, false})
+	}
+	for _, rule := range r.clusterRules {
+		rules = append(rules, kindRule{rule, true})
+	}
+	refs := []roleRef{}
+	for ref := range r.refs {
+		if !r.rendered[ref.kind+"/"+ref.name] {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return fmt.Sprint(refs[i]) < fmt.Sprint(refs[j])
+	})
+	for _, ref := range refs {
+		resource := "roles"
+		if ref.kind == "ClusterRole" {
+			resource = "clusterroles"
+		}
+		rules = append(rules, kindRule{rbacv1beta1.PolicyRule{
+			APIGroups:     []string{rbacv1beta1.GroupName},
+			Resources:     []string{resource},
+			ResourceNames: []string{ref.name},
+			Verbs:         []string{"bind"},
+		}, ref.cluster})
+	}
+	return rules
+}
+
+type kindRule struct {
+	rbacv1beta1.PolicyRule
+	cluster bool
+}
+
+//kindRules rules of kinds, one per API group and scope, resources guessed from kinds, scope of crdKinds
+//cluster-scoped as well. RBAC kinds get bind and escalate with --escalate
+func kindRules(kinds map[schema.GroupVersionKind]bool, crdKinds map[schema.GroupKind]bool) []kindRule {
+	type groupScope struct {
+		group   string
+		cluster bool
+	}
+	resources, names := map[groupScope]map[string]bool{}, []string{}
+	for gvk := range kinds {
+		names = append(names, gvk.String())
+		plural, _ := meta.UnsafeGuessKindToResource(gvk)
+		key := groupScope{gvk.Group, clusterScoped(gvk, crdKinds)}
+		if resources[key] == nil {
+			resources[key] = map[string]bool{}
+		}
+		resources[key][plural.Resource] = true
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logger.Printf("chart kind: %s", name)
+	}
+	keys := []groupScope{}
+	for key := range resources {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cluster != keys[j].cluster {
+			return !keys[i].cluster
+		}
+		return keys[i].group < keys[j].group
+	})
+	rules := []kindRule{}
+	for _, key := range keys {
+		rule := kindRule{rbacv1beta1.PolicyRule{APIGroups: []string{key.group}, Verbs: allVerbs}, key.cluster}
+		for resource := range resources[key] {
+			rule.Resources = append(rule.Resources, resource)
+		}
+		sort.Strings(rule.Resources)
+		if key.group == rbacv1beta1.GroupName && option.OptionRBACEscalate {
+			rule.Verbs = append(append([]string{}, allVerbs...), "bind", "escalate")
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
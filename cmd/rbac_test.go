@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	rbacv1beta1 "k8s.io/api/rbac/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+)
+
+const testRBACManifests = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: redis
+rules:
+- apiGroups: [""]
+  resources: [configmaps]
+  verbs: [get]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: redis
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: redis
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: rbac.authorization.k8s.io/v1
+  kind: ClusterRoleBinding
+  metadata:
+    name: redis-view
+  roleRef:
+    apiGroup: rbac.authorization.k8s.io
+    kind: ClusterRole
+    name: view
+`
+
+func TestChartRoles(t *testing.T) {
+	kinds, roles := map[schema.GroupVersionKind]bool{}, newChartRoles()
+	if err := collectKinds(testRBACManifests, kinds, roles); err != nil {
+		t.Fatal(err)
+	}
+	if !kinds[schema.GroupVersionKind{Group: rbacv1beta1.GroupName, Version: "v1", Kind: "ClusterRoleBinding"}] {
+		t.Errorf("kind of list item not collected: %v", kinds)
+	}
+	expected := []kindRule{
+		{rbacv1beta1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}, false},
+		{rbacv1beta1.PolicyRule{APIGroups: []string{rbacv1beta1.GroupName}, Resources: []string{"clusterroles"}, ResourceNames: []string{"view"}, Verbs: []string{"bind"}}, true},
+	}
+	if actual := roles.rules(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestKindRulesWithoutEscalate(t *testing.T) {
+	logger = option.NewLogger("test")
+	for _, rule := range kindRules(map[schema.GroupVersionKind]bool{{Group: rbacv1beta1.GroupName, Version: "v1", Kind: "Role"}: true}, nil) {
+		for _, verb := range rule.Verbs {
+			if verb == "bind" || verb == "escalate" {
+				t.Errorf("%s granted without --escalate", verb)
+			}
+		}
+	}
+}
+
+func TestKindRulesClusterScope(t *testing.T) {
+	logger = option.NewLogger("test")
+	defer func(kinds []string) { option.OptionClusterKinds = kinds }(option.OptionClusterKinds)
+	option.OptionClusterKinds = []string{"ClusterIssuer.cert-manager.io"}
+	kinds, roles := map[schema.GroupVersionKind]bool{}, newChartRoles()
+	if err := collectKinds(`apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  scope: Cluster
+  names:
+    kind: Widget
+---
+apiVersion: example.com/v1
+kind: Widget
+---
+apiVersion: cert-manager.io/v1
+kind: ClusterIssuer
+---
+apiVersion: cert-manager.io/v1
+kind: Issuer
+---
+apiVersion: networking.k8s.io/v1
+kind: IngressClass
+`, kinds, roles); err != nil {
+		t.Fatal(err)
+	}
+	scopes := map[string]bool{}
+	for _, rule := range kindRules(kinds, roles.crdKinds) {
+		for _, resource := range rule.Resources {
+			scopes[resource] = rule.cluster
+		}
+	}
+	expected := map[string]bool{"customresourcedefinitions": true, "widgets": true, "clusterissuers": true, "issuers": false, "ingressclasses": true}
+	if !reflect.DeepEqual(scopes, expected) {
+		t.Errorf("expected scopes %v, got %v", expected, scopes)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
+	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/storage"
+	"k8s.io/helm/pkg/timeconv"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/charts"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+//getResource gets resource of the first kind in --namespace
+func getResource(name string) (*v1alpha1.HelmApp, error) {
+	op := option.Operators[0]
+	r := &v1alpha1.HelmApp{TypeMeta: metav1.TypeMeta{APIVersion: op.APIVersion, Kind: op.CRDKind}}
+	r.SetNamespace(option.OptionNamespace)
+	r.SetName(name)
+	return r, sdk.Get(r)
+}
+
+//deployedRelease deployed release of resource in storage, or release of its status
+func deployedRelease(storageBackend *storage.Storage, r *v1alpha1.HelmApp) *release.Release {
+	if deployed, err := storageBackend.Deployed(helmext.ReleaseName(r)); err == nil {
+		return deployed
+	}
+	return r.Status.Release
+}
+
+func chartName(rel *release.Release) string {
+	metadata := rel.GetChart().GetMetadata()
+	if metadata == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s", metadata.GetName(), metadata.GetVersion())
+}
+
+//showStatus writes phase, release and readiness of released objects of resource
+func showStatus(name string, out io.Writer) error {
+	r, err := getResource(name)
+	if err != nil {
+		return err
+	}
+	storageBackend, err := option.GetStorageBackend()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	status := r.Status
+	fmt.Fprintf(w, "NAME:\t%s\n", resourceKey(r))
+	fmt.Fprintf(w, "PHASE:\t%s\n", status.Phase)
+	if status.Reason != "" {
+		fmt.Fprintf(w, "REASON:\t%s\n", status.Reason)
+	}
+	if status.Message != "" {
+		fmt.Fprintf(w, "MESSAGE:\t%s\n", status.Message)
+	}
+	if !status.LastTransitionTime.IsZero() {
+		fmt.Fprintf(w, "LAST TRANSITION:\t%s\n", status.LastTransitionTime.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "RELEASE:\t%s\n", helmext.ReleaseName(r))
+	rel := deployedRelease(storageBackend, r)
+	if rel == nil {
+		return nil
+	}
+	fmt.Fprintf(w, "REVISION:\t%d\n", rel.GetVersion())
+	fmt.Fprintf(w, "CHART:\t%s\n", chartName(rel))
+	if status.Chart != nil && status.Chart.Source != "" {
+		fmt.Fprintf(w, "CHART SOURCE:\t%s\n", status.Chart.Source)
+	}
+	objects, err := manifestObjects(rel.GetManifest(), r.GetNamespace())
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "\nKIND\tNAME\tREADY\tSTATUS\n")
+	for _, key := range keys {
+		o := &unstructured.Unstructured{Object: objects[key]}
+		namespace := o.GetNamespace()
+		if namespace == "" {
+			namespace = r.GetNamespace()
+		}
+		ready, detail := objectReadiness(o.GetAPIVersion(), o.GetKind(), namespace, o.GetName())
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", o.GetKind(), o.GetName(), ready, detail)
+	}
+	return nil
+}
+
+//objectReadiness whether live object of released manifest is ready, with a short status
+func objectReadiness(apiVersion string, kind string, namespace string, name string) (bool, string) {
+	client, _, err := k8sclient.GetResourceClient(apiVersion, kind, namespace)
+	if err != nil {
+		return false, err.Error()
+	}
+	o, err := client.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, "Missing"
+	} else if err != nil {
+		return false, err.Error()
+	}
+	nestedInt := func(defaultVal int64, fields ...string) int64 {
+		if v, found, err := unstructured.NestedInt64(o.Object, fields...); found && err == nil {
+			return v
+		}
+		return defaultVal
+	}
+	nestedString := func(fields ...string) string {
+		v, _, _ := unstructured.NestedString(o.Object, fields...)
+		return v
+	}
+	if generation, observed := o.GetGeneration(), nestedInt(-1, "status", "observedGeneration"); observed >= 0 && observed < generation {
+		return false, "Progressing"
+	}
+	switch kind {
+	case "Deployment", "StatefulSet", "ReplicaSet", "ReplicationController":
+		desired, ready := nestedInt(1, "spec", "replicas"), nestedInt(0, "status", "readyReplicas")
+		return ready >= desired, fmt.Sprintf("%d/%d replicas ready", ready, desired)
+	case "DaemonSet":
+		desired, ready := nestedInt(0, "status", "desiredNumberScheduled"), nestedInt(0, "status", "numberReady")
+		return ready >= desired, fmt.Sprintf("%d/%d pods ready", ready, desired)
+	case "Job":
+		completions, succeeded := nestedInt(1, "spec", "completions"), nestedInt(0, "status", "succeeded")
+		return succeeded >= completions, fmt.Sprintf("%d/%d completed", succeeded, completions)
+	case "Pod":
+		phase := nestedString("status", "phase")
+		if phase == "Succeeded" {
+			return true, phase
+		}
+		conditions, _, _ := unstructured.NestedSlice(o.Object, "status", "conditions")
+		for _, c := range conditions {
+			if condition, ok := c.(map[string]interface{}); ok && condition["type"] == "Ready" {
+				return condition["status"] == "True", phase
+			}
+		}
+		return false, phase
+	case "PersistentVolumeClaim":
+		phase := nestedString("status", "phase")
+		return phase == "Bound", phase
+	case "Service":
+		if nestedString("spec", "type") == "LoadBalancer" {
+			ingress, _, _ := unstructured.NestedSlice(o.Object, "status", "loadBalancer", "ingress")
+			if len(ingress) == 0 {
+				return false, "Pending load balancer"
+			}
+		}
+	}
+	return true, "Exists"
+}
+
+//showHistory writes revisions of release of resource in storage
+func showHistory(name string, out io.Writer) error {
+	r, err := getResource(name)
+	if apierrors.IsNotFound(err) {
+		//release of removed resource may still be in storage
+		logger.Warnf("resource %s not found", resourceKey(r))
+	} else if err != nil {
+		return err
+	}
+	storageBackend, err := option.GetStorageBackend()
+	if err != nil {
+		return err
+	}
+	releases, err := storageBackend.History(helmext.ReleaseName(r))
+	if err != nil {
+		return err
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].GetVersion() < releases[j].GetVersion()
+	})
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "REVISION\tUPDATED\tSTATUS\tCHART\tDESCRIPTION\n")
+	for _, rel := range releases {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", rel.GetVersion(), timeconv.Format(rel.GetInfo().GetLastDeployed(), time.RFC3339),
+			rel.GetInfo().GetStatus().GetCode(), chartName(rel), rel.GetInfo().GetDescription())
+	}
+	return nil
+}
+
+//rollbackResource rolls resource back to revision of its release through the operator: spec is replaced by the spec
+//recorded on the revision, chart pinned to the source revision of the revision if the chart source has revisions,
+//and rollback-revision option set
+func rollbackResource(name string, revision int) error {
+	r, err := getResource(name)
+	if err != nil {
+		return err
+	}
+	storageBackend, err := option.GetStorageBackend()
+	if err != nil {
+		return err
+	}
+	rel, err := storageBackend.Get(helmext.ReleaseName(r), int32(revision))
+	if err != nil {
+		return err
+	}
+	spec, chart, ok, err := helmext.RecordedResource(rel)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("spec of %s is not recorded on revision %d, roll back by editing the resource instead", resourceKey(r), revision)
+	}
+	r.Spec = spec
+	annotations := r.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[helmext.OptionAnnotation(r, helmext.OptionRollbackRevision)] = strconv.Itoa(revision)
+	if source, version, ok := pinnedChart(chart); ok {
+		annotations[helmext.OptionAnnotation(r, helmext.OptionChart)] = source
+		if version != "" {
+			annotations[helmext.OptionAnnotation(r, helmext.OptionChartVersion)] = version
+		} else {
+			delete(annotations, helmext.OptionAnnotation(r, helmext.OptionChartVersion))
+		}
+	} else if current := deployedRelease(storageBackend, r); current != nil && chartName(current) != chartName(rel) {
+		logger.Warnf("chart source of %s has no versions, chart %s of revision %d not pinned", resourceKey(r), chartName(rel), revision)
+	}
+	r.SetAnnotations(annotations)
+	if err := sdk.Update(r); err != nil {
+		return err
+	}
+	logger.Printf("%s rolling back to revision %d", resourceKey(r), revision)
+	return nil
+}
+
+//pinnedChart chart and chart-version options loading exactly the chart of status: git charts at the commit,
+//oci charts at the manifest digest and repository charts at the version, ok false for sources without revisions
+func pinnedChart(chart *v1alpha1.HelmAppChartStatus) (string, string, bool) {
+	switch {
+	case chart == nil:
+		return "", "", false
+	case charts.IsGitReference(chart.Source) && chart.Revision != "":
+		return chart.Source + "?ref=" + chart.Revision, "", true
+	case charts.IsOCIReference(chart.Source) && chart.Revision != "":
+		return chart.Source + "@" + chart.Revision, "", true
+	case chart.Version != "" && !charts.IsGitReference(chart.Source) && !charts.IsOCIReference(chart.Source):
+		return chart.Source, chart.Version, true
+	}
+	return "", "", false
+}
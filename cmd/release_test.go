@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func TestPinnedChart(t *testing.T) {
+	for _, c := range []struct {
+		chart   *v1alpha1.HelmAppChartStatus
+		source  string
+		version string
+		pinned  bool
+	}{
+		{&v1alpha1.HelmAppChartStatus{Source: "stable/redis", Version: "1.2.7"}, "stable/redis", "1.2.7", true},
+		{&v1alpha1.HelmAppChartStatus{Source: "git+https://git.example.com/charts.git//redis", Version: "main", Revision: "0123abc"},
+			"git+https://git.example.com/charts.git//redis?ref=0123abc", "", true},
+		{&v1alpha1.HelmAppChartStatus{Source: "oci://registry.example.com/charts/redis", Version: "1.2.3", Revision: "sha256:abc"},
+			"oci://registry.example.com/charts/redis@sha256:abc", "", true},
+		{&v1alpha1.HelmAppChartStatus{Source: "configmap://charts/redis.tgz", Digest: "sha256:abc", Revision: "42"}, "", "", false},
+		{&v1alpha1.HelmAppChartStatus{Source: "https://example.com/redis.tgz", Digest: "sha256:abc"}, "", "", false},
+		{nil, "", "", false},
+	} {
+		source, version, pinned := pinnedChart(c.chart)
+		if source != c.source || version != c.version || pinned != c.pinned {
+			t.Errorf("%+v: unexpected %q %q %v", c.chart, source, version, pinned)
+		}
+	}
+}
+
+func TestRecordedResourceMissing(t *testing.T) {
+	rel := &release.Release{Name: "test", Config: &cpb.Config{Raw: "password: secret\n"}}
+	if spec, _, ok, err := helmext.RecordedResource(rel); ok || err != nil || spec != nil {
+		t.Errorf("values taken as recorded spec: %v %v", spec, err)
+	}
+}
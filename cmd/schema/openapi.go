@@ -0,0 +1,150 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+)
+
+//OpenAPI converts schema to the OpenAPI v3 subset accepted by CRD validation: local '$ref' inlined,
+//'type' lists narrowed to a single non-null type, draft-06+ exclusive bounds converted to draft-04 form,
+//recursive '$ref' truncated to untyped values, and keywords rejected by the apiserver (definitions, patternProperties, uniqueItems, default) dropped.
+//'required' is dropped as well, since values absent from a resource are taken from chart defaults.
+func (s *Schema) OpenAPI() (*Schema, error) {
+	c := &openAPIConverter{validator{root: s}, map[string]bool{}}
+	return c.convert(s)
+}
+
+type openAPIConverter struct {
+	validator
+	//expanding '$ref' being inlined
+	expanding map[string]bool
+}
+
+func (c *openAPIConverter) convert(s *Schema) (*Schema, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if ref := s.Ref; ref != "" {
+		if c.expanding[ref] {
+			return &Schema{Description: s.Description}, nil
+		}
+		c.expanding[ref] = true
+		defer delete(c.expanding, ref)
+	}
+	s, err := c.resolve(s)
+	if err != nil {
+		return nil, err
+	}
+	out := &Schema{
+		Title:       s.Title,
+		Description: s.Description,
+		Enum:        s.Enum,
+		MinLength:   s.MinLength,
+		MaxLength:   s.MaxLength,
+		Pattern:     s.Pattern,
+		Format:      s.Format,
+		MinItems:    s.MinItems,
+		MaxItems:    s.MaxItems,
+	}
+	types := []string{}
+	for _, t := range s.Type {
+		if t != "null" {
+			types = append(types, t)
+		}
+	}
+	if len(types) == 1 {
+		out.Type = StringOrArray{types[0]}
+	}
+	out.Minimum, out.ExclusiveMinimum = openAPIBound(s.Minimum, s.ExclusiveMinimum, 1)
+	out.Maximum, out.ExclusiveMaximum = openAPIBound(s.Maximum, s.ExclusiveMaximum, -1)
+	if len(s.Properties) > 0 {
+		out.Properties = map[string]*Schema{}
+		for _, name := range sortedKeys(s.Properties) {
+			if out.Properties[name], err = c.convert(s.Properties[name]); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	} else if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		//properties and additionalProperties are mutually exclusive in CRD validation
+		sub, err := c.convert(s.AdditionalProperties.Schema)
+		if err != nil {
+			return nil, err
+		}
+		out.AdditionalProperties = &BoolOrSchema{true, sub}
+	}
+	if out.Items, err = c.convert(s.Items); err != nil {
+		return nil, err
+	}
+	for _, list := range []struct {
+		from []*Schema
+		to   *[]*Schema
+	}{{s.AllOf, &out.AllOf}, {s.AnyOf, &out.AnyOf}, {s.OneOf, &out.OneOf}} {
+		for _, sub := range list.from {
+			converted, err := c.convert(sub)
+			if err != nil {
+				return nil, err
+			}
+			*list.to = append(*list.to, converted)
+		}
+	}
+	if out.Not, err = c.convert(s.Not); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//openAPIBound draft-04 form of bound and exclusive bound, sign 1 for minimum and -1 for maximum
+func openAPIBound(bound *float64, exclusive *BoolOrNumber, sign float64) (*float64, *BoolOrNumber) {
+	if exclusive == nil || !exclusive.Exclusive {
+		return bound, nil
+	}
+	if exclusive.Number == nil {
+		if bound == nil {
+			return nil, nil
+		}
+		return bound, &BoolOrNumber{Exclusive: true}
+	}
+	if bound != nil && (*bound-*exclusive.Number)*sign > 0 {
+		//inclusive bound is tighter
+		return bound, nil
+	}
+	return exclusive.Number, &BoolOrNumber{Exclusive: true}
+}
+
+func sortedKeys(m map[string]*Schema) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Infer schema of value types, eg. of chart values.yaml. Objects accept undeclared keys,
+//arrays accept any items and null values any type, so that defaults only constrain types.
+func Infer(values interface{}) *Schema {
+	return infer(normalize(values))
+}
+
+func infer(values interface{}) *Schema {
+	switch value := values.(type) {
+	case map[string]interface{}:
+		s := &Schema{Type: StringOrArray{"object"}}
+		if len(value) > 0 {
+			s.Properties = map[string]*Schema{}
+			for k, v := range value {
+				s.Properties[k] = infer(v)
+			}
+		}
+		return s
+	case []interface{}:
+		return &Schema{Type: StringOrArray{"array"}}
+	case string:
+		return &Schema{Type: StringOrArray{"string"}}
+	case bool:
+		return &Schema{Type: StringOrArray{"boolean"}}
+	case float64:
+		return &Schema{Type: StringOrArray{"number"}}
+	}
+	return &Schema{}
+}
@@ -0,0 +1,96 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+func TestOpenAPI(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		schema   string
+		expected string
+	}{
+		{"nullable type narrowed", `{type: [string, "null"]}`,
+			`{"type":"string"}`},
+		{"type list dropped", `{type: [string, integer]}`,
+			`{}`},
+		{"required and default dropped", `{type: object, required: [a], properties: {a: {type: string, default: x}}}`,
+			`{"type":"object","properties":{"a":{"type":"string"}}}`},
+		{"unsupported keywords dropped", `{patternProperties: {"^x-": {type: string}}, definitions: {a: {}}, items: {type: string}, uniqueItems: true}`,
+			`{"items":{"type":"string"}}`},
+		{"additionalProperties schema kept", `{type: object, additionalProperties: {type: integer}}`,
+			`{"type":"object","additionalProperties":{"type":"integer"}}`},
+		{"additionalProperties dropped with properties", `{properties: {a: {}}, additionalProperties: {type: integer}}`,
+			`{"properties":{"a":{}}}`},
+		{"additionalProperties false dropped", `{additionalProperties: false}`,
+			`{}`},
+		{"$ref inlined", `{definitions: {port: {type: integer, maximum: 65535}}, properties: {port: {$ref: "#/definitions/port"}}}`,
+			`{"properties":{"port":{"type":"integer","maximum":65535}}}`},
+		{"recursive $ref truncated", `{definitions: {node: {type: object, properties: {child: {$ref: "#/definitions/node"}}}}, properties: {root: {$ref: "#/definitions/node"}}}`,
+			`{"properties":{"root":{"type":"object","properties":{"child":{}}}}}`},
+		{"exclusiveMinimum number", `{exclusiveMinimum: 1}`,
+			`{"minimum":1,"exclusiveMinimum":true}`},
+		{"exclusiveMaximum number tighter", `{maximum: 10, exclusiveMaximum: 5}`,
+			`{"maximum":5,"exclusiveMaximum":true}`},
+		{"maximum tighter", `{maximum: 5, exclusiveMaximum: 10}`,
+			`{"maximum":5}`},
+		{"exclusive bool kept", `{minimum: 1, exclusiveMinimum: true}`,
+			`{"minimum":1,"exclusiveMinimum":true}`},
+		{"exclusive bool without bound dropped", `{exclusiveMaximum: true}`,
+			`{}`},
+		{"combinators converted", `{oneOf: [{type: [integer, "null"]}, {$ref: "#/$defs/s"}], not: {enum: [x]}, $defs: {s: {type: string}}}`,
+			`{"oneOf":[{"type":"integer"},{"type":"string"}],"not":{"enum":["x"]}}`},
+	} {
+		s, err := Parse([]byte(c.schema))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		converted, err := s.OpenAPI()
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if actual := testJSON(t, converted); actual != testJSON(t, c.expected) {
+			t.Errorf("%s: expected %s, got %s", c.name, testJSON(t, c.expected), actual)
+		}
+	}
+	s, _ := Parse([]byte(`{properties: {a: {$ref: "#/definitions/missing"}}}`))
+	if _, err := s.OpenAPI(); err == nil {
+		t.Error("missing $ref converted")
+	}
+}
+
+//testJSON canonical JSON of schema or JSON text
+func testJSON(t *testing.T, value interface{}) string {
+	data, ok := value.(string)
+	if !ok {
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = string(bytes)
+	}
+	var out interface{}
+	if err := yaml.Unmarshal([]byte(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bytes)
+}
+
+func TestInfer(t *testing.T) {
+	s := Infer(map[string]interface{}{"replicas": 1, "image": map[string]interface{}{"tag": "latest"}, "args": []string{}, "extra": nil})
+	if err := s.Validate(testValues(t, `{replicas: 2, image: {tag: v1, pullPolicy: Always}, args: [1], extra: {a: 1}, other: x}`), false); err != nil {
+		t.Errorf("values of inferred types rejected: %v", err)
+	}
+	if err := s.Validate(testValues(t, `{replicas: "2", image: {tag: 1}}`), false); err == nil {
+		t.Error("values of mismatched types accepted")
+	}
+}
@@ -0,0 +1,474 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+//Schema JSON schema of values, the subset of draft-07 used by chart values.schema.json
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 StringOrArray      `json:"type,omitempty"`
+	Default              interface{}        `json:"default,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	PatternProperties    map[string]*Schema `json:"patternProperties,omitempty"`
+	AdditionalProperties *BoolOrSchema      `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     *BoolOrNumber      `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     *BoolOrNumber      `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int64             `json:"minLength,omitempty"`
+	MaxLength            *int64             `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	MinItems             *int64             `json:"minItems,omitempty"`
+	MaxItems             *int64             `json:"maxItems,omitempty"`
+	UniqueItems          bool               `json:"uniqueItems,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Not                  *Schema            `json:"not,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+}
+
+//StringOrArray 'type' of a single type name or list of names
+type StringOrArray []string
+
+//UnmarshalJSON accepts string or array of strings
+func (s *StringOrArray) UnmarshalJSON(data []byte) error {
+	single := ""
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = StringOrArray{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+//MarshalJSON single type as string
+func (s StringOrArray) MarshalJSON() ([]byte, error) {
+	if len(s) == 1 {
+		return json.Marshal(s[0])
+	}
+	return json.Marshal([]string(s))
+}
+
+//BoolOrSchema 'additionalProperties' of bool or schema
+type BoolOrSchema struct {
+	Allows bool
+	Schema *Schema
+}
+
+//UnmarshalJSON accepts bool or schema
+func (b *BoolOrSchema) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &b.Allows); err == nil {
+		return nil
+	}
+	b.Allows, b.Schema = true, &Schema{}
+	return json.Unmarshal(data, b.Schema)
+}
+
+//MarshalJSON bool if no schema
+func (b BoolOrSchema) MarshalJSON() ([]byte, error) {
+	if b.Schema != nil {
+		return json.Marshal(b.Schema)
+	}
+	return json.Marshal(b.Allows)
+}
+
+//BoolOrNumber 'exclusiveMinimum'/'exclusiveMaximum' of bool (draft-04) or number (draft-06+)
+type BoolOrNumber struct {
+	Exclusive bool
+	Number    *float64
+}
+
+//UnmarshalJSON accepts bool or number
+func (b *BoolOrNumber) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &b.Exclusive); err == nil {
+		return nil
+	}
+	b.Exclusive = true
+	return json.Unmarshal(data, &b.Number)
+}
+
+//MarshalJSON bool if no number
+func (b BoolOrNumber) MarshalJSON() ([]byte, error) {
+	if b.Number != nil {
+		return json.Marshal(*b.Number)
+	}
+	return json.Marshal(b.Exclusive)
+}
+
+//Parse parses schema of JSON or YAML
+func Parse(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse values schema: %v", err)
+	}
+	return s, nil
+}
+
+//Violation value at path violating schema
+type Violation struct {
+	Path    string
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return fmt.Sprintf("%s: %s", v.Path, v.Message)
+}
+
+//ValidationError values violating schema
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, v := range e.Violations {
+		messages = append(messages, v.String())
+	}
+	return fmt.Sprintf("values invalid: %s", strings.Join(messages, "; "))
+}
+
+//IsValidationError whether err is a ValidationError
+func IsValidationError(err error) bool {
+	_, ok := err.(*ValidationError)
+	return ok
+}
+
+//Validate values against schema, strict rejects keys not declared in properties of object schemas
+//without additionalProperties. Returns a ValidationError listing each violating path.
+func (s *Schema) Validate(values map[string]interface{}, strict bool) error {
+	v := &validator{root: s, strict: strict}
+	v.validate(s, "", normalize(values))
+	if len(v.violations) > 0 {
+		sort.SliceStable(v.violations, func(i, j int) bool {
+			return v.violations[i].Path < v.violations[j].Path
+		})
+		return &ValidationError{v.violations}
+	}
+	return nil
+}
+
+//normalize values to JSON types
+func normalize(values interface{}) interface{} {
+	bytes, err := json.Marshal(values)
+	if err != nil {
+		return values
+	}
+	var out interface{}
+	if err := json.Unmarshal(bytes, &out); err != nil {
+		return values
+	}
+	return out
+}
+
+type validator struct {
+	root       *Schema
+	strict     bool
+	violations []Violation
+	depth      int
+}
+
+func (v *validator) fail(path string, format string, args ...interface{}) {
+	v.violations = append(v.violations, Violation{path, fmt.Sprintf(format, args...)})
+}
+
+//resolve local '$ref' of '#/definitions/<name>', '#/$defs/<name>' or '#'
+func (v *validator) resolve(s *Schema) (*Schema, error) {
+	for i := 0; s.Ref != "" && i < 32; i++ {
+		ref := s.Ref
+		switch {
+		case ref == "#":
+			s = v.root
+		case strings.HasPrefix(ref, "#/definitions/"):
+			s = v.root.Definitions[strings.TrimPrefix(ref, "#/definitions/")]
+		case strings.HasPrefix(ref, "#/$defs/"):
+			s = v.root.Defs[strings.TrimPrefix(ref, "#/$defs/")]
+		default:
+			return nil, fmt.Errorf("unsupported $ref %q", ref)
+		}
+		if s == nil {
+			return nil, fmt.Errorf("$ref %q not found", ref)
+		}
+	}
+	if s.Ref != "" {
+		return nil, fmt.Errorf("$ref %q refers to itself", s.Ref)
+	}
+	return s, nil
+}
+
+func childPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+//check whether value is valid against s, without recording violations
+func (v *validator) check(s *Schema, path string, value interface{}) bool {
+	sub := &validator{root: v.root, strict: v.strict, depth: v.depth}
+	sub.validate(s, path, value)
+	return len(sub.violations) == 0
+}
+
+func (v *validator) validate(s *Schema, path string, value interface{}) {
+	if v.depth > 64 {
+		v.fail(path, "schema nested too deep")
+		return
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+	s, err := v.resolve(s)
+	if err != nil {
+		v.fail(path, "%v", err)
+		return
+	}
+
+	if len(s.Type) > 0 && !matchesType(s.Type, value) {
+		v.fail(path, "expected %s, got %s", strings.Join(s.Type, " or "), typeName(value))
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(normalize(e), value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "must be one of %s", jsonString(s.Enum))
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		v.validate(sub, path, value)
+	}
+	if len(s.AnyOf) > 0 {
+		valid := false
+		for _, sub := range s.AnyOf {
+			if v.check(sub, path, value) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			v.fail(path, "does not match any of anyOf schemas")
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matched := 0
+		for _, sub := range s.OneOf {
+			if v.check(sub, path, value) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(path, "must match exactly one of oneOf schemas, matched %d", matched)
+		}
+	}
+	if s.Not != nil && v.check(s.Not, path, value) {
+		v.fail(path, "must not match schema of not")
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(s, path, val)
+	case []interface{}:
+		v.validateArray(s, path, val)
+	case string:
+		v.validateString(s, path, val)
+	case float64:
+		v.validateNumber(s, path, val)
+	}
+}
+
+func (v *validator) validateObject(s *Schema, path string, value map[string]interface{}) {
+	for _, name := range s.Required {
+		if _, ok := value[name]; !ok {
+			v.fail(childPath(path, name), "required")
+		}
+	}
+	keys := []string{}
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		matched := false
+		if prop, ok := s.Properties[key]; ok {
+			matched = true
+			v.validate(prop, childPath(path, key), value[key])
+		}
+		for pattern, prop := range s.PatternProperties {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				v.fail(path, "illegal patternProperties %q: %v", pattern, err)
+				continue
+			}
+			if re.MatchString(key) {
+				matched = true
+				v.validate(prop, childPath(path, key), value[key])
+			}
+		}
+		if matched {
+			continue
+		}
+		switch additional := s.AdditionalProperties; {
+		case additional != nil && additional.Schema != nil:
+			v.validate(additional.Schema, childPath(path, key), value[key])
+		case additional != nil && !additional.Allows:
+			v.fail(childPath(path, key), "unknown key")
+		case additional == nil && v.strict && len(s.Properties)+len(s.PatternProperties) > 0:
+			v.fail(childPath(path, key), "unknown key")
+		}
+	}
+}
+
+func (v *validator) validateArray(s *Schema, path string, value []interface{}) {
+	if s.MinItems != nil && int64(len(value)) < *s.MinItems {
+		v.fail(path, "must have at least %d items", *s.MinItems)
+	}
+	if s.MaxItems != nil && int64(len(value)) > *s.MaxItems {
+		v.fail(path, "must have at most %d items", *s.MaxItems)
+	}
+	if s.UniqueItems {
+		for i := range value {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					v.fail(fmt.Sprintf("%s[%d]", path, i), "duplicates item %d", j)
+				}
+			}
+		}
+	}
+	if s.Items != nil {
+		for i, item := range value {
+			v.validate(s.Items, fmt.Sprintf("%s[%d]", path, i), item)
+		}
+	}
+}
+
+func (v *validator) validateString(s *Schema, path string, value string) {
+	length := int64(len([]rune(value)))
+	if s.MinLength != nil && length < *s.MinLength {
+		v.fail(path, "must be at least %d characters", *s.MinLength)
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		v.fail(path, "must be at most %d characters", *s.MaxLength)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			v.fail(path, "illegal pattern %q: %v", s.Pattern, err)
+		} else if !re.MatchString(value) {
+			v.fail(path, "must match pattern %q", s.Pattern)
+		}
+	}
+}
+
+func (v *validator) validateNumber(s *Schema, path string, value float64) {
+	if s.Minimum != nil {
+		exclusive := s.ExclusiveMinimum != nil && s.ExclusiveMinimum.Number == nil && s.ExclusiveMinimum.Exclusive
+		if value < *s.Minimum || exclusive && value == *s.Minimum {
+			v.fail(path, "must be greater than %s%v", orEqual(!exclusive), *s.Minimum)
+		}
+	}
+	if s.ExclusiveMinimum != nil && s.ExclusiveMinimum.Number != nil && value <= *s.ExclusiveMinimum.Number {
+		v.fail(path, "must be greater than %v", *s.ExclusiveMinimum.Number)
+	}
+	if s.Maximum != nil {
+		exclusive := s.ExclusiveMaximum != nil && s.ExclusiveMaximum.Number == nil && s.ExclusiveMaximum.Exclusive
+		if value > *s.Maximum || exclusive && value == *s.Maximum {
+			v.fail(path, "must be less than %s%v", orEqual(!exclusive), *s.Maximum)
+		}
+	}
+	if s.ExclusiveMaximum != nil && s.ExclusiveMaximum.Number != nil && value >= *s.ExclusiveMaximum.Number {
+		v.fail(path, "must be less than %v", *s.ExclusiveMaximum.Number)
+	}
+}
+
+func orEqual(inclusive bool) string {
+	if inclusive {
+		return "or equal to "
+	}
+	return ""
+}
+
+func matchesType(types []string, value interface{}) bool {
+	for _, t := range types {
+		switch t {
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return true
+			}
+		case "integer":
+			if n, ok := value.(float64); ok && n == math.Trunc(n) {
+				return true
+			}
+		case "null":
+			if value == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func jsonString(value interface{}) string {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(bytes)
+}
@@ -0,0 +1,144 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+func testValues(t *testing.T, data string) map[string]interface{} {
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(data), &values); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		schema     string
+		values     string
+		strict     bool
+		violations []string
+	}{
+		{"type matched", `{properties: {port: {type: integer}, name: {type: [string, "null"]}}}`,
+			`{port: 80, name: null}`, false, nil},
+		{"type mismatch", `{properties: {port: {type: integer}, tls: {type: boolean}}}`,
+			`{port: "80", tls: 1}`, false, []string{"port: expected integer, got string", "tls: expected boolean, got number"}},
+		{"integer fraction", `{properties: {replicas: {type: integer}}}`,
+			`{replicas: 1.5}`, false, []string{"replicas: expected integer, got number"}},
+		{"required", `{required: [image], properties: {image: {type: object, required: [repository]}}}`,
+			`{}`, false, []string{"image: required"}},
+		{"nested required", `{required: [image], properties: {image: {type: object, required: [repository]}}}`,
+			`{image: {tag: latest}}`, false, []string{"image.repository: required"}},
+		{"additionalProperties false", `{properties: {a: {type: string}}, additionalProperties: false}`,
+			`{a: x, b: y}`, false, []string{"b: unknown key"}},
+		{"additionalProperties schema", `{additionalProperties: {type: string}}`,
+			`{a: x, b: 1}`, false, []string{"b: expected string, got number"}},
+		{"patternProperties", `{patternProperties: {"^x-": {type: string}}, additionalProperties: false}`,
+			`{x-a: x, z: 1}`, false, []string{"z: unknown key"}},
+		{"strict unknown key", `{properties: {a: {type: string}}}`,
+			`{a: x, b: y}`, true, []string{"b: unknown key"}},
+		{"lenient unknown key", `{properties: {a: {type: string}}}`,
+			`{a: x, b: y}`, false, nil},
+		{"$ref definitions", `{definitions: {port: {type: integer, maximum: 65535}}, properties: {port: {$ref: "#/definitions/port"}}}`,
+			`{port: 70000}`, false, []string{"port: must be less than or equal to 65535"}},
+		{"$ref $defs", `{$defs: {name: {type: string}}, properties: {name: {$ref: "#/$defs/name"}}}`,
+			`{name: 1}`, false, []string{"name: expected string, got number"}},
+		{"$ref root", `{type: object, properties: {child: {$ref: "#"}, name: {type: string}}}`,
+			`{child: {child: {name: 1}}}`, false, []string{"child.child.name: expected string, got number"}},
+		{"$ref missing", `{properties: {a: {$ref: "#/definitions/missing"}}}`,
+			`{a: 1}`, false, []string{`a: $ref "#/definitions/missing" not found`}},
+		{"$ref remote", `{properties: {a: {$ref: "https://example.com/schema.json"}}}`,
+			`{a: 1}`, false, []string{`a: unsupported $ref "https://example.com/schema.json"`}},
+		{"anyOf matched", `{properties: {size: {anyOf: [{type: integer}, {type: string, pattern: "^[0-9]+Gi$"}]}}}`,
+			`{size: 10Gi}`, false, nil},
+		{"anyOf unmatched", `{properties: {size: {anyOf: [{type: integer}, {type: string, pattern: "^[0-9]+Gi$"}]}}}`,
+			`{size: 10Mi}`, false, []string{"size: does not match any of anyOf schemas"}},
+		{"oneOf matched", `{properties: {v: {oneOf: [{type: integer}, {type: string}]}}}`,
+			`{v: x}`, false, nil},
+		{"oneOf matched twice", `{properties: {v: {oneOf: [{type: number}, {type: integer}]}}}`,
+			`{v: 1}`, false, []string{"v: must match exactly one of oneOf schemas, matched 2"}},
+		{"oneOf unmatched", `{properties: {v: {oneOf: [{type: integer}, {type: string}]}}}`,
+			`{v: true}`, false, []string{"v: must match exactly one of oneOf schemas, matched 0"}},
+		{"allOf", `{properties: {v: {allOf: [{type: string}, {minLength: 3}]}}}`,
+			`{v: ab}`, false, []string{"v: must be at least 3 characters"}},
+		{"not", `{properties: {v: {not: {type: string}}}}`,
+			`{v: x}`, false, []string{"v: must not match schema of not"}},
+		{"enum matched", `{properties: {mode: {enum: [a, b]}, level: {enum: [1, 2]}}}`,
+			`{mode: b, level: 2}`, false, nil},
+		{"enum unmatched", `{properties: {mode: {enum: [a, b]}}}`,
+			`{mode: c}`, false, []string{`mode: must be one of ["a","b"]`}},
+		{"minimum inclusive", `{properties: {v: {minimum: 1}}}`,
+			`{v: 1}`, false, nil},
+		{"exclusiveMinimum number", `{properties: {v: {exclusiveMinimum: 1}}}`,
+			`{v: 1}`, false, []string{"v: must be greater than 1"}},
+		{"exclusiveMinimum bool", `{properties: {v: {minimum: 1, exclusiveMinimum: true}}}`,
+			`{v: 1}`, false, []string{"v: must be greater than 1"}},
+		{"exclusiveMaximum number", `{properties: {v: {exclusiveMaximum: 10}}}`,
+			`{v: 9.5}`, false, nil},
+		{"exclusiveMaximum bool", `{properties: {v: {maximum: 10, exclusiveMaximum: true}}}`,
+			`{v: 10}`, false, []string{"v: must be less than 10"}},
+		{"string bounds", `{properties: {v: {minLength: 2, maxLength: 3, pattern: "^[a-z]+$"}}}`,
+			`{v: ABCD}`, false, []string{"v: must be at most 3 characters", `v: must match pattern "^[a-z]+$"`}},
+		{"array bounds", `{properties: {v: {type: array, minItems: 1, maxItems: 2, uniqueItems: true, items: {type: string}}}}`,
+			`{v: [a, a, 1]}`, false, []string{"v: must have at most 2 items", "v[1]: duplicates item 0", "v[2]: expected string, got number"}},
+	} {
+		s, err := Parse([]byte(c.schema))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		violations := []string{}
+		err = s.Validate(testValues(t, c.values), c.strict)
+		if err != nil {
+			if !IsValidationError(err) {
+				t.Errorf("%s: unexpected error %v", c.name, err)
+				continue
+			}
+			for _, v := range err.(*ValidationError).Violations {
+				violations = append(violations, v.String())
+			}
+		}
+		if len(violations) == 0 && len(c.violations) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(violations, c.violations) {
+			t.Errorf("%s: expected violations %q, got %q", c.name, c.violations, violations)
+		}
+	}
+}
+
+func TestValidateRecursiveRef(t *testing.T) {
+	s, err := Parse([]byte(`{definitions: {loop: {$ref: "#/definitions/loop"}}, properties: {a: {$ref: "#/definitions/loop"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(testValues(t, `{a: 1}`), false); !IsValidationError(err) {
+		t.Errorf("self-referencing $ref accepted: %v", err)
+	}
+}
+
+func TestParseKeywordForms(t *testing.T) {
+	s, err := Parse([]byte(`{"type": ["string", "null"], "additionalProperties": {"type": "string"}, "exclusiveMinimum": 1, "exclusiveMaximum": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Type, StringOrArray{"string", "null"}) {
+		t.Errorf("unexpected type %v", s.Type)
+	}
+	if s.AdditionalProperties == nil || !s.AdditionalProperties.Allows || s.AdditionalProperties.Schema == nil {
+		t.Errorf("unexpected additionalProperties %+v", s.AdditionalProperties)
+	}
+	if s.ExclusiveMinimum == nil || s.ExclusiveMinimum.Number == nil || *s.ExclusiveMinimum.Number != 1 {
+		t.Errorf("unexpected exclusiveMinimum %+v", s.ExclusiveMinimum)
+	}
+	if s.ExclusiveMaximum == nil || s.ExclusiveMaximum.Number != nil || !s.ExclusiveMaximum.Exclusive {
+		t.Errorf("unexpected exclusiveMaximum %+v", s.ExclusiveMaximum)
+	}
+	if _, err := Parse([]byte(`{"type": 1}`)); err == nil {
+		t.Error("illegal type accepted")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+//renderTemplate renders resources of file without a cluster connection, through the values merge and chart loading
+//of the operator, and writes manifests and hooks of each release to out
+func renderTemplate(file string, out io.Writer) error {
+	manifests, err := readManifests(file)
+	if err != nil {
+		return err
+	}
+	objects, err := loadFileObjects(option.OptionValuesObjects, option.OptionNamespace)
+	if err != nil {
+		return err
+	}
+	installers := map[schema.GroupVersionKind]helmext.Installer{}
+	for _, op := range option.Operators {
+		installer, err := helmext.NewOfflineInstaller(op.Chart, option.OptionKubeVersion, option.OptionAPIVersions,
+			installerBehavior{op, objects, option.NewChartCache(), newChartPoller(), newChartWatcher()})
+		if err != nil {
+			return err
+		}
+		installers[schema.FromAPIVersionAndKind(op.APIVersion, op.CRDKind)] = installer
+	}
+	for _, manifest := range manifests {
+		r, installer, err := parseResource(manifest, installers)
+		if err != nil {
+			return err
+		}
+		release, err := installer.DryRunRelease(r)
+		if err != nil {
+			return fmt.Errorf("%s: %v", resourceKey(r), err)
+		}
+		fmt.Fprintln(out, strings.TrimSpace(release.GetManifest()))
+		for _, hook := range release.GetHooks() {
+			fmt.Fprintf(out, "---\n# Source: %s\n%s\n", hook.GetPath(), strings.TrimSpace(hook.GetManifest()))
+		}
+	}
+	return nil
+}
+
+//parseResource resource of manifest and its installer, kind defaults to the first operator, namespace to --namespace
+func parseResource(manifest []byte, installers map[schema.GroupVersionKind]helmext.Installer) (*v1alpha1.HelmApp, helmext.Installer, error) {
+	r := &v1alpha1.HelmApp{}
+	if err := json.Unmarshal(manifest, r); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse resource: %v", err)
+	}
+	if r.APIVersion == "" && r.Kind == "" {
+		r.APIVersion, r.Kind = option.Operators[0].APIVersion, option.Operators[0].CRDKind
+	}
+	installer, ok := installers[r.GroupVersionKind()]
+	if !ok {
+		return nil, nil, fmt.Errorf("kind %s of %s not configured with --crd", r.GroupVersionKind(), r.GetName())
+	}
+	if r.GetName() == "" {
+		return nil, nil, fmt.Errorf("resource of kind %s without name", r.Kind)
+	}
+	if r.GetNamespace() == "" {
+		r.SetNamespace(option.OptionNamespace)
+	}
+	return r, installer, nil
+}
@@ -0,0 +1,156 @@
+package textdiff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//maxTableSize limit of lines product diffed by LCS, larger changes are reported as a whole replacement
+const maxTableSize = 4 << 20
+
+type edit struct {
+	kind byte
+	line string
+}
+
+//Unified diff of from and to in unified format with context lines, empty if equal (but for a missing final newline)
+func Unified(from string, to string, fromName string, toName string, context int) string {
+	if from == to {
+		return ""
+	}
+	edits := diffLines(splitLines(from), splitLines(to))
+	out := &bytes.Buffer{}
+	//line numbers of each edit in from and to
+	fromLine, toLine := make([]int, len(edits)+1), make([]int, len(edits)+1)
+	fromLine[0], toLine[0] = 1, 1
+	for i, e := range edits {
+		fromLine[i+1], toLine[i+1] = fromLine[i], toLine[i]
+		if e.kind != '+' {
+			fromLine[i+1]++
+		}
+		if e.kind != '-' {
+			toLine[i+1]++
+		}
+	}
+	for i := 0; i < len(edits); {
+		if edits[i].kind == ' ' {
+			i++
+			continue
+		}
+		start, end := i-context, i
+		if start < 0 {
+			start = 0
+		}
+		//extend hunk over changes separated by at most 2*context unchanged lines
+		for next := i; next < len(edits); next++ {
+			if edits[next].kind != ' ' {
+				end = next
+			} else if next-end > 2*context {
+				break
+			}
+		}
+		end += context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fromCount, toCount := fromLine[end]-fromLine[start], toLine[end]-toLine[start]
+		fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(fromLine[start], fromCount), hunkRange(toLine[start], toCount))
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(out, "%c%s\n", e.kind, e.line)
+		}
+		i = end
+	}
+	return out.String()
+}
+
+func hunkRange(line int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", line-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+//diffLines edit script of a to b, by longest common subsequence after trimming common prefix and suffix
+func diffLines(a []string, b []string) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	edits := []edit{}
+	for _, line := range a[:prefix] {
+		edits = append(edits, edit{' ', line})
+	}
+	edits = append(edits, lcsEdits(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, edit{' ', line})
+	}
+	return edits
+}
+
+func lcsEdits(a []string, b []string) []edit {
+	edits := []edit{}
+	if len(a)*len(b) > maxTableSize {
+		for _, line := range a {
+			edits = append(edits, edit{'-', line})
+		}
+		for _, line := range b {
+			edits = append(edits, edit{'+', line})
+		}
+		return edits
+	}
+	//lcs[i][j] length of LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		edits = append(edits, edit{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		edits = append(edits, edit{'+', b[j]})
+	}
+	return edits
+}
@@ -0,0 +1,98 @@
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		from     string
+		to       string
+		context  int
+		expected string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", 3, ""},
+		{"final newline only", "a\nb", "a\nb\n", 3, ""},
+		{"empty from", "", "a\nb\n", 3,
+			"--- from\n+++ to\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"empty to", "a\nb\n", "", 3,
+			"--- from\n+++ to\n@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"single line", "a\n", "b\n", 3,
+			"--- from\n+++ to\n@@ -1 +1 @@\n-a\n+b\n"},
+		{"changed line", "1\n2\n3\n4\n5\n", "1\n2\nx\n4\n5\n", 1,
+			"--- from\n+++ to\n@@ -2,3 +2,3 @@\n 2\n-3\n+x\n 4\n"},
+		{"inserted line", "1\n2\n3\n4\n", "1\n2\nx\n3\n4\n", 1,
+			"--- from\n+++ to\n@@ -2,2 +2,3 @@\n 2\n+x\n 3\n"},
+		{"separate hunks", "a\nb\nc\nd\ne\nf\ng\nh\ni\n", "a\nB\nc\nd\ne\nf\ng\nH\ni\n", 1,
+			"--- from\n+++ to\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n@@ -7,3 +7,3 @@\n g\n-h\n+H\n i\n"},
+		{"merged hunks", "a\nb\nc\nd\ne\nf\ng\nh\ni\n", "a\nB\nc\nd\ne\nf\ng\nH\ni\n", 3,
+			"--- from\n+++ to\n@@ -1,9 +1,9 @@\n a\n-b\n+B\n c\n d\n e\n f\n g\n-h\n+H\n i\n"},
+		{"no context", "a\nb\nc\n", "a\nx\nc\n", 0,
+			"--- from\n+++ to\n@@ -2 +2 @@\n-b\n+x\n"},
+	} {
+		if actual := Unified(c.from, c.to, "from", "to", c.context); actual != c.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", c.name, c.expected, actual)
+		}
+	}
+}
+
+//apply edits, returning lines of from and to
+func apply(edits []edit) ([]string, []string) {
+	from, to := []string{}, []string{}
+	for _, e := range edits {
+		if e.kind != '+' {
+			from = append(from, e.line)
+		}
+		if e.kind != '-' {
+			to = append(to, e.line)
+		}
+	}
+	return from, to
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, c := range []struct {
+		a, b   string
+		common int
+	}{
+		{"a b c a b b a", "c b a b a c", 4},
+		{"x a b c y", "z a b c w", 3},
+		{"a b c", "d e f", 0},
+		{"", "a b", 0},
+		{"a b", "", 0},
+	} {
+		a, b := strings.Fields(c.a), strings.Fields(c.b)
+		edits := diffLines(a, b)
+		from, to := apply(edits)
+		if strings.Join(from, " ") != c.a || strings.Join(to, " ") != c.b {
+			t.Errorf("%q to %q: edits %v do not apply", c.a, c.b, edits)
+		}
+		common := 0
+		for _, e := range edits {
+			if e.kind == ' ' {
+				common++
+			}
+		}
+		if common != c.common {
+			t.Errorf("%q to %q: %d common lines, expected %d", c.a, c.b, common, c.common)
+		}
+	}
+}
+
+func TestDiffLinesBeyondTable(t *testing.T) {
+	a, b := []string{"head"}, []string{"head"}
+	for i := 0; i < 2100; i++ {
+		a, b = append(a, fmt.Sprintf("a%d", i)), append(b, fmt.Sprintf("b%d", i))
+	}
+	edits := diffLines(a, b)
+	if len(edits) != 1+2*2100 || edits[0].kind != ' ' || edits[1].kind != '-' || edits[2100].kind != '-' || edits[2101].kind != '+' {
+		t.Errorf("change beyond table size not replaced as a whole")
+	}
+	from, to := apply(edits)
+	if strings.Join(from, "\n") != strings.Join(a, "\n") || strings.Join(to, "\n") != strings.Join(b, "\n") {
+		t.Errorf("edits do not apply")
+	}
+}
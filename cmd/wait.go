@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+//waitInstalled waits until the operator applied resource name, that is its spec-checksum annotation equals specChecksum
+//of written, the resource just created or updated by install (or of the resource itself if nil), and its phase is
+//Applied or Failed. The operator writes both along with the status of each apply, stale phases do not count
+func waitInstalled(client dynamic.ResourceInterface, name string, written *unstructured.Unstructured) error {
+	if !option.OptionWait {
+		return nil
+	}
+	expected := ""
+	if written != nil {
+		r, err := resourceOf(written)
+		if err != nil {
+			return err
+		}
+		expected = specChecksum(r)
+	}
+	logger.Printf("Waiting for CRD resource applied: %s", name)
+	return waitResource(client, name, func(r *v1alpha1.HelmApp) (bool, error) {
+		if r == nil {
+			return false, fmt.Errorf("%s deleted", name)
+		}
+		checksum := expected
+		if checksum == "" {
+			checksum = specChecksum(r)
+		}
+		if r.GetAnnotations()[helmext.OptionAnnotation(r, optionSpecChecksum)] != checksum {
+			return false, nil
+		}
+		switch r.Status.Phase {
+		case v1alpha1.PhaseFailed:
+			return false, fmt.Errorf("%s failed: %s: %s", name, r.Status.Reason, r.Status.Message)
+		case v1alpha1.PhaseApplied:
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+//waitUninstalled waits until the finalizer of resource name is removed and the resource is gone
+func waitUninstalled(client dynamic.ResourceInterface, name string) error {
+	if !option.OptionWait {
+		return nil
+	}
+	logger.Printf("Waiting for CRD resource removed: %s", name)
+	return waitResource(client, name, func(r *v1alpha1.HelmApp) (bool, error) {
+		return r == nil, nil
+	})
+}
+
+//waitResource watches resource name until done, or --timeout. done is called with nil once the resource is gone
+func waitResource(client dynamic.ResourceInterface, name string, done func(r *v1alpha1.HelmApp) (bool, error)) error {
+	var timeout <-chan time.Time
+	if option.OptionWaitTimeout > 0 {
+		timeout = time.After(time.Duration(option.OptionWaitTimeout) * time.Second)
+	}
+	for {
+		var r *v1alpha1.HelmApp
+		obj, err := client.Get(name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if r, err = resourceOf(obj); err != nil {
+				return err
+			}
+		}
+		if ok, err := done(r); ok || err != nil {
+			return err
+		}
+		opts := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()}
+		if r != nil {
+			opts.ResourceVersion = r.GetResourceVersion()
+		}
+		w, err := client.Watch(opts)
+		if err != nil {
+			return err
+		}
+		ok, err := watchResource(w, timeout, done)
+		w.Stop()
+		if ok || err != nil {
+			return err
+		}
+		//watch closed, get and watch again
+	}
+}
+
+func watchResource(w watch.Interface, timeout <-chan time.Time, done func(r *v1alpha1.HelmApp) (bool, error)) (bool, error) {
+	for {
+		select {
+		case <-timeout:
+			return false, fmt.Errorf("timed out after %ds", option.OptionWaitTimeout)
+		case event, ok := <-w.ResultChan():
+			if !ok || event.Type == watch.Error {
+				return false, nil
+			}
+			var r *v1alpha1.HelmApp
+			if event.Type != watch.Deleted {
+				obj, ok := event.Object.(*unstructured.Unstructured)
+				if !ok {
+					continue
+				}
+				var err error
+				if r, err = resourceOf(obj); err != nil {
+					return false, err
+				}
+			}
+			if ok, err := done(r); ok || err != nil {
+				return ok, err
+			}
+		}
+	}
+}
+
+func resourceOf(obj *unstructured.Unstructured) (*v1alpha1.HelmApp, error) {
+	r := &v1alpha1.HelmApp{}
+	if err := k8sutil.UnstructuredIntoRuntimeObject(obj, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
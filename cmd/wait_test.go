@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+func TestSpecChecksumIgnoresOperatorOptions(t *testing.T) {
+	r := testResource(map[string]string{"chart": "redis"})
+	r.Spec = v1alpha1.HelmAppSpec{"replicas": 1}
+	submitted := specChecksum(r)
+
+	applied := r.DeepCopy()
+	applied.Status = *applied.Status.SetPhase(v1alpha1.PhaseApplied, "", "")
+	annotations := applied.GetAnnotations()
+	for _, option := range []string{"checksum", optionSpecChecksum, helmext.OptionChartRevision, helmext.OptionRollbackRevision} {
+		annotations[helmext.OptionAnnotation(applied, option)] = "x"
+	}
+	if specChecksum(applied) != submitted {
+		t.Errorf("checksum changed by options of operator")
+	}
+
+	changed := r.DeepCopy()
+	changed.Spec = v1alpha1.HelmAppSpec{"replicas": 2}
+	if specChecksum(changed) == submitted {
+		t.Errorf("checksum unchanged by spec")
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/xiaopal/helm-app-operator/cmd/option"
+
+	"github.com/ghodss/yaml"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+	api "k8s.io/kubernetes/pkg/apis/core"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+
+	"github.com/xiaopal/helm-app-operator/cmd/apis/v1alpha1"
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+const webhookPath = "/validate"
+
+//webhookTimeout bounds reading and answering an admission review, well within the 30s the API server waits
+const webhookTimeout = 10 * time.Second
+
+//webhookServer validating admission webhook, rejecting resources failing values merge, validation or dry-run render
+type webhookServer struct {
+	installers map[schema.GroupVersionKind]helmext.Installer
+	clientset  internalclientset.Interface
+}
+
+//webhookLoadTimeout bounds loading chart of a review through the shared chart cache, leaving time to render within webhookTimeout
+const webhookLoadTimeout = 5 * time.Second
+
+//webhookBehavior installer behavior of webhook, loading charts through the shared chart cache within webhookLoadTimeout
+type webhookBehavior struct {
+	installerBehavior
+}
+
+//chartNotLoadedError chart of resource failed to load, or not loaded within webhookLoadTimeout
+type chartNotLoadedError struct {
+	Chart string
+	Err   error
+}
+
+func (e *chartNotLoadedError) Error() string {
+	return fmt.Sprintf("chart %s not loaded: %v", e.Chart, e.Err)
+}
+
+//TranslateChartPath keeps chart path, translated by ReadChart within webhookLoadTimeout
+func (c webhookBehavior) TranslateChartPath(r *v1alpha1.HelmApp, chartPath string) (string, error) {
+	return chartPath, nil
+}
+
+//ReadChart translates and loads chart of r as reconciles do, through the shared chart cache. Loading on after
+//webhookLoadTimeout is left in background, warming the cache for the reconcile
+func (c webhookBehavior) ReadChart(r *v1alpha1.HelmApp, chartPath string) (*cpb.Chart, error) {
+	type loaded struct {
+		chart *cpb.Chart
+		err   error
+	}
+	done, copied := make(chan loaded, 1), r.DeepCopy()
+	go func() {
+		chartPath, err := c.installerBehavior.TranslateChartPath(copied, chartPath)
+		if err != nil {
+			done <- loaded{nil, err}
+			return
+		}
+		chart, err := c.installerBehavior.ReadChart(copied, chartPath)
+		done <- loaded{chart, err}
+	}()
+	chart := helmext.ReleaseOption(r, helmext.OptionChart, c.operator.Chart)
+	select {
+	case result := <-done:
+		if result.err != nil {
+			return nil, &chartNotLoadedError{chart, result.err}
+		}
+		return result.chart, nil
+	case <-time.After(webhookLoadTimeout):
+		return nil, &chartNotLoadedError{chart, fmt.Errorf("timed out after %v", webhookLoadTimeout)}
+	}
+}
+
+//Run serves webhook over HTTPS until ctx done
+func (s *webhookServer) Run(ctx context.Context, addr string) {
+	cert, _, err := webhookCertificate(s.clientset)
+	if err != nil {
+		logger.Errorf("admission webhook stopped: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookPath, s.serve)
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		ReadTimeout:  webhookTimeout,
+		WriteTimeout: webhookTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Printf("serving admission webhook on %s", addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("admission webhook stopped: %v", err)
+	}
+}
+
+func (s *webhookServer) serve(w http.ResponseWriter, req *http.Request) {
+	review := &admissionv1beta1.AdmissionReview{}
+	if err := json.NewDecoder(req.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("illegal admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = s.admit(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+func (s *webhookServer) admit(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	allowed := &admissionv1beta1.AdmissionResponse{Allowed: true}
+	installer, ok := s.installers[schema.GroupVersionKind{Group: req.Kind.Group, Version: req.Kind.Version, Kind: req.Kind.Kind}]
+	if !ok || req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return allowed
+	}
+	r := &v1alpha1.HelmApp{}
+	if err := json.Unmarshal(req.Object.Raw, r); err != nil {
+		return denied(metav1.StatusReasonBadRequest, err)
+	}
+	if len(r.GetNamespace()) == 0 {
+		r.SetNamespace(req.Namespace)
+	}
+	if r.GetDeletionTimestamp() != nil {
+		return allowed
+	}
+	if req.Operation == admissionv1beta1.Update {
+		old := &v1alpha1.HelmApp{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err == nil && !releaseChanged(old, r) {
+			//status, finalizers or operator annotations updated
+			return allowed
+		}
+	}
+	logger := resourceLogger(r, "webhook")
+	if _, err := installer.DryRunRelease(r); err != nil {
+		if _, ok := err.(*chartNotLoadedError); ok {
+			logger.Printf("admitted %s without validation: %v", req.Operation, err)
+			return allowed
+		}
+		logger.Printf("denied %s: %v", req.Operation, err)
+		return denied(metav1.StatusReason(failureReason(err)), err)
+	}
+	return allowed
+}
+
+//releaseChanged whether update of resource changes its release
+func releaseChanged(old *v1alpha1.HelmApp, r *v1alpha1.HelmApp) bool {
+	annotations := func(r *v1alpha1.HelmApp) map[string]string {
+		result := map[string]string{}
+		for k, v := range r.GetAnnotations() {
+			if k != helmext.OptionAnnotation(r, "checksum") && k != helmext.OptionAnnotation(r, optionSpecChecksum) &&
+				k != helmext.OptionAnnotation(r, helmext.OptionChartRevision) {
+				result[k] = v
+			}
+		}
+		return result
+	}
+	return !reflect.DeepEqual(old.Spec, r.Spec) ||
+		!reflect.DeepEqual(old.GetLabels(), r.GetLabels()) ||
+		!reflect.DeepEqual(annotations(old), annotations(r))
+}
+
+func denied(reason metav1.StatusReason, err error) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  reason,
+			Message: err.Error(),
+		},
+	}
+}
+
+//webhookCertificate serving certificate and CA bundle of webhook, from --webhook-cert-dir,
+//or the --webhook-secret Secret, which is self-generated if not exists
+func webhookCertificate(clientset internalclientset.Interface) (tls.Certificate, []byte, error) {
+	if len(option.OptionWebhookCertDir) > 0 {
+		certFile, keyFile := filepath.Join(option.OptionWebhookCertDir, "tls.crt"), filepath.Join(option.OptionWebhookCertDir, "tls.key")
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return cert, nil, err
+		}
+		caBundle, err := ioutil.ReadFile(filepath.Join(option.OptionWebhookCertDir, "ca.crt"))
+		if err != nil {
+			caBundle, err = ioutil.ReadFile(certFile)
+		}
+		return cert, caBundle, err
+	}
+	secrets := clientset.Core().Secrets(option.OptionWebhookNamespace)
+	secret, err := secrets.Get(option.OptionWebhookSecret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		data, genErr := generateWebhookCertificate()
+		if genErr != nil {
+			return tls.Certificate{}, nil, genErr
+		}
+		secret, err = secrets.Create(&api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: option.OptionWebhookSecret, Namespace: option.OptionWebhookNamespace},
+			Type:       api.SecretTypeTLS,
+			Data:       data,
+		})
+		if err == nil {
+			logger.Printf("generated admission webhook certificate %s/%s", option.OptionWebhookNamespace, option.OptionWebhookSecret)
+		} else if apierrors.IsAlreadyExists(err) {
+			secret, err = secrets.Get(option.OptionWebhookSecret, metav1.GetOptions{})
+		}
+	}
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to get admission webhook certificate: %v", err)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[api.TLSCertKey], secret.Data[api.TLSPrivateKeyKey])
+	if err != nil {
+		return cert, nil, err
+	}
+	caBundle, ok := secret.Data["ca.crt"]
+	if !ok {
+		caBundle = secret.Data[api.TLSCertKey]
+	}
+	return cert, caBundle, nil
+}
+
+//generateWebhookCertificate self-signed CA and serving certificate of --webhook-service
+func generateWebhookCertificate() (map[string][]byte, error) {
+	service, namespace := option.OptionWebhookService, option.OptionWebhookNamespace
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s-ca", service)},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("%s.%s.svc", service, namespace)},
+		DNSNames: []string{
+			service,
+			fmt.Sprintf("%s.%s", service, namespace),
+			fmt.Sprintf("%s.%s.svc", service, namespace),
+			fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.AddDate(10, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		api.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		api.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"ca.crt":             pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+	}, nil
+}
+
+//printWebhookConfiguration prints ValidatingWebhookConfiguration of watched kinds
+func printWebhookConfiguration(clientset internalclientset.Interface) error {
+	_, caBundle, err := webhookCertificate(clientset)
+	if err != nil {
+		return err
+	}
+	path, failurePolicy := webhookPath, admissionregistrationv1beta1.FailurePolicyType(option.OptionWebhookFailurePolicy)
+	clientConfig := admissionregistrationv1beta1.WebhookClientConfig{CABundle: caBundle}
+	if len(option.OptionWebhookURL) > 0 {
+		url := option.OptionWebhookURL + webhookPath
+		clientConfig.URL = &url
+	} else {
+		clientConfig.Service = &admissionregistrationv1beta1.ServiceReference{
+			Namespace: option.OptionWebhookNamespace,
+			Name:      option.OptionWebhookService,
+			Path:      &path,
+		}
+	}
+	config := &admissionregistrationv1beta1.ValidatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1beta1", Kind: "ValidatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: option.OptionWebhookService},
+	}
+	for _, op := range option.Operators {
+		config.Webhooks = append(config.Webhooks, admissionregistrationv1beta1.Webhook{
+			Name:         fmt.Sprintf("%s.%s", op.CRDSingular, op.CRDGroup),
+			ClientConfig: clientConfig,
+			Rules: []admissionregistrationv1beta1.RuleWithOperations{{
+				Operations: []admissionregistrationv1beta1.OperationType{admissionregistrationv1beta1.Create, admissionregistrationv1beta1.Update},
+				Rule: admissionregistrationv1beta1.Rule{
+					APIGroups:   []string{op.CRDGroup},
+					APIVersions: []string{op.CRDVersion},
+					Resources:   []string{op.CRDPlural},
+				},
+			}},
+			FailurePolicy: &failurePolicy,
+		})
+	}
+	bytes, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(bytes))
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/helm/pkg/storage"
+	"k8s.io/helm/pkg/storage/driver"
+
+	"github.com/xiaopal/helm-app-operator/cmd/helmext"
+)
+
+func TestWebhookLoadsCharts(t *testing.T) {
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+	webhook := webhookBehavior{behavior}
+	dir, err := ioutil.TempDir("", "chart-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte("apiVersion: v1\nname: redis\nversion: 1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	//never reconciled
+	r := testResource(map[string]string{"chart": dir})
+	chart, err := webhook.ReadChart(r, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chart.GetMetadata().GetName() != "redis" {
+		t.Errorf("unexpected chart %v", chart.GetMetadata())
+	}
+	if r.Status.Chart != nil {
+		t.Errorf("status of reviewed resource changed")
+	}
+
+	missing := testResource(map[string]string{"chart": filepath.Join(dir, "missing")})
+	if _, err := webhook.ReadChart(missing, ""); err == nil {
+		t.Errorf("read missing chart")
+	} else if _, ok := err.(*chartNotLoadedError); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAdmitChartFailingToLoad(t *testing.T) {
+	behavior, cleanup := testBehavior(t)
+	defer cleanup()
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "TestApp"}
+	server := &webhookServer{installers: map[schema.GroupVersionKind]helmext.Installer{
+		gvk: helmext.NewInstallerWithBehavior(storage.Init(driver.NewMemory()), nil, "", webhookBehavior{behavior}),
+	}}
+	response := server.admit(&admissionv1beta1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Namespace: "default",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{Raw: []byte(`{"apiVersion":"example.com/v1","kind":"TestApp",` +
+			`"metadata":{"name":"never-loaded","annotations":{"test-operator/chart":"oci://127.0.0.1:1/redis:1.0.0"}}}`)},
+	})
+	if !response.Allowed {
+		t.Errorf("denied resource of chart failing to load: %v", response.Result)
+	}
+}